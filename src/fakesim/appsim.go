@@ -0,0 +1,593 @@
+package fakesim
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/alialkhalidi/da-license-proxy/src/gmlserver"
+)
+
+const (
+	defaultClientID = "myClientID"
+	termsVersion    = "2026.1"
+	termsContent    = "These fake terms govern the use of the fake lockbox."
+)
+
+// account is a MyAM user and, once created, their lockbox
+type account struct {
+	User
+	// consented are the clients the user has allowed, MyAM skips the consent page for them
+	consented map[string]bool
+	lockbox   *lockbox
+}
+
+// lockbox is what the DLBP keeps of a user's lockbox
+type lockbox struct {
+	created                gmlserver.CreateLockboxRespBody
+	recovery               *gmlserver.DetailedRecoveryInfo
+	masterPrivateKey       string
+	pseudoDevicePrivateKey string
+	acceptedTerms          termsAcceptance
+	assets                 []gmlserver.CreateDigitalAssetRespBody
+	licenses               []License
+}
+
+// serverState is the device state the simulator server hands out base64url encoded as serverState, the part of
+// gmlserver.DLBstate the license flow touches
+type serverState struct {
+	CreateLockboxResponse  *gmlserver.CreateLockboxRespBody                `json:"createLockBoxBody,omitempty"`
+	RecoveryInfo           *gmlserver.DetailedRecoveryInfo                 `json:"detailedRecoveryInfo,omitempty"`
+	MasterPrivateKey       string                                          `json:"masterPrivateKey,omitempty"`
+	PseudoDevicePrivateKey string                                          `json:"pseudoDevicePrivateKey,omitempty"`
+	DAList                 map[string]gmlserver.CreateDigitalAssetRespBody `json:"daList,omitempty"`
+	LastLicenseRequest     *lastLicenseRequest                             `json:"lastLicenseRequest,omitempty"`
+	PseudonymDeviceKeyMap  map[string]string                               `json:"pseudoDeviceKeyMap,omitempty"`
+	CurrentTermsInfo       *termsAcceptance                                `json:"currentTermsInfo,omitempty"`
+	AcceptedTerms          *termsAcceptance                                `json:"acceptedTerms,omitempty"`
+	ClientID               string                                          `json:"clientId,omitempty"`
+	OrgCodes               []gmlserver.ChannelCodeWithExpiry               `json:"orgCodes"`
+}
+
+type lastLicenseRequest struct {
+	LicenseRequestID  string                       `json:"licenseRequestId"`
+	DacLicenseRequest *gmlserver.DACLicenseRequest `json:"dacLicenseRequest"`
+	RequestInfo       string                       `json:"requestInfo"`
+	PseudonymID       string                       `json:"pseudonymId,omitempty"`
+	PseudonymIDSalt   string                       `json:"pseudonymIdSalt,omitempty"`
+}
+
+type termsAcceptance struct {
+	Locale      string `json:"locale"`
+	Version     string `json:"version"`
+	ContentHash string `json:"contentHash"`
+}
+
+// License is what the fake issues: base64url encoded JSON, where a real simulator server issues a JWE
+type License struct {
+	LicenseRequestID string          `json:"licenseRequestId"`
+	DacID            string          `json:"dacId"`
+	Assets           []LicensedAsset `json:"assets"`
+	IssuedAt         int64           `json:"issuedAt"`
+}
+
+// LicensedAsset is a digital asset a license gives the DAC
+type LicensedAsset struct {
+	Name             string `json:"name"`
+	DigitalAssetID   string `json:"digitalAssetId"`
+	DigitalAssetType string `json:"digitalAssetType"`
+	SeqNo            int    `json:"seqNo"`
+}
+
+// DecodeLicense decodes a license issued by the fake
+func DecodeLicense(license string) (*License, error) {
+	data, err := gmlserver.Base64URLDecode(license)
+	if err != nil {
+		return nil, fmt.Errorf("license is not base64url: %v", err)
+	}
+	decoded := new(License)
+	if err = json.Unmarshal(data, decoded); err != nil {
+		return nil, fmt.Errorf("license is not a fake license: %v", err)
+	}
+	return decoded, nil
+}
+
+// Licenses returns the licenses issued for username's assets, oldest first
+func (s *Server) Licenses(username string) []License {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok || user.lockbox == nil {
+		return nil
+	}
+	return append([]License(nil), user.lockbox.licenses...)
+}
+
+func (s *Server) requestObject(w http.ResponseWriter, r *http.Request) {
+	var req gmlserver.RequestObjectReq
+	if !decode(w, r, &req.Body) {
+		return
+	}
+	body := req.Body.RequestObjBody
+	switch {
+	case body == nil:
+		fail(w, http.StatusBadRequest, "INVALID_REQUEST", "requestObjBody is required")
+		return
+	case body.Provider == "" || !strings.Contains(" "+body.Scopes+" ", " openid "):
+		fail(w, http.StatusBadRequest, "INVALID_REQUEST", "provider_url and the openid scope are required")
+		return
+	case body.CodeChallengeMethod != "S256" || body.CodeChallenge == "":
+		fail(w, http.StatusBadRequest, "INVALID_REQUEST", "a S256 code_challenge is required")
+		return
+	}
+	request := &requestObject{clientID: body.ClientID, scopes: body.Scopes, acrValues: body.AcrValues, state: body.State,
+		uiLocales: body.UILocales, codeChallenge: body.CodeChallenge}
+	if request.clientID == "" {
+		request.clientID = defaultClientID
+	}
+	id := randomID(24)
+	s.mu.Lock()
+	s.requestObjects[id] = request
+	s.mu.Unlock()
+
+	query := url.Values{"client_id": {request.clientID}, "request": {id}, "ui_locales": {request.uiLocales},
+		"scope": {request.scopes}, "acr_values": {request.acrValues}}
+	var resp gmlserver.RequestObjectResp
+	resp.Body.LoginURL = s.URL + "/myam/oidc/authorize?" + query.Encode()
+	accepted(w, resp.Body)
+}
+
+func (s *Server) accessToken(w http.ResponseWriter, r *http.Request) {
+	var req gmlserver.AccessTokenReq
+	if !decode(w, r, &req.Body) {
+		return
+	}
+	body := req.Body.AccessTokenBody
+	if body == nil {
+		fail(w, http.StatusBadRequest, "INVALID_REQUEST", "accessTokenBody is required")
+		return
+	}
+	clientID := body.ClientID
+	if clientID == "" {
+		clientID = defaultClientID
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	grant, ok := s.grants[body.AuthCode]
+	// an auth code is good for one exchange, whatever its outcome
+	delete(s.grants, body.AuthCode)
+	switch {
+	case !ok:
+		fail(w, http.StatusBadRequest, "INVALID_GRANT", "unknown or used authCode")
+		return
+	case grant.request.clientID != clientID:
+		fail(w, http.StatusBadRequest, "INVALID_GRANT", "authCode was issued to another client")
+		return
+	}
+	challenge := sha256.Sum256([]byte(body.CodeVerifier))
+	if gmlserver.Base64URLEncode(challenge[:]) != grant.request.codeChallenge {
+		fail(w, http.StatusBadRequest, "INVALID_GRANT", "code_verifier does not match the code_challenge")
+		return
+	}
+	token := randomID(32)
+	s.tokens[token] = grant.username
+
+	var resp gmlserver.AccessTokenResp
+	resp.Body.AccessToken = token
+	resp.Body.IDToken = idToken(s.URL+"/myam/oidc", grant.username, clientID)
+	accepted(w, resp.Body)
+}
+
+func (s *Server) recoverLockbox(w http.ResponseWriter, r *http.Request) {
+	var req gmlserver.RecoverLockboxReq
+	if !decode(w, r, &req.Body) || !required(w, req.Body.RecoverLockBoxBody, "recoverLockboxBody") {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.authorized(w, req.Body.RecoverLockBoxBody.AccessToken)
+	if !ok {
+		return
+	}
+	if user.lockbox == nil {
+		fail(w, http.StatusNotFound, "LOCKBOX_NOT_FOUND", "the user has no lockbox")
+		return
+	}
+	lb := user.lockbox
+	recovered := &gmlserver.RecoverLockboxRespBody{CreateLockboxRespBody: lb.created, Assets: lb.assets,
+		TermsInfo: currentTerms(req.Body.RecoverLockBoxBody.Locale)}
+	var resp gmlserver.RecoverLockboxResp
+	resp.Body.RecoverLockboxBody = recovered
+	resp.Body.ServerState = encodeState(lb.state(nil, req.Body.RecoverLockBoxBody.ClientID))
+	accepted(w, resp.Body)
+}
+
+func (s *Server) retrieveCurrentTerms(w http.ResponseWriter, r *http.Request) {
+	var req gmlserver.RetrieveCurrentTermsReq
+	if !decode(w, r, &req.Body) || !required(w, req.Body.RetrieveCurrentTermsBody, "retrieveCurrentTermsBody") {
+		return
+	}
+	body := req.Body.RetrieveCurrentTermsBody
+	state, ok := decodeState(w, body.ServerState, false)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok = s.authorized(w, body.AccessToken); !ok {
+		return
+	}
+	terms := currentTerms(body.Locale)
+	state.CurrentTermsInfo = &termsAcceptance{Locale: terms.Locale, Version: terms.Version, ContentHash: contentHash(terms.Content)}
+	if body.ClientID != "" {
+		state.ClientID = body.ClientID
+	}
+	var resp gmlserver.RetrieveCurrentTermsResp
+	resp.Body.RetrieveCurrentTermsRespBody = &gmlserver.RetrieveCurrentTermsRespBody{TermsInfo: terms}
+	resp.Body.ServerState = encodeState(state)
+	accepted(w, resp.Body)
+}
+
+func (s *Server) createLockbox(w http.ResponseWriter, r *http.Request) {
+	var req gmlserver.CreateLockboxReq
+	if !decode(w, r, &req.Body) || !required(w, req.Body.CreateLockBoxbody, "createLockboxBody") {
+		return
+	}
+	body := req.Body.CreateLockBoxbody
+	state, ok := decodeState(w, body.ServerState, true)
+	if !ok {
+		return
+	}
+	if state.CurrentTermsInfo == nil {
+		fail(w, http.StatusBadRequest, "TERMS_NOT_RETRIEVED", "call retrieveCurrentTerms before createLockbox")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.authorized(w, body.AccessToken)
+	if !ok {
+		return
+	}
+	if user.lockbox != nil {
+		fail(w, http.StatusConflict, "LOCKBOX_EXISTS", "the user already has a lockbox")
+		return
+	}
+	lb := newLockbox(*state.CurrentTermsInfo, !body.DoNotCreateRecoveryData)
+	user.lockbox = lb
+	for _, assetType := range body.AssetTypes {
+		lb.created.CreatedAssets = append(lb.created.CreatedAssets, lb.addAsset(assetType))
+	}
+
+	var resp gmlserver.CreateLockboxResp
+	resp.Body.CreateLockboxBody = &lb.created
+	resp.Body.ServerState = encodeState(lb.state(state, state.ClientID))
+	accepted(w, resp.Body)
+}
+
+func (s *Server) createDigitalAsset(w http.ResponseWriter, r *http.Request) {
+	var req gmlserver.CreateDigitalAssetReq
+	if !decode(w, r, &req.Body) || !required(w, req.Body.CreateDigitalAssetBody, "CreateDigitalAssetBody") {
+		return
+	}
+	body := req.Body.CreateDigitalAssetBody
+	if len(body.AssetTypes) == 0 {
+		fail(w, http.StatusBadRequest, "INVALID_REQUEST", "assetTypes is required")
+		return
+	}
+	state, ok := decodeState(w, body.ServerState, true)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lb, ok := s.lockboxFor(w, body.AccessToken, state)
+	if !ok {
+		return
+	}
+	var resp gmlserver.CreateDigitalAssetResp
+	for _, assetType := range body.AssetTypes {
+		resp.Body.CreateDigitalAssetBody = append(resp.Body.CreateDigitalAssetBody, lb.addAsset(assetType))
+	}
+	resp.Body.ServerState = encodeState(lb.state(state, state.ClientID))
+	accepted(w, resp.Body)
+}
+
+func (s *Server) retrieveLicenseRequest(w http.ResponseWriter, r *http.Request) {
+	var req gmlserver.RetrieveLicenseRequestReq
+	if !decode(w, r, &req.Body) || !required(w, req.Body.RetrieveLicenseRequestBody, "retrieveLicenseRequestBody") {
+		return
+	}
+	body := req.Body.RetrieveLicenseRequestBody
+	state, ok := decodeState(w, body.ServerState, true)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lb, ok := s.lockboxFor(w, body.AccessToken, state)
+	if !ok {
+		return
+	}
+	request, ok := s.licenseRequests[body.LicenseRequestID]
+	switch {
+	case !ok:
+		fail(w, http.StatusNotFound, "LICENSE_REQUEST_NOT_FOUND", "no license request "+body.LicenseRequestID)
+		return
+	case body.RequestEncKey != request.EncKey:
+		fail(w, http.StatusBadRequest, "DECRYPTION_FAILED", "the license request does not decrypt with requestEncKey")
+		return
+	}
+
+	dacRequest := &gmlserver.DACLicenseRequest{
+		DacID:                  request.DacID,
+		DacIDSalt:              randomID(16),
+		RequestSalt:            randomID(16),
+		QueryExpression:        queryExpression(request.AssetTypes),
+		QueryExpressionSalt:    randomID(16),
+		LicenseNotificationURL: s.URL + "/dac/licenses",
+		LicenseEncKey:          randomID(32),
+		DisplayText:            map[string]string{"en": "Fake DAC asks for your identity"},
+		DefaultLang:            "en",
+		State:                  randomID(8),
+		StateSalt:              randomID(16),
+	}
+	encRequest, _ := json.Marshal(dacRequest)
+	requestHash := sha256.Sum256(encRequest)
+	state.LastLicenseRequest = &lastLicenseRequest{LicenseRequestID: request.ID, DacLicenseRequest: dacRequest,
+		RequestInfo: gmlserver.Base64URLEncode(encRequest), PseudonymID: lb.created.Pseudonym.ID, PseudonymIDSalt: randomID(16)}
+
+	var resp gmlserver.RetrieveLicenseRequestResp
+	resp.Body.CLR = &gmlserver.RetrieveLicenseRequestrespbody{EncRequest: gmlserver.Base64URLEncode(encRequest),
+		DecryptedRequest: dacRequest, RequestHash: gmlserver.Base64URLEncode(requestHash[:])}
+	resp.Body.LicenseRequestID = request.ID
+	resp.Body.ServerState = encodeState(lb.state(state, state.ClientID))
+	accepted(w, resp.Body)
+}
+
+func (s *Server) issueLicense(w http.ResponseWriter, r *http.Request) {
+	var req gmlserver.IssueLicenseReq
+	if !decode(w, r, &req.Body) || !required(w, req.Body.IssueLicenseBody, "issueLicenseBody") {
+		return
+	}
+	body := req.Body.IssueLicenseBody
+	state, ok := decodeState(w, body.ServerState, true)
+	if !ok {
+		return
+	}
+	if state.LastLicenseRequest == nil || state.LastLicenseRequest.LicenseRequestID != body.LicenseRequestID {
+		fail(w, http.StatusBadRequest, "LICENSE_REQUEST_NOT_RETRIEVED", "call retrieveLicenseRequest for "+body.LicenseRequestID+" first")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lb, ok := s.lockboxFor(w, body.AccessToken, state)
+	if !ok {
+		return
+	}
+	request := s.licenseRequests[body.LicenseRequestID]
+
+	license := License{LicenseRequestID: request.ID, DacID: request.DacID, IssuedAt: time.Now().Unix()}
+	var matched []*gmlserver.CreateDigitalAssetRespBody
+	for i, assetType := range request.AssetTypes {
+		name := fmt.Sprintf("asset%d", i+1)
+		var asset *gmlserver.CreateDigitalAssetRespBody
+		for _, entry := range req.Body.MatchedAssets {
+			if entry.Name == name {
+				asset = lb.asset(entry.DigitalAssetID)
+			}
+		}
+		if asset == nil || asset.DigitalAssetType != assetType {
+			fail(w, http.StatusBadRequest, "ASSET_NOT_MATCHED", fmt.Sprintf("%s, a %s, is not matched to an asset of the user", name, assetType))
+			return
+		}
+		matched = append(matched, asset)
+		license.Assets = append(license.Assets, LicensedAsset{Name: name, DigitalAssetID: asset.DigitalAssetID,
+			DigitalAssetType: assetType, SeqNo: asset.LastSequenceNumber + 1})
+	}
+	for _, asset := range matched {
+		asset.LastSequenceNumber++
+	}
+	lb.licenses = append(lb.licenses, license)
+	encoded, _ := json.Marshal(license)
+
+	var resp gmlserver.IssueLicenseResp
+	resp.Body.License = gmlserver.Base64URLEncode(encoded)
+	if !body.DoNotNotifyDAC {
+		resp.Body.URL = s.URL + "/dac/licenses?id=" + url.QueryEscape(randomID(16))
+	}
+	resp.Body.ServerState = encodeState(lb.state(state, state.ClientID))
+	accepted(w, resp.Body)
+}
+
+// authorized returns the user of an access token, answering 401 if there is none, s.mu must be held
+func (s *Server) authorized(w http.ResponseWriter, accessToken string) (*account, bool) {
+	username, ok := s.tokens[accessToken]
+	if !ok {
+		fail(w, http.StatusUnauthorized, "INVALID_TOKEN", "unknown or missing accessToken")
+		return nil, false
+	}
+	return s.users[username], true
+}
+
+// lockboxFor returns the lockbox of an access token's user, answering an error if the user has none or the
+// server state is of another lockbox, s.mu must be held
+func (s *Server) lockboxFor(w http.ResponseWriter, accessToken string, state *serverState) (*lockbox, bool) {
+	user, ok := s.authorized(w, accessToken)
+	if !ok {
+		return nil, false
+	}
+	switch {
+	case user.lockbox == nil:
+		fail(w, http.StatusNotFound, "LOCKBOX_NOT_FOUND", "the user has no lockbox")
+		return nil, false
+	case state.CreateLockboxResponse == nil || state.CreateLockboxResponse.User == nil ||
+		state.CreateLockboxResponse.User.ID != user.lockbox.created.User.ID:
+		fail(w, http.StatusBadRequest, "INVALID_SERVER_STATE", "serverState is not of the user's lockbox")
+		return nil, false
+	}
+	return user.lockbox, true
+}
+
+func newLockbox(terms termsAcceptance, withRecoveryData bool) *lockbox {
+	pseudonymID := randomID(32)
+	lb := &lockbox{
+		created: gmlserver.CreateLockboxRespBody{
+			User: &gmlserver.UserCreateLockboxResponse{ID: randomID(32), DlbpID: "fake-dlbp", DlbpIDSalt: randomID(16),
+				PseudonymBaseDerivationData: randomID(32)},
+			Device: &gmlserver.DeviceCreateLockBoxResponse{ID: randomID(32), UserIDSalt: randomID(16)},
+			Pseudonym: &gmlserver.PseudonymCreateLockboxResponse{ID: pseudonymID, DerivationData: randomID(32),
+				UserIDSalt: randomID(16), SigKeyDerivationData: randomID(32), EncKeyDerivationData: randomID(32),
+				AppEncKeyDerivationData: randomID(32), MemberID: "fake-member", MemberIDSalt: randomID(16)},
+			Pseudonymdevice: &gmlserver.PseudonymDeviceCreateLockboxResponse{ID: randomID(32), PseudonymID: pseudonymID,
+				PseudonymIDSalt: randomID(16), DeviceIDSalt: randomID(16)},
+			DeviceSecurityData: randomID(16),
+		},
+		masterPrivateKey:       randomID(48),
+		pseudoDevicePrivateKey: randomID(48),
+		acceptedTerms:          terms,
+	}
+	lb.created.Codes = []gmlserver.ChannelCodeWithExpiry{{ChannelCode: gmlserver.ChannelCode{ID: randomID(16), HMAC: randomID(32)},
+		Expiry: time.Now().Add(time.Hour).Unix()}}
+	lb.created.CodeDuration = int(time.Hour.Seconds())
+	if withRecoveryData {
+		lb.recovery = &gmlserver.DetailedRecoveryInfo{RecoveryDataB64: randomID(64), RecoveryDataSalt: randomID(16),
+			LockboxEncKey: randomID(32), RecoveryKey: randomID(32)}
+		lb.recovery.RecoveryDataHash = contentHash(lb.recovery.RecoveryDataB64)
+		lb.recovery.RecoveryData.EncLockboxEncKey = randomID(48)
+		lb.recovery.EncDlbpRecoveryKeyPart = randomID(48)
+		lb.recovery.EncStewardRecoveryKeyPart = randomID(48)
+	}
+	return lb
+}
+
+func (lb *lockbox) addAsset(assetType string) gmlserver.CreateDigitalAssetRespBody {
+	asset := gmlserver.CreateDigitalAssetRespBody{
+		DigitalAssetID:             randomID(16),
+		DigitalAssetType:           assetType,
+		PseudonymID:                lb.created.Pseudonym.ID,
+		PseudonymIDSalt:            randomID(16),
+		AssetBaseSalt:              randomID(48),
+		AssetBaseEncryptionKey:     randomID(48),
+		StorageType:                "DAP",
+		DapID:                      "fake-dap",
+		ExpiryEpochSeconds:         time.Now().AddDate(1, 0, 0).Unix(),
+		LicensedDigitalAssetIDSalt: randomID(16),
+		Status:                     "ACTIVE",
+	}
+	lb.assets = append(lb.assets, asset)
+	return asset
+}
+
+func (lb *lockbox) asset(id string) *gmlserver.CreateDigitalAssetRespBody {
+	for i := range lb.assets {
+		if lb.assets[i].DigitalAssetID == id {
+			return &lb.assets[i]
+		}
+	}
+	return nil
+}
+
+// state returns the device state of the lockbox, keeping the terms and license request of prev
+func (lb *lockbox) state(prev *serverState, clientID string) *serverState {
+	state := &serverState{
+		CreateLockboxResponse:  &lb.created,
+		RecoveryInfo:           lb.recovery,
+		MasterPrivateKey:       lb.masterPrivateKey,
+		PseudoDevicePrivateKey: lb.pseudoDevicePrivateKey,
+		DAList:                 make(map[string]gmlserver.CreateDigitalAssetRespBody),
+		PseudonymDeviceKeyMap:  map[string]string{lb.created.Pseudonym.ID: lb.pseudoDevicePrivateKey},
+		AcceptedTerms:          &lb.acceptedTerms,
+		ClientID:               clientID,
+		OrgCodes:               lb.created.Codes,
+	}
+	// the latest asset of each type
+	for _, asset := range lb.assets {
+		state.DAList[asset.DigitalAssetType] = asset
+	}
+	if prev != nil {
+		state.CurrentTermsInfo = prev.CurrentTermsInfo
+		state.LastLicenseRequest = prev.LastLicenseRequest
+	}
+	return state
+}
+
+func encodeState(state *serverState) string {
+	data, err := json.Marshal(state)
+	if err != nil {
+		panic(err)
+	}
+	return gmlserver.Base64URLEncode(data)
+}
+
+// decodeState decodes a serverState, answering 400 if it is malformed or required and missing
+func decodeState(w http.ResponseWriter, encoded string, required bool) (*serverState, bool) {
+	state := new(serverState)
+	if encoded == "" {
+		if required {
+			fail(w, http.StatusBadRequest, "INVALID_SERVER_STATE", "serverState is required")
+			return nil, false
+		}
+		return state, true
+	}
+	data, err := gmlserver.Base64URLDecode(encoded)
+	if err == nil {
+		err = json.Unmarshal(data, state)
+	}
+	if err != nil {
+		fail(w, http.StatusBadRequest, "INVALID_SERVER_STATE", "serverState is not base64url encoded JSON")
+		return nil, false
+	}
+	return state, true
+}
+
+func currentTerms(locale string) *gmlserver.TermsInfo {
+	if locale == "" {
+		locale = "en-CA"
+	}
+	return &gmlserver.TermsInfo{Locale: locale, Version: termsVersion, ContentType: "text/plain", Content: termsContent}
+}
+
+// queryExpression asks for the assets as asset1, asset2... in order
+func queryExpression(assetTypes []string) string {
+	names := make([]string, len(assetTypes))
+	for i, assetType := range assetTypes {
+		names[i] = fmt.Sprintf("asset%d: %s", i+1, path.Base(assetType))
+	}
+	return strings.Join(names, " AND ")
+}
+
+// idToken returns an unsigned JWT naming the user
+func idToken(issuer, username, clientID string) string {
+	header, _ := json.Marshal(map[string]string{"alg": "none", "typ": "JWT"})
+	now := time.Now().Unix()
+	claims, _ := json.Marshal(map[string]interface{}{"iss": issuer, "sub": username, "aud": clientID, "iat": now, "exp": now + 3600})
+	return gmlserver.Base64URLEncode(header) + "." + gmlserver.Base64URLEncode(claims) + "."
+}
+
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return gmlserver.Base64URLEncode(sum[:])
+}
+
+// decode reads a JSON request body, answering 400 if it is malformed
+func decode(w http.ResponseWriter, r *http.Request, body interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		fail(w, http.StatusBadRequest, "INVALID_REQUEST", "malformed JSON: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// required answers 400 if the wrapped body of a request is missing
+func required[T any](w http.ResponseWriter, body *T, name string) bool {
+	if body == nil {
+		fail(w, http.StatusBadRequest, "INVALID_REQUEST", name+" is required")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,530 @@
+package fakesim_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alialkhalidi/da-license-proxy/src/fakesim"
+	"github.com/alialkhalidi/da-license-proxy/src/gmlserver"
+	"github.com/alialkhalidi/da-license-proxy/src/licenser"
+)
+
+const (
+	requestID = "request-id"
+	encKey    = "enc-key"
+)
+
+var (
+	alice = fakesim.User{Username: "alice", Password: "secret"}
+	bob   = fakesim.User{Username: "bob", Password: "hunter2", StepUp: true}
+	quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+)
+
+func newFake(t *testing.T) *fakesim.Server {
+	t.Helper()
+	sim := fakesim.New()
+	t.Cleanup(sim.Close)
+	sim.AddUser(alice)
+	sim.AddUser(bob)
+	sim.AddLicenseRequest(fakesim.LicenseRequest{ID: requestID, EncKey: encKey})
+	return sim
+}
+
+// newConfig runs the license flow against sim without waiting for lockboxes to propagate, retrying right away
+func newConfig(sim *fakesim.Server) *gmlserver.Configuration {
+	cfg := gmlserver.NewConfiguration(sim.URL, sim.URL)
+	cfg.RecoverLockboxDelay = 0
+	cfg.Logger = quiet
+	policy := gmlserver.DefaultRetryPolicy()
+	policy.Backoff.Initial = time.Millisecond
+	cfg.Retry = &gmlserver.RetryPolicies{Default: policy}
+	return cfg
+}
+
+// getLicense runs the license flow, returning the steps observed in order with their outcome
+func getLicense(cfg *gmlserver.Configuration, user fakesim.User, licenseRequestID string) (string, []string, error) {
+	var steps []string
+	license, err := gmlserver.GetLicenseForDA(context.Background(), cfg, user.Username, user.Password, licenseRequestID, encKey,
+		func(event gmlserver.StepEvent) {
+			if event.Outcome != gmlserver.StepStarted {
+				steps = append(steps, event.Step+" "+event.Outcome)
+			}
+		})
+	return license, steps, err
+}
+
+func decodeLicense(t *testing.T, license string) *fakesim.License {
+	t.Helper()
+	decoded, err := fakesim.DecodeLicense(license)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestNewUser(t *testing.T) {
+	sim := newFake(t)
+	license, steps, err := getLicense(newConfig(sim), alice, requestID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"auth succeeded", "recoverLockbox failed", "createLockbox succeeded", "createDA succeeded",
+		"retrieveLicenseRequest succeeded", "issueLicense succeeded"}
+	if strings.Join(steps, ", ") != strings.Join(want, ", ") {
+		t.Errorf("steps = %v, want %v", steps, want)
+	}
+	assets, ok := sim.Assets(alice.Username)
+	if !ok || len(assets) != 1 || assets[0].DigitalAssetType != gmlserver.FoundationalIdentityAssetType {
+		t.Fatalf("lockbox assets = %+v, %v, want one foundational identity", assets, ok)
+	}
+	decoded := decodeLicense(t, license)
+	if decoded.LicenseRequestID != requestID || len(decoded.Assets) != 1 || decoded.Assets[0].DigitalAssetID != assets[0].DigitalAssetID ||
+		decoded.Assets[0].SeqNo != 1 {
+		t.Errorf("license = %+v, want the asset %s licensed for %s", decoded, assets[0].DigitalAssetID, requestID)
+	}
+	for endpoint, calls := range map[string]int{fakesim.EndpointConsent: 1, fakesim.EndpointStepUp: 0, "retrievecurrentterms": 1} {
+		if got := sim.Calls(endpoint); got != calls {
+			t.Errorf("%s called %d times, want %d", endpoint, got, calls)
+		}
+	}
+}
+
+func TestReturningUser(t *testing.T) {
+	sim := newFake(t)
+	cfg := newConfig(sim)
+	if _, _, err := getLicense(cfg, alice, requestID); err != nil {
+		t.Fatal(err)
+	}
+	license, steps, err := getLicense(cfg, alice, requestID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"auth succeeded", "recoverLockbox succeeded", "createDA succeeded", "retrieveLicenseRequest succeeded",
+		"issueLicense succeeded"}
+	if strings.Join(steps, ", ") != strings.Join(want, ", ") {
+		t.Errorf("steps = %v, want %v", steps, want)
+	}
+	// consent is remembered, the second login is redirected with the auth code right away
+	if calls := sim.Calls(fakesim.EndpointConsent); calls != 1 {
+		t.Errorf("consent called %d times, want 1", calls)
+	}
+	if calls := sim.Calls("createlockbox"); calls != 1 {
+		t.Errorf("createlockbox called %d times, want 1", calls)
+	}
+	if licenses := sim.Licenses(alice.Username); len(licenses) != 2 {
+		t.Errorf("issued %d licenses, want 2", len(licenses))
+	}
+	// each flow creates the asset anew and licenses the latest one
+	assets, _ := sim.Assets(alice.Username)
+	if decoded := decodeLicense(t, license); len(assets) != 2 || decoded.Assets[0].DigitalAssetID != assets[1].DigitalAssetID {
+		t.Errorf("license = %+v, want the latest of %+v", decoded, assets)
+	}
+}
+
+func TestStepUp(t *testing.T) {
+	sim := newFake(t)
+	if _, _, err := getLicense(newConfig(sim), bob, requestID); err != nil {
+		t.Fatal(err)
+	}
+	if calls := sim.Calls(fakesim.EndpointStepUp); calls != 1 {
+		t.Errorf("stepup called %d times, want 1", calls)
+	}
+}
+
+func TestMultipleAssetTypes(t *testing.T) {
+	sim := newFake(t)
+	assetTypes := []string{gmlserver.FoundationalIdentityAssetType, "vme://assets/address"}
+	sim.AddLicenseRequest(fakesim.LicenseRequest{ID: "two-assets", EncKey: encKey, AssetTypes: assetTypes})
+	cfg := newConfig(sim)
+	cfg.AssetTypes = assetTypes
+
+	license, _, err := getLicense(cfg, alice, "two-assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := decodeLicense(t, license)
+	if len(decoded.Assets) != 2 || decoded.Assets[1].Name != "asset2" || decoded.Assets[1].DigitalAssetType != assetTypes[1] {
+		t.Errorf("license assets = %+v, want %v as asset1 and asset2", decoded.Assets, assetTypes)
+	}
+}
+
+func TestFlowFailures(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		prepare func(sim *fakesim.Server)
+		user    fakesim.User
+		request string
+		step    string
+		method  string
+		status  int
+	}{
+		{
+			name:   "wrong password",
+			user:   fakesim.User{Username: alice.Username, Password: "wrong"},
+			step:   gmlserver.StepAuth,
+			method: "authenticate",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:    "wrong step up PIN",
+			prepare: func(sim *fakesim.Server) { sim.StepUpPIN = "0000" },
+			user:    bob,
+			step:    gmlserver.StepAuth,
+			method:  "stepup",
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name: "consent page down",
+			prepare: func(sim *fakesim.Server) {
+				sim.Inject(fakesim.EndpointConsent, fakesim.Fault{Status: http.StatusInternalServerError})
+			},
+			step:   gmlserver.StepAuth,
+			method: "consent",
+			status: http.StatusInternalServerError,
+		},
+		{
+			name: "access token",
+			prepare: func(sim *fakesim.Server) {
+				sim.Inject("accesstoken", fakesim.Fault{Status: http.StatusInternalServerError})
+			},
+			step:   gmlserver.StepAuth,
+			method: "accesstoken",
+			status: http.StatusInternalServerError,
+		},
+		{
+			name: "terms",
+			prepare: func(sim *fakesim.Server) {
+				sim.Inject("retrievecurrentterms", fakesim.Fault{Status: http.StatusInternalServerError})
+			},
+			step:   gmlserver.StepCreateLockbox,
+			method: "retrievecurrentterms",
+			status: http.StatusInternalServerError,
+		},
+		{
+			name: "create lockbox",
+			prepare: func(sim *fakesim.Server) {
+				sim.Inject("createlockbox", fakesim.Fault{Status: http.StatusInternalServerError})
+			},
+			step:   gmlserver.StepCreateLockbox,
+			method: "createlockbox",
+			status: http.StatusInternalServerError,
+		},
+		{
+			name: "create DA",
+			prepare: func(sim *fakesim.Server) {
+				sim.Inject("createdigitalasset", fakesim.Fault{Status: http.StatusInternalServerError})
+			},
+			step:   gmlserver.StepCreateDA,
+			method: "createdigitalasset",
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:    "unknown license request",
+			request: "unknown",
+			step:    gmlserver.StepRetrieveLicenseRequest,
+			method:  "retrievelicenserequest",
+			status:  http.StatusNotFound,
+		},
+		{
+			name: "issue license",
+			prepare: func(sim *fakesim.Server) {
+				sim.Inject("issuelicense", fakesim.Fault{Status: http.StatusInternalServerError})
+			},
+			step:   gmlserver.StepIssueLicense,
+			method: "issuelicense",
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:    "dropped connection",
+			prepare: func(sim *fakesim.Server) { sim.Inject("issuelicense", fakesim.Fault{Drop: true}) },
+			step:    gmlserver.StepIssueLicense,
+			method:  "issuelicense",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sim := newFake(t)
+			if tc.prepare != nil {
+				tc.prepare(sim)
+			}
+			user, request := tc.user, tc.request
+			if user.Username == "" {
+				user = alice
+			}
+			if request == "" {
+				request = requestID
+			}
+			cfg := newConfig(sim)
+			cfg.Retry = nil
+
+			_, _, err := getLicense(cfg, user, request)
+			var flowErr *gmlserver.FlowError
+			if !errors.As(err, &flowErr) || flowErr.Step != tc.step {
+				t.Fatalf("error = %v, want a failure of step %s", err, tc.step)
+			}
+			var upstreamErr *gmlserver.UpstreamError
+			if !errors.As(err, &upstreamErr) || upstreamErr.Method != tc.method || upstreamErr.StatusCode != tc.status {
+				t.Errorf("error = %v, want %s answering %d", err, tc.method, tc.status)
+			}
+		})
+	}
+}
+
+func TestRetriedFaults(t *testing.T) {
+	sim := newFake(t)
+	sim.Inject("retrievelicenserequest", fakesim.Fault{Status: http.StatusServiceUnavailable, Times: 1})
+	sim.Inject("retrievelicenserequest", fakesim.Fault{Delay: 10 * time.Millisecond, Drop: true, Times: 1})
+
+	if _, _, err := getLicense(newConfig(sim), alice, requestID); err != nil {
+		t.Fatal(err)
+	}
+	if calls := sim.Calls("retrievelicenserequest"); calls != 3 {
+		t.Errorf("retrievelicenserequest called %d times, want 3", calls)
+	}
+
+	sim.ClearFaults()
+	sim.Inject("issuelicense", fakesim.Fault{Status: http.StatusBadGateway})
+	if _, _, err := getLicense(newConfig(sim), alice, requestID); err == nil {
+		t.Error("flow succeeded while issuelicense kept failing")
+	}
+	if calls := sim.Calls("issuelicense"); calls != 1+gmlserver.DefaultRetryPolicy().Attempts {
+		t.Errorf("issuelicense called %d times, want 1 and %d attempts", calls, gmlserver.DefaultRetryPolicy().Attempts)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	sim := newFake(t)
+	sim.Inject("requestobject", fakesim.Fault{Status: http.StatusInternalServerError})
+	cfg := newConfig(sim)
+	cfg.Retry = nil
+	settings := gmlserver.DefaultBreakerSettings()
+	settings.Failures = 2
+	cfg.SimServerBreaker = gmlserver.NewCircuitBreaker(gmlserver.UpstreamSimServer, settings, nil)
+
+	for i := 0; i < 3; i++ {
+		getLicense(cfg, alice, requestID)
+	}
+	if calls := sim.Calls("requestobject"); calls != settings.Failures {
+		t.Errorf("requestobject called %d times, want %d before the breaker opened", calls, settings.Failures)
+	}
+	_, _, err := getLicense(cfg, alice, requestID)
+	if !errors.Is(err, gmlserver.ErrCircuitOpen) {
+		t.Errorf("error = %v, want %v", err, gmlserver.ErrCircuitOpen)
+	}
+}
+
+func TestLicenser(t *testing.T) {
+	sim := newFake(t)
+	l, err := licenser.New(
+		licenser.WithSimServerURL(sim.URL),
+		licenser.WithMyAMURL(sim.URL),
+		licenser.WithLogger(quiet),
+		licenser.WithRecoverLockboxDelay(0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	license, err := l.GetLicense(context.Background(), licenser.Credentials{Username: alice.Username, Password: alice.Password}, requestID, encKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodeLicense(t, license)
+}
+
+func TestCassetteReplay(t *testing.T) {
+	sim := newFake(t)
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	cfg := newConfig(sim)
+	gmlserver.NewCassette(path, gmlserver.DefaultCassetteMatch()).Apply(cfg)
+	recorded, _, err := getLicense(cfg, alice, requestID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim.Close()
+
+	cassette, err := gmlserver.OpenCassette(path, gmlserver.DefaultCassetteMatch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = newConfig(sim)
+	cassette.Apply(cfg)
+	replayed, steps, err := getLicense(cfg, alice, requestID)
+	if err != nil {
+		t.Fatalf("replay failed after %v: %v", steps, err)
+	}
+	if replayed != recorded {
+		t.Errorf("replayed license %s, recorded %s", replayed, recorded)
+	}
+}
+
+// newServer starts a gml server against sim from a config file, as the gml binary does, more is appended to the file
+func newServer(t *testing.T, sim *fakesim.Server, more string) http.Handler {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "gmlserverconfig.yml")
+	config := `simserver:
+  url: ` + sim.URL + `
+  recoverlockbox:
+    delay: 0s
+myam:
+  url: ` + sim.URL + `
+log:
+  level: error
+` + more
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	server, err := gmlserver.NewGmlServer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server.Handler()
+}
+
+func serve(t *testing.T, handler http.Handler, method, target, body string, into interface{}) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	if into != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), into); err != nil {
+			t.Fatalf("%s %s = %d %s: %v", method, target, rec.Code, rec.Body, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestServerLicenses(t *testing.T) {
+	sim := newFake(t)
+	handler := newServer(t, sim, "")
+
+	var license gmlserver.GmlResp
+	body := `{"username": "alice", "password": "secret", "requestID": "request-id", "requestEncKey": "enc-key"}`
+	if code := serve(t, handler, http.MethodPost, "/v1/licenses", body, &license.Body); code != http.StatusOK {
+		t.Fatalf("POST /v1/licenses = %d", code)
+	}
+	decodeLicense(t, license.Body.License)
+
+	var failure gmlserver.ErrorResp
+	body = `{"username": "alice", "password": "secret", "requestID": "unknown", "requestEncKey": "enc-key"}`
+	if code := serve(t, handler, http.MethodPost, "/v1/licenses", body, &failure); code != http.StatusNotFound {
+		t.Errorf("POST /v1/licenses of an unknown request = %d, want 404", code)
+	}
+	if failure.Step != gmlserver.StepRetrieveLicenseRequest || failure.UpstreamStatus != http.StatusNotFound {
+		t.Errorf("error = %+v, want the retrieveLicenseRequest 404", failure)
+	}
+}
+
+func TestServerJobs(t *testing.T) {
+	sim := newFake(t)
+	handler := newServer(t, sim, "")
+
+	var job gmlserver.LicenseJob
+	body := `{"username": "bob", "password": "hunter2", "requestID": "request-id", "requestEncKey": "enc-key"}`
+	if code := serve(t, handler, http.MethodPost, "/v1/license-jobs", body, &job); code != http.StatusAccepted {
+		t.Fatalf("POST /v1/license-jobs = %d", code)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for job.Status != "succeeded" {
+		if job.Status == "failed" || time.Now().After(deadline) {
+			t.Fatalf("job = %+v, want it to succeed", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+		serve(t, handler, http.MethodGet, "/v1/license-jobs/"+job.ID, "", &job)
+	}
+	decodeLicense(t, job.License)
+}
+
+func TestServerReadiness(t *testing.T) {
+	sim := newFake(t)
+	handler := newServer(t, sim, "")
+
+	var ready gmlserver.ReadinessResp
+	if code := serve(t, handler, http.MethodGet, "/readyz", "", &ready.Body); code != http.StatusOK {
+		t.Errorf("GET /readyz = %d %+v, want 200", code, ready.Body)
+	}
+}
+
+func TestServerEnvironments(t *testing.T) {
+	sim := newFake(t)
+	peer := fakesim.New()
+	t.Cleanup(peer.Close)
+	carol := fakesim.User{Username: "carol", Password: "peer-secret"}
+	peer.AddUser(carol)
+	peer.AddLicenseRequest(fakesim.LicenseRequest{ID: "peer-request", EncKey: encKey})
+	t.Setenv("GML_TEST_CAROL_PASSWORD", carol.Password)
+	handler := newServer(t, sim, `environments:
+  peerorg10:
+    simserver:
+      url: `+peer.URL+`
+    myam:
+      url: `+peer.URL+`
+    locale: fr
+    profiles:
+      - name: carol
+        username: carol
+        password:
+          env: GML_TEST_CAROL_PASSWORD
+`)
+
+	body := `{"profile": "carol", "requestID": "peer-request", "requestEncKey": "enc-key"}`
+	var license gmlserver.GmlResp
+	if code := serve(t, handler, http.MethodPost, "/v1/peerorg10/licenses", body, &license.Body); code != http.StatusOK {
+		t.Fatalf("POST /v1/peerorg10/licenses = %d", code)
+	}
+	decodeLicense(t, license.Body.License)
+	body = `{"profile": "carol", "requestID": "peer-request", "requestEncKey": "enc-key", "environment": "peerorg10"}`
+	if code := serve(t, handler, http.MethodPost, "/v1/licenses", body, &license.Body); code != http.StatusOK {
+		t.Fatalf("POST /v1/licenses in peerorg10 = %d", code)
+	}
+	if n := len(peer.Licenses("carol")); n != 2 {
+		t.Errorf("peerorg10 issued %d licenses to carol, want 2", n)
+	}
+	if _, ok := sim.Assets("carol"); ok || sim.Calls("requestobject") != 0 {
+		t.Error("the default environment was called for peerorg10 requests")
+	}
+
+	for _, test := range []struct {
+		name, target, body string
+		want               int
+	}{
+		{"profile of another environment", "/v1/licenses", `{"profile": "carol", "requestID": "request-id", "requestEncKey": "enc-key"}`, http.StatusBadRequest},
+		{"unknown environment field", "/v1/licenses", `{"username": "alice", "password": "secret", "requestID": "request-id", "requestEncKey": "enc-key", "environment": "nowhere"}`, http.StatusBadRequest},
+		{"environment field contradicting the path", "/v1/peerorg10/licenses", `{"profile": "carol", "requestID": "peer-request", "requestEncKey": "enc-key", "environment": "default"}`, http.StatusBadRequest},
+		{"unknown environment path", "/v1/nowhere/licenses", `{"username": "alice", "password": "secret", "requestID": "request-id", "requestEncKey": "enc-key"}`, http.StatusNotFound},
+	} {
+		var failure gmlserver.ErrorResp
+		if code := serve(t, handler, http.MethodPost, test.target, test.body, &failure); code != test.want {
+			t.Errorf("%s: POST %s = %d %+v, want %d", test.name, test.target, code, failure, test.want)
+		}
+	}
+
+	var ready gmlserver.ReadinessResp
+	if code := serve(t, handler, http.MethodGet, "/readyz?environment=peerorg10", "", &ready.Body); code != http.StatusOK || ready.Body.Environment != "peerorg10" {
+		t.Errorf("GET /readyz?environment=peerorg10 = %d %+v", code, ready.Body)
+	}
+	if code := serve(t, handler, http.MethodGet, "/readyz?environment=nowhere", "", nil); code != http.StatusNotFound {
+		t.Errorf("GET /readyz?environment=nowhere = %d, want 404", code)
+	}
+	var profiles gmlserver.ProfilesResp
+	serve(t, handler, http.MethodGet, "/v1/profiles", "", &profiles.Body)
+	if len(profiles.Body.Profiles) != 0 {
+		t.Errorf("default environment profiles = %+v, want none", profiles.Body.Profiles)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if metrics := rec.Body.String(); !strings.Contains(metrics, `gml_step_duration_seconds_count{environment="peerorg10"`) {
+		t.Errorf("no peerorg10 step metrics in:\n%s", metrics)
+	}
+}
@@ -0,0 +1,249 @@
+// Package fakesim is an in-process app simulator server and MyAM for testing GML without the live
+// *.stg.verified.me hosts. It implements the simulator server methods of the license flow and the MyAM login
+// pages, keeping each user's lockbox, digital assets and licenses in memory, and fails any endpoint on demand.
+//
+//	sim := fakesim.New()
+//	defer sim.Close()
+//	sim.AddUser(fakesim.User{Username: "alice", Password: "secret"})
+//	sim.AddLicenseRequest(fakesim.LicenseRequest{ID: "request-id", EncKey: "enc-key"})
+//	cfg := gmlserver.NewConfiguration(sim.URL, sim.URL)
+//	license, err := gmlserver.GetLicenseForDA(ctx, cfg, "alice", "secret", "request-id", "enc-key", nil)
+package fakesim
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/alialkhalidi/da-license-proxy/src/gmlserver"
+)
+
+// endpoints of the MyAM login, the simulator server endpoints are named after their lower case method,
+// ie. recoverlockbox
+const (
+	EndpointAuthorize    = "myam/authorize"
+	EndpointAuthenticate = "myam/authenticate"
+	EndpointLogin        = "myam/login"
+	EndpointStepUp       = "myam/stepup"
+	EndpointConsent      = "myam/consent"
+)
+
+// DefaultStepUpPIN is the step up PIN accepted unless the server's StepUpPIN says otherwise, the one GML sends
+const DefaultStepUpPIN = "1234"
+
+// User is a MyAM user
+type User struct {
+	Username string
+	Password string
+	// StepUp has MyAM ask for a PIN once the password is accepted
+	StepUp bool
+}
+
+// LicenseRequest is a license request a DAC has made, waiting to be retrieved and issued
+type LicenseRequest struct {
+	ID     string
+	EncKey string
+	// AssetTypes are the assets the DAC asks for, queried as asset1, asset2... in this order.
+	// The foundational identity if empty.
+	AssetTypes []string
+	// DacID is the DAC making the request, fake-dac if empty
+	DacID string
+}
+
+// Fault replaces the normal answer of an endpoint
+type Fault struct {
+	// Delay is waited before answering, or before failing if the fault has more to it
+	Delay time.Duration
+	// Status is answered with Body instead of the endpoint's own response, 0 answers normally
+	Status int
+	// Body defaults to the status text
+	Body string
+	// Drop hangs up without answering
+	Drop bool
+	// Times is how many calls fail, 0 fails every call until the faults are cleared
+	Times int
+}
+
+// Server is the fake simulator server and MyAM, both served from URL. It is safe for concurrent use.
+type Server struct {
+	*httptest.Server
+	// StepUpPIN is the step up PIN MyAM accepts, DefaultStepUpPIN if empty
+	StepUpPIN string
+
+	mu              sync.Mutex
+	users           map[string]*account
+	licenseRequests map[string]LicenseRequest
+	requestObjects  map[string]*requestObject
+	sessions        map[string]*session
+	grants          map[string]*grant
+	tokens          map[string]string
+	faults          map[string][]*Fault
+	calls           map[string]int
+}
+
+// New starts a fake without users or license requests, Close stops it
+func New() *Server {
+	s := &Server{
+		users:           make(map[string]*account),
+		licenseRequests: make(map[string]LicenseRequest),
+		requestObjects:  make(map[string]*requestObject),
+		sessions:        make(map[string]*session),
+		grants:          make(map[string]*grant),
+		tokens:          make(map[string]string),
+		faults:          make(map[string][]*Fault),
+		calls:           make(map[string]int),
+	}
+	mux := http.NewServeMux()
+	for method, handler := range map[string]http.HandlerFunc{
+		"requestobject":          s.requestObject,
+		"accesstoken":            s.accessToken,
+		"recoverlockbox":         s.recoverLockbox,
+		"retrievecurrentterms":   s.retrieveCurrentTerms,
+		"createlockbox":          s.createLockbox,
+		"createdigitalasset":     s.createDigitalAsset,
+		"retrievelicenserequest": s.retrieveLicenseRequest,
+		"issuelicense":           s.issueLicense,
+	} {
+		mux.HandleFunc("POST /"+method, s.endpoint(method, handler))
+	}
+	mux.HandleFunc("GET /myam/oidc/authorize", s.endpoint(EndpointAuthorize, s.authorize))
+	mux.HandleFunc("POST /myam/oidc/authenticate", s.endpoint(EndpointAuthenticate, s.authenticate))
+	mux.HandleFunc("POST /myam/oidc/login", s.endpoint(EndpointLogin, s.login))
+	mux.HandleFunc("GET /myam/oidc/stepup", s.endpoint(EndpointStepUp, s.stepUp))
+	mux.HandleFunc("GET /myam/oidc/consent", s.endpoint(EndpointConsent, s.consent))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// AddUser adds a MyAM user without a lockbox, replacing any user of the same name
+func (s *Server) AddUser(user User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[user.Username] = &account{User: user, consented: make(map[string]bool)}
+}
+
+// AddLicenseRequest makes a license request retrievable
+func (s *Server) AddLicenseRequest(request LicenseRequest) {
+	if len(request.AssetTypes) == 0 {
+		request.AssetTypes = []string{gmlserver.FoundationalIdentityAssetType}
+	}
+	if request.DacID == "" {
+		request.DacID = "fake-dac"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.licenseRequests[request.ID] = request
+}
+
+// Assets returns the digital assets in username's lockbox, false if the user has no lockbox
+func (s *Server) Assets(username string) ([]gmlserver.CreateDigitalAssetRespBody, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok || user.lockbox == nil {
+		return nil, false
+	}
+	return append([]gmlserver.CreateDigitalAssetRespBody(nil), user.lockbox.assets...), true
+}
+
+// Inject fails the next calls of endpoint, after the faults injected before it are used up
+func (s *Server) Inject(endpoint string, fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[endpoint] = append(s.faults[endpoint], &fault)
+}
+
+// ClearFaults removes every injected fault
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = make(map[string][]*Fault)
+}
+
+// Calls returns how often endpoint was called, failed calls included
+func (s *Server) Calls(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[endpoint]
+}
+
+// endpoint counts the calls of handler and applies the faults injected into it
+func (s *Server) endpoint(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fault, ok := s.called(name)
+		if !ok {
+			handler(w, r)
+			return
+		}
+		if fault.Delay > 0 {
+			timer := time.NewTimer(fault.Delay)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+		switch {
+		case fault.Drop:
+			if hijacker, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hijacker.Hijack(); err == nil {
+					conn.Close()
+					return
+				}
+			}
+			panic(http.ErrAbortHandler)
+		case fault.Status != 0:
+			body := fault.Body
+			if body == "" {
+				body = http.StatusText(fault.Status)
+			}
+			http.Error(w, body, fault.Status)
+		default:
+			handler(w, r)
+		}
+	}
+}
+
+func (s *Server) called(name string) (Fault, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[name]++
+	faults := s.faults[name]
+	if len(faults) == 0 {
+		return Fault{}, false
+	}
+	fault := faults[0]
+	if fault.Times > 0 {
+		fault.Times--
+		if fault.Times == 0 {
+			s.faults[name] = faults[1:]
+		}
+	}
+	return *fault, true
+}
+
+// fail answers a simulator server error the way the simulator server does
+func fail(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]string{"code": code, "message": message}})
+}
+
+// accepted answers a simulator server method with 202 and body
+func accepted(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(body)
+}
+
+// randomID returns a fresh base64url ID of n random bytes
+func randomID(n int) string {
+	id, err := gmlserver.GenerateRandomString(n)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
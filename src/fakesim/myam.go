@@ -0,0 +1,188 @@
+package fakesim
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const sessionCookie = "MYAMSESSION"
+
+// requestObject is an authorization request made through the simulator server's requestobject
+type requestObject struct {
+	clientID      string
+	scopes        string
+	acrValues     string
+	state         string
+	uiLocales     string
+	codeChallenge string
+}
+
+// session is one user's way through the MyAM login pages, from authorize to the redirect with the auth code
+type session struct {
+	request       *requestObject
+	username      string
+	authenticated bool
+	loggedIn      bool
+	steppedUp     bool
+}
+
+// grant is an auth code waiting to be exchanged for an access token
+type grant struct {
+	username string
+	request  *requestObject
+}
+
+// authorize opens a session for the request object of the login URL and shows the login page
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	request, ok := s.requestObjects[r.URL.Query().Get("request")]
+	id := randomID(16)
+	if ok {
+		s.sessions[id] = &session{request: request}
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown or missing request object", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: id, Path: "/myam", HttpOnly: true})
+	page(w, "Sign in", `<form action="/myam/oidc/login" method="post">
+  <input name="username"/><input name="password" type="password"/><input type="submit" value="Sign in"/>
+</form>`)
+}
+
+// authenticate checks the username and password posted as JSON by the login page's script
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) {
+	var creds struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		http.Error(w, "malformed credentials", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.session(r)
+	if !ok {
+		http.Error(w, "no login session", http.StatusUnauthorized)
+		return
+	}
+	if !s.passwordMatches(creds.Username, creds.Password) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"status": "INVALID_CREDENTIALS"}`)
+		return
+	}
+	sess.username, sess.authenticated = creds.Username, true
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status": "AUTHENTICATED"}`)
+}
+
+// login submits the login form of an authenticated session, then asks for a step up PIN, for consent or
+// redirects with the auth code, whichever is due
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "malformed form", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.session(r)
+	if !ok || !sess.authenticated {
+		http.Error(w, "not authenticated", http.StatusUnauthorized)
+		return
+	}
+	if r.PostForm.Get("username") != sess.username || !s.passwordMatches(sess.username, r.PostForm.Get("password")) {
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	sess.loggedIn = true
+	s.next(w, r, sess)
+}
+
+// stepUp checks the PIN of a user asked for one
+func (s *Server) stepUp(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.session(r)
+	if !ok || !sess.loggedIn {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return
+	}
+	pin := s.StepUpPIN
+	if pin == "" {
+		pin = DefaultStepUpPIN
+	}
+	if r.URL.Query().Get("code") != pin {
+		http.Error(w, "wrong PIN", http.StatusUnauthorized)
+		return
+	}
+	sess.steppedUp = true
+	s.next(w, r, sess)
+}
+
+// consent records the user's consent to the scopes of the client
+func (s *Server) consent(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.session(r)
+	if !ok || !sess.loggedIn {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return
+	}
+	user := s.users[sess.username]
+	if user.StepUp && !sess.steppedUp {
+		http.Error(w, "step up required", http.StatusForbidden)
+		return
+	}
+	user.consented[sess.request.clientID] = true
+	s.next(w, r, sess)
+}
+
+// next shows the page a logged in session is due, or redirects it to the client with the auth code
+func (s *Server) next(w http.ResponseWriter, r *http.Request, sess *session) {
+	user := s.users[sess.username]
+	switch {
+	case user.StepUp && !sess.steppedUp:
+		page(w, "Verify it's you", `<form action="/myam/oidc/stepup" method="get"><input name="code"/></form>`)
+	case strings.Contains(sess.request.scopes, "lockbox_creation") && !user.consented[sess.request.clientID]:
+		page(w, "Allow access", fmt.Sprintf(`<p>%s asks for %s</p><form action="/myam/oidc/consent" method="get"><input type="submit" value="Allow"/></form>`,
+			html.EscapeString(sess.request.clientID), html.EscapeString(sess.request.scopes)))
+	default:
+		code := randomID(24)
+		s.grants[code] = &grant{username: sess.username, request: sess.request}
+		delete(s.sessions, sessionID(r))
+		redirect := url.Values{"code": {code}, "state": {sess.request.state}}
+		http.Redirect(w, r, s.URL+"/callback?"+redirect.Encode(), http.StatusFound)
+	}
+}
+
+// session returns the session of r's cookie, s.mu must be held
+func (s *Server) session(r *http.Request) (*session, bool) {
+	sess, ok := s.sessions[sessionID(r)]
+	return sess, ok
+}
+
+func sessionID(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// passwordMatches checks a user's password, s.mu must be held
+func (s *Server) passwordMatches(username, password string) bool {
+	user, ok := s.users[username]
+	return ok && user.Password == password
+}
+
+func page(w http.ResponseWriter, title, body string) {
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	fmt.Fprintf(w, "<html><head><title>%s</title></head><body>\n%s\n</body></html>\n", title, body)
+}
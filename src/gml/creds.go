@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alialkhalidi/da-license-proxy/src/gmlserver"
+	"golang.org/x/term"
+)
+
+const (
+	credsPassphraseEnv    = "GML_CREDS_PASSPHRASE"
+	credsNewPassphraseEnv = "GML_CREDS_NEW_PASSPHRASE"
+
+	credsUsage = `usage: gml creds <command> [flags]
+
+Manages the encrypted store of MyAM test credentials read by credentials.store.file.
+
+commands:
+  add [-update] <username>   store a password, read from standard input or prompted for
+  list                       list the stored usernames
+  rm <username>              remove a stored password
+  rotate                     seal the store with a new passphrase or key file
+
+The store is opened with -key-file, -passphrase-file, $` + credsPassphraseEnv + ` or a prompted passphrase.
+rotate takes the new one from -new-key-file, -new-passphrase-file, $` + credsNewPassphraseEnv + ` or a prompt.
+`
+)
+
+// credsFlags are the flags every creds command takes
+type credsFlags struct {
+	*flag.FlagSet
+	store          string
+	keyFile        string
+	passphraseFile string
+}
+
+func newCredsFlags(command string) *credsFlags {
+	f := &credsFlags{FlagSet: flag.NewFlagSet("gml creds "+command, flag.ContinueOnError)}
+	f.SetOutput(stderr)
+	f.StringVar(&f.store, "store", "gmlcreds.json", "credential store file")
+	f.StringVar(&f.keyFile, "key-file", "", "key file sealing the store")
+	f.StringVar(&f.passphraseFile, "passphrase-file", "", "file holding the passphrase sealing the store")
+	return f
+}
+
+// runCreds runs a creds command and returns the process exit code
+func runCreds(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, credsUsage)
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "add":
+		err = credsAdd(args[1:])
+	case "list":
+		err = credsList(args[1:])
+	case "rm":
+		err = credsRemove(args[1:])
+	case "rotate":
+		err = credsRotate(args[1:])
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(stdout, credsUsage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown creds command %q\n\n%s", args[0], credsUsage)
+		return 2
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "gml creds %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func credsAdd(args []string) error {
+	f := newCredsFlags("add")
+	update := f.Bool("update", false, "replace the password if the username is already stored")
+	username, err := f.parseUsername(args)
+	if err != nil {
+		return err
+	}
+	key, err := storeKey(f.keyFile, f.passphraseFile, credsPassphraseEnv, "passphrase")
+	if err != nil {
+		return err
+	}
+	store, err := gmlserver.OpenCredentialStore(f.store, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		store, err = gmlserver.NewCredentialStore(f.store, key), nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := store.Password(username); ok && !*update {
+		return fmt.Errorf("%s is already stored, pass -update to replace its password", username)
+	}
+	password, err := readSecret("password for " + username)
+	if err != nil {
+		return err
+	}
+	if password == "" {
+		return fmt.Errorf("empty password")
+	}
+	replaced := store.Set(username, password)
+	if err = store.Save(); err != nil {
+		return err
+	}
+	if replaced {
+		fmt.Fprintf(stdout, "updated %s\n", username)
+	} else {
+		fmt.Fprintf(stdout, "added %s\n", username)
+	}
+	return nil
+}
+
+func credsList(args []string) error {
+	f := newCredsFlags("list")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	store, err := f.open()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "USERNAME\tUPDATED")
+	for _, cred := range store.List() {
+		fmt.Fprintf(w, "%s\t%s\n", cred.Username, cred.UpdatedAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func credsRemove(args []string) error {
+	f := newCredsFlags("rm")
+	username, err := f.parseUsername(args)
+	if err != nil {
+		return err
+	}
+	store, err := f.open()
+	if err != nil {
+		return err
+	}
+	if !store.Remove(username) {
+		return fmt.Errorf("%s is not stored", username)
+	}
+	if err = store.Save(); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "removed %s\n", username)
+	return nil
+}
+
+func credsRotate(args []string) error {
+	f := newCredsFlags("rotate")
+	newKeyFile := f.String("new-key-file", "", "key file to seal the store with from now on")
+	newPassphraseFile := f.String("new-passphrase-file", "", "file holding the passphrase to seal the store with from now on")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	store, err := f.open()
+	if err != nil {
+		return err
+	}
+	key, err := storeKey(*newKeyFile, *newPassphraseFile, credsNewPassphraseEnv, "new passphrase")
+	if err != nil {
+		return err
+	}
+	store.Rekey(key)
+	if err = store.Save(); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "rotated %s, give GML the new key file or passphrase before it restarts\n", f.store)
+	return nil
+}
+
+func (f *credsFlags) parseUsername(args []string) (string, error) {
+	if err := f.Parse(args); err != nil {
+		return "", err
+	}
+	if f.NArg() != 1 {
+		return "", fmt.Errorf("want exactly one username, got %d", f.NArg())
+	}
+	return f.Arg(0), nil
+}
+
+func (f *credsFlags) open() (*gmlserver.CredentialStore, error) {
+	key, err := storeKey(f.keyFile, f.passphraseFile, credsPassphraseEnv, "passphrase")
+	if err != nil {
+		return nil, err
+	}
+	return gmlserver.OpenCredentialStore(f.store, key)
+}
+
+// storeKey reads the key file or passphrase file, else takes the passphrase from env or prompts for it
+func storeKey(keyFile, passphraseFile, env, prompt string) (gmlserver.CredentialStoreKey, error) {
+	switch {
+	case keyFile != "":
+		return gmlserver.ReadKeyFile(keyFile)
+	case passphraseFile != "":
+		return gmlserver.ReadPassphraseFile(passphraseFile)
+	case os.Getenv(env) != "":
+		return gmlserver.PassphraseKey(os.Getenv(env)), nil
+	}
+	passphrase, err := readSecret(prompt)
+	if err != nil {
+		return gmlserver.CredentialStoreKey{}, err
+	}
+	return gmlserver.PassphraseKey(passphrase), nil
+}
+
+// stdin is shared by every readSecret, so secrets piped one per line are read in turn
+var stdin = bufio.NewReader(os.Stdin)
+
+// stdout and stderr take the output of the creds commands
+var stdout, stderr io.Writer = os.Stdout, os.Stderr
+
+// readSecret prompts for a secret without echoing it, or reads a line of standard input if it is not a terminal
+func readSecret(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprintf(os.Stderr, "%s: ", prompt)
+		secret, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(secret), err
+	}
+	line, err := stdin.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", fmt.Errorf("failed to read %s from standard input: %v", prompt, err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
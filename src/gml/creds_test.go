@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alialkhalidi/da-license-proxy/src/gmlserver"
+)
+
+func writeKeyFile(t *testing.T, file string) {
+	t.Helper()
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if err := os.WriteFile(file, secret, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runCredsWith runs a creds command with input as standard input, returning its exit code and output
+func runCredsWith(t *testing.T, input string, args ...string) (int, string) {
+	t.Helper()
+	var out bytes.Buffer
+	stdin, stdout, stderr = bufio.NewReader(strings.NewReader(input)), &out, &out
+	t.Cleanup(func() { stdin, stdout, stderr = bufio.NewReader(os.Stdin), os.Stdout, os.Stderr })
+	return runCreds(args), out.String()
+}
+
+func openStore(t *testing.T, store, keyFile string) *gmlserver.CredentialStore {
+	t.Helper()
+	key, err := gmlserver.ReadKeyFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := gmlserver.OpenCredentialStore(store, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creds
+}
+
+func TestCredsCommands(t *testing.T) {
+	dir := t.TempDir()
+	store, keyFile, newKeyFile := filepath.Join(dir, "gmlcreds.json"), filepath.Join(dir, "store.key"), filepath.Join(dir, "new.key")
+	writeKeyFile(t, keyFile)
+	writeKeyFile(t, newKeyFile)
+	flags := []string{"-store", store, "-key-file", keyFile}
+
+	for _, tc := range []struct {
+		name   string
+		input  string
+		args   []string
+		code   int
+		output string
+	}{
+		{"add creates the store", "alice-password\n", append([]string{"add"}, append(flags, "alice")...), 0, "added alice"},
+		{"add another", "bob-password\n", append([]string{"add"}, append(flags, "bob")...), 0, "added bob"},
+		{"add an existing user", "other\n", append([]string{"add"}, append(flags, "alice")...), 1, "pass -update"},
+		{"update", "new-alice-password\n", append([]string{"add", "-update"}, append(flags, "alice")...), 0, "updated alice"},
+		{"empty password", "\n", append([]string{"add"}, append(flags, "carol")...), 1, "empty password"},
+		{"list", "", append([]string{"list"}, flags...), 0, "alice"},
+		{"rm", "", append([]string{"rm"}, append(flags, "bob")...), 0, "removed bob"},
+		{"rm an unknown user", "", append([]string{"rm"}, append(flags, "bob")...), 1, "bob is not stored"},
+		{"no username", "", append([]string{"rm"}, flags...), 1, "want exactly one username"},
+		{"unknown command", "", []string{"show"}, 2, "unknown creds command"},
+	} {
+		code, output := runCredsWith(t, tc.input, tc.args...)
+		if code != tc.code || !strings.Contains(output, tc.output) {
+			t.Errorf("%s: gml creds %s = %d %q, want %d with %q", tc.name, strings.Join(tc.args, " "), code, output, tc.code, tc.output)
+		}
+	}
+
+	creds := openStore(t, store, keyFile)
+	if password, ok := creds.Password("alice"); !ok || password != "new-alice-password" {
+		t.Errorf("alice's password = %q, %v, want new-alice-password", password, ok)
+	}
+	for _, username := range []string{"bob", "carol"} {
+		if _, ok := creds.Password(username); ok {
+			t.Errorf("%s is stored", username)
+		}
+	}
+
+	// rotate reseals the store, the old key file no longer opens it
+	if code, output := runCredsWith(t, "", append([]string{"rotate", "-new-key-file", newKeyFile}, flags...)...); code != 0 {
+		t.Fatalf("gml creds rotate = %d %q", code, output)
+	}
+	if code, output := runCredsWith(t, "", append([]string{"list"}, flags...)...); code != 1 || !strings.Contains(output, "wrong key file") {
+		t.Errorf("list with the old key file = %d %q, want it to fail", code, output)
+	}
+	if password, ok := openStore(t, store, newKeyFile).Password("alice"); !ok || password != "new-alice-password" {
+		t.Errorf("alice's password after rotate = %q, %v, want new-alice-password", password, ok)
+	}
+}
+
+func TestCredsPassphraseFromEnvironment(t *testing.T) {
+	store := filepath.Join(t.TempDir(), "gmlcreds.json")
+	t.Setenv(credsPassphraseEnv, "env passphrase")
+	if code, output := runCredsWith(t, "secret\n", "add", "-store", store, "alice"); code != 0 {
+		t.Fatalf("gml creds add = %d %q", code, output)
+	}
+	creds, err := gmlserver.OpenCredentialStore(store, gmlserver.PassphraseKey("env passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password, ok := creds.Password("alice"); !ok || password != "secret" {
+		t.Errorf("alice's password = %q, %v, want secret", password, ok)
+	}
+}
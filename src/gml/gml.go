@@ -5,7 +5,7 @@ import (
 	"os/signal"
 	"syscall"
 
-	"gmlserver"
+	"github.com/alialkhalidi/da-license-proxy/src/gmlserver"
 	"log"
 )
 
@@ -16,13 +16,16 @@ var (
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "creds" {
+		os.Exit(runCreds(os.Args[2:]))
+	}
 	if len(os.Args) != 2 {
 		myLogger.Fatal("config file not passed in")
 	}
 
 	gmlseverconfig = os.Args[1]
 
-	var sigs = make(chan os.Signal)
+	var sigs = make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
 	gml, err := gmlserver.NewGmlServer(gmlseverconfig)
@@ -31,15 +34,20 @@ func main() {
 	}
 	myLogger.Printf("******STARTING GML SERVER********")
 
+	var stopped = make(chan error, 1)
 	go func() {
-		if _, err := gml.Start(); err != nil {
+		_, err := gml.Start()
+		stopped <- err
+	}()
+	select {
+	case s := <-sigs:
+		myLogger.Printf("Got shutdown signal: %v", s)
+	case err := <-stopped:
+		if err != nil {
 			myLogger.Printf("%s\n", err.Error())
-			close(sigs)
 		}
-	}()
-	s := <-sigs
-	myLogger.Printf("Got shutdown signal: %v", s)
+	}
 	if err := gml.Close(); err != nil {
-		myLogger.Printf(err.Error())
+		myLogger.Print(err.Error())
 	}
 }
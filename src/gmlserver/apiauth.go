@@ -0,0 +1,293 @@
+package gmlserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// APIKeyHeader carries an API key, which can also be sent as the password of a basic Authorization header
+	APIKeyHeader = "X-API-Key"
+
+	defaultAuthReloadInterval = 10 * time.Second
+)
+
+// apiKeyConfig is an entry of auth.keys, the key is given as is or as the hex SHA-256 of the key
+type apiKeyConfig struct {
+	ID     string `mapstructure:"id"`
+	Key    string `mapstructure:"key"`
+	SHA256 string `mapstructure:"sha256"`
+}
+
+// tokenSecretConfig is an entry of auth.tokens.secrets, tokens naming it as their kid are checked against it
+type tokenSecretConfig struct {
+	ID     string `mapstructure:"id"`
+	Secret string `mapstructure:"secret"`
+}
+
+// apiCredentials are the keys and token secrets callers are checked against, and the callers allowed on the
+// admin endpoints, replaced as a whole on reload
+type apiCredentials struct {
+	keys    map[[sha256.Size]byte]string
+	secrets []tokenSecretConfig
+	admins  map[string]bool
+}
+
+func loadAPICredentials(v *viper.Viper) (*apiCredentials, error) {
+	var keys []apiKeyConfig
+	if err := v.UnmarshalKey(AUTH_KEYS, &keys); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", AUTH_KEYS, err)
+	}
+	var secrets []tokenSecretConfig
+	if err := v.UnmarshalKey(AUTH_TOKEN_SECRETS, &secrets); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", AUTH_TOKEN_SECRETS, err)
+	}
+
+	creds := &apiCredentials{keys: make(map[[sha256.Size]byte]string, len(keys)), admins: make(map[string]bool)}
+	for i, key := range keys {
+		if key.ID == "" {
+			return nil, fmt.Errorf("%s[%d] has no id", AUTH_KEYS, i)
+		}
+		var sum [sha256.Size]byte
+		switch {
+		case key.Key != "":
+			sum = sha256.Sum256([]byte(key.Key))
+		case key.SHA256 != "":
+			decoded, err := hex.DecodeString(key.SHA256)
+			if err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("%s[%d] sha256 is not a hex SHA-256 digest", AUTH_KEYS, i)
+			}
+			copy(sum[:], decoded)
+		default:
+			return nil, fmt.Errorf("%s[%d] has neither key nor sha256", AUTH_KEYS, i)
+		}
+		creds.keys[sum] = key.ID
+	}
+	for i, secret := range secrets {
+		if secret.ID == "" || secret.Secret == "" {
+			return nil, fmt.Errorf("%s[%d] needs an id and a secret", AUTH_TOKEN_SECRETS, i)
+		}
+	}
+	creds.secrets = secrets
+	for _, caller := range v.GetStringSlice(AUTH_ADMINS) {
+		creds.admins[caller] = true
+	}
+	return creds, nil
+}
+
+// callerForKey returns the ID of the API key, comparing digests so the time taken says nothing about the key
+func (c *apiCredentials) callerForKey(key string) (string, bool) {
+	sum := sha256.Sum256([]byte(key))
+	for known, id := range c.keys {
+		if subtle.ConstantTimeCompare(known[:], sum[:]) == 1 {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type tokenClaims struct {
+	Sub string `json:"sub"`
+	Exp int64  `json:"exp"`
+	Nbf int64  `json:"nbf"`
+}
+
+// callerForToken checks an HS256 JWT against the secrets and returns its subject
+func (c *apiCredentials) callerForToken(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed bearer token")
+	}
+	header := new(tokenHeader)
+	if err := decodeTokenPart(parts[0], header); err != nil {
+		return "", err
+	}
+	if header.Alg != "HS256" {
+		return "", fmt.Errorf("bearer token alg %q is not supported, want HS256", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed bearer token signature")
+	}
+
+	signed := false
+	for _, secret := range c.secrets {
+		if header.Kid != "" && header.Kid != secret.ID {
+			continue
+		}
+		if hmac.Equal(signature, signToken(parts[0]+"."+parts[1], []byte(secret.Secret))) {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return "", fmt.Errorf("bearer token signature does not match any secret")
+	}
+
+	claims := new(tokenClaims)
+	if err := decodeTokenPart(parts[1], claims); err != nil {
+		return "", err
+	}
+	switch {
+	case claims.Sub == "":
+		return "", fmt.Errorf("bearer token has no sub")
+	case claims.Exp != 0 && now.Unix() >= claims.Exp:
+		return "", fmt.Errorf("bearer token expired")
+	case claims.Nbf != 0 && now.Unix() < claims.Nbf:
+		return "", fmt.Errorf("bearer token not valid yet")
+	}
+	return claims.Sub, nil
+}
+
+func decodeTokenPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		return fmt.Errorf("malformed bearer token: %v", err)
+	}
+	return nil
+}
+
+func signToken(signingInput string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+// NewBearerToken returns an HS256 JWT for subject signed with the secret named kid, expiring at expires
+func NewBearerToken(kid string, secret []byte, subject string, expires time.Time) string {
+	header, _ := json.Marshal(tokenHeader{Alg: "HS256", Kid: kid})
+	claims, _ := json.Marshal(tokenClaims{Sub: subject, Exp: expires.Unix()})
+	signingInput := Base64URLEncode(header) + "." + Base64URLEncode(claims)
+	return signingInput + "." + Base64URLEncode(signToken(signingInput, secret))
+}
+
+// apiAuth checks every request for an API key or bearer token, except those to public paths.
+// The credentials are reloaded from the config file whenever it changes, so keys can be rotated without a restart.
+type apiAuth struct {
+	enabled bool
+	public  map[string]bool
+	creds   atomic.Pointer[apiCredentials]
+}
+
+func newAPIAuth(v *viper.Viper) (*apiAuth, error) {
+	a := &apiAuth{enabled: v.GetBool(AUTH_ENABLED), public: make(map[string]bool)}
+	for _, path := range v.GetStringSlice(AUTH_PUBLIC_PATHS) {
+		a.public[path] = true
+	}
+	creds, err := loadAPICredentials(v)
+	if err != nil {
+		return nil, err
+	}
+	a.creds.Store(creds)
+	return a, nil
+}
+
+// authenticate returns the caller's identity: the ID of its API key or the subject of its bearer token
+func (a *apiAuth) authenticate(r *http.Request) (string, error) {
+	creds := a.creds.Load()
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		if caller, ok := creds.callerForKey(key); ok {
+			return caller, nil
+		}
+		return "", fmt.Errorf("unknown API key")
+	}
+	if _, key, ok := r.BasicAuth(); ok {
+		if caller, ok := creds.callerForKey(key); ok {
+			return caller, nil
+		}
+		return "", fmt.Errorf("unknown API key")
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return creds.callerForToken(strings.TrimSpace(token), time.Now())
+	}
+	return "", fmt.Errorf("missing API key or bearer token")
+}
+
+// apiAuthHandler rejects unauthenticated requests with a 401, and tags the context of the others with the caller
+func (t *GmlServer) apiAuthHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !t.apiAuth.enabled || t.apiAuth.public[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		caller, err := t.apiAuth.authenticate(r)
+		if err != nil {
+			t.logger().WarnContext(r.Context(), "rejected unauthenticated request", "path", r.URL.Path, "err", err)
+			w.Header().Add("WWW-Authenticate", `Bearer realm="gml"`)
+			w.Header().Add("WWW-Authenticate", `Basic realm="gml"`)
+			t.writeError(w, http.StatusUnauthorized, &ErrorResp{Code: ErrCodeUnauthorized, Message: err.Error()})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withCaller(r.Context(), caller)))
+	})
+}
+
+// adminOnly answers 403 to callers not in auth.admins. With auth disabled there are no callers to tell apart and
+// every request is let through.
+func (t *GmlServer) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if t.apiAuth.enabled && !t.apiAuth.creds.Load().admins[CallerFrom(r.Context())] {
+			t.logger().WarnContext(r.Context(), "rejected request to an admin endpoint", "path", r.URL.Path)
+			t.writeError(w, http.StatusForbidden, &ErrorResp{Code: ErrCodeForbidden, Message: r.URL.Path + " is for admins only"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// watchAPICredentials reloads the credentials when the config file changes, until ctx is done.
+// A file that fails to load leaves the current credentials in place.
+func (t *GmlServer) watchAPICredentials(ctx context.Context, cfgFile string, interval time.Duration) {
+	lastModified := time.Time{}
+	if info, err := os.Stat(cfgFile); err == nil {
+		lastModified = info.ModTime()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(cfgFile)
+		if err != nil || info.ModTime().Equal(lastModified) {
+			continue
+		}
+		lastModified = info.ModTime()
+
+		v := viper.New()
+		err = setupViper(v, cfgFile)
+		var creds *apiCredentials
+		if err == nil {
+			creds, err = loadAPICredentials(v)
+		}
+		if err != nil {
+			t.logger().Error("failed to reload API credentials, keeping the current ones", "err", err)
+			continue
+		}
+		t.apiAuth.creds.Store(creds)
+		t.logger().Info("reloaded API credentials", "keys", len(creds.keys), "tokenSecrets", len(creds.secrets), "admins", len(creds.admins))
+	}
+}
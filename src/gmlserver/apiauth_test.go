@@ -0,0 +1,195 @@
+package gmlserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAuthConfig = `
+simserver:
+  url: http://simserver.invalid
+myam:
+  url: http://myam.invalid
+auth:
+  enabled: true
+  public:
+    paths:
+      - /healthz
+  keys:
+    - id: ops
+      key: ops-key
+    - id: ci
+      key: ci-key
+  tokens:
+    secrets:
+      - id: current
+        secret: current-secret
+  admins:
+    - ops
+`
+
+// newAuthTestServer returns a GmlServer configured with config, and the file config was written to
+func newAuthTestServer(t *testing.T, config string) (*GmlServer, string) {
+	t.Helper()
+	cfgFile := filepath.Join(t.TempDir(), "gmlserverconfig.yml")
+	if err := os.WriteFile(cfgFile, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewGmlServer(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.config.Logger = quietLogger
+	return server, cfgFile
+}
+
+func TestAdminOnly(t *testing.T) {
+	server, _ := newAuthTestServer(t, testAuthConfig)
+	for _, tc := range []struct {
+		name    string
+		enabled bool
+		key     string
+		status  int
+	}{
+		{"admin", true, "ops-key", http.StatusOK},
+		{"caller not in admins", true, "ci-key", http.StatusForbidden},
+		{"no key", true, "", http.StatusUnauthorized},
+		{"auth disabled", false, "", http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server.apiAuth.enabled = tc.enabled
+			// an admin asking for an unknown capture gets past the check to the 404
+			for path, allowed := range map[string]int{
+				loggingPath: http.StatusOK, profilesPath: http.StatusOK, capturesPath + "/unknown": http.StatusNotFound,
+			} {
+				req := httptest.NewRequest(http.MethodGet, path, nil)
+				if tc.key != "" {
+					req.Header.Set(APIKeyHeader, tc.key)
+				}
+				rec := httptest.NewRecorder()
+				server.Handler().ServeHTTP(rec, req)
+				want := tc.status
+				if want == http.StatusOK {
+					want = allowed
+				}
+				if rec.Code != want {
+					t.Errorf("GET %s = %d, want %d: %s", path, rec.Code, want, rec.Body)
+				}
+			}
+		})
+	}
+}
+
+// signedToken returns a JWT with header and claims, signed with secret whatever alg the header names
+func signedToken(header tokenHeader, claims tokenClaims, secret string) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signingInput := Base64URLEncode(h) + "." + Base64URLEncode(c)
+	return signingInput + "." + Base64URLEncode(signToken(signingInput, []byte(secret)))
+}
+
+func TestCallerForToken(t *testing.T) {
+	server, _ := newAuthTestServer(t, testAuthConfig)
+	creds := server.apiAuth.creds.Load()
+	now := time.Now()
+	valid := tokenClaims{Sub: "alice", Exp: now.Add(time.Minute).Unix()}
+	for _, tc := range []struct {
+		name   string
+		token  string
+		caller string
+		err    string
+	}{
+		{"valid", NewBearerToken("current", []byte("current-secret"), "alice", now.Add(time.Minute)), "alice", ""},
+		{"no kid", signedToken(tokenHeader{Alg: "HS256"}, valid, "current-secret"), "alice", ""},
+		{"bad signature", NewBearerToken("current", []byte("wrong-secret"), "alice", now.Add(time.Minute)), "", "does not match"},
+		{"alg none", signedToken(tokenHeader{Alg: "none", Kid: "current"}, valid, "current-secret"), "", "not supported"},
+		{"alg HS512", signedToken(tokenHeader{Alg: "HS512", Kid: "current"}, valid, "current-secret"), "", "not supported"},
+		{"unknown kid", signedToken(tokenHeader{Alg: "HS256", Kid: "retired"}, valid, "current-secret"), "", "does not match"},
+		{"expired", NewBearerToken("current", []byte("current-secret"), "alice", now.Add(-time.Second)), "", "expired"},
+		{"not valid yet", signedToken(tokenHeader{Alg: "HS256", Kid: "current"}, tokenClaims{Sub: "alice", Nbf: now.Add(time.Minute).Unix()}, "current-secret"), "", "not valid yet"},
+		{"no sub", signedToken(tokenHeader{Alg: "HS256", Kid: "current"}, tokenClaims{Exp: valid.Exp}, "current-secret"), "", "no sub"},
+		{"malformed", "not.a-token", "", "malformed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			caller, err := creds.callerForToken(tc.token, now)
+			switch {
+			case tc.err == "" && (err != nil || caller != tc.caller):
+				t.Errorf("callerForToken = %q, %v, want %q", caller, err, tc.caller)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Errorf("callerForToken = %q, %v, want an error containing %q", caller, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestAPIAuthPublicPaths(t *testing.T) {
+	server, _ := newAuthTestServer(t, testAuthConfig)
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{healthzPath, http.StatusOK},
+		// only the exact path is public
+		{healthzPath + "/", http.StatusUnauthorized},
+		{readyzPath, http.StatusUnauthorized},
+		{metricsPath, http.StatusUnauthorized},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if rec.Code != tc.status {
+				t.Errorf("GET %s without credentials = %d, want %d", tc.path, rec.Code, tc.status)
+			}
+		})
+	}
+}
+
+func TestWatchAPICredentials(t *testing.T) {
+	server, cfgFile := newAuthTestServer(t, testAuthConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.watchAPICredentials(ctx, cfgFile, 5*time.Millisecond)
+
+	// write replaces the config with a modification time that differs from the last one, however coarse the clock
+	modified := time.Now()
+	write := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(cfgFile, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		modified = modified.Add(time.Second)
+		if err := os.Chtimes(cfgFile, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a change made before the watcher first looked at the file goes unseen, so it is made again until picked up
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := server.apiAuth.creds.Load().callerForKey("rotated-ci-key"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the rotated key was not reloaded")
+		}
+		write(strings.Replace(testAuthConfig, "key: ci-key", "key: rotated-ci-key", 1))
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, ok := server.apiAuth.creds.Load().callerForKey("ci-key"); ok {
+		t.Error("the replaced key still works after the reload")
+	}
+
+	// a config that fails to load leaves the current credentials in place
+	write(strings.Replace(testAuthConfig, "- id: ci\n      key:", "- key:", 1))
+	time.Sleep(50 * time.Millisecond)
+	if caller, ok := server.apiAuth.creds.Load().callerForKey("rotated-ci-key"); !ok || caller != "ci" {
+		t.Errorf("callerForKey after a broken config = %q, %v, want ci", caller, ok)
+	}
+}
@@ -1,6 +1,8 @@
 package gmlserver
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -8,20 +10,25 @@ import (
 	"net/http/cookiejar"
 	"net/url"
 	"strings"
+
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
-func GetAccessToken(scope string, userID string, password string, clientID string) (string, error) {
+// ErrLoginRejected is returned when MyAM turns down the user's password or step up PIN
+var ErrLoginRejected = errors.New("MyAM rejected the credentials")
+
+func GetAccessToken(ctx context.Context, cfg *Configuration, scope string, userID string, password string, clientID string) (string, error) {
 	codeVerifier, codeChallenge, err := generateCodeVerifierAndCaculateCodeChallenge()
 	if err != nil {
 		return "", err
 	}
 
-	authcode, err := getAuthCode(scope, authlevelCLB, userID, password, codeChallenge, clientID)
+	authcode, err := getAuthCode(ctx, cfg, scope, authlevelCLB, userID, password, codeChallenge, clientID)
 	if err != nil {
 		return "", err
 	}
 	payload := &AccessTokenReqBody{
-		Provider:     Config.CorrectProviderURL,
+		Provider:     cfg.CorrectProviderURL,
 		AuthCode:     authcode,
 		CodeVerifier: codeVerifier,
 		ClientID:     clientID,
@@ -30,9 +37,9 @@ func GetAccessToken(scope string, userID string, password string, clientID strin
 	postbody.Body.AccessTokenBody = payload
 	var expected = new(AccessTokenResp)
 
-	err = SendRequestAndCheckResponse(accessTokenRequestMethod, postbody.Body, http.StatusAccepted, &expected.Body)
+	err = SendRequestAndCheckResponse(ctx, cfg, accessTokenRequestMethod, postbody.Body, http.StatusAccepted, &expected.Body)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
 	/*
@@ -46,14 +53,14 @@ func GetAccessToken(scope string, userID string, password string, clientID strin
 	return expected.Body.AccessToken, nil
 }
 
-func getAuthCode(scope, authlevel string, userID string, password string, codeChallenge string, clientID string) (string, error) {
+func getAuthCode(ctx context.Context, cfg *Configuration, scope, authlevel string, userID string, password string, codeChallenge string, clientID string) (string, error) {
 
 	payload := &RequestObjectReqBody{
-		Provider:            Config.CorrectProviderURL,
-		Audience:            Config.CorrectAudience,
+		Provider:            cfg.CorrectProviderURL,
+		Audience:            cfg.CorrectAudience,
 		State:               correctState,
 		Scopes:              scope,
-		UILocales:           Config.UILocales,
+		UILocales:           cfg.UILocales,
 		AcrValues:           authlevel,
 		CodeChallengeMethod: "S256",
 		CodeChallenge:       codeChallenge,
@@ -63,7 +70,7 @@ func getAuthCode(scope, authlevel string, userID string, password string, codeCh
 	var postbody = new(RequestObjectReq)
 	postbody.Body.RequestObjBody = payload
 	var expected = new(RequestObjectResp)
-	err := SendRequestAndCheckResponse(requestObjectRequestMethod, postbody.Body, http.StatusAccepted, &expected.Body)
+	err := SendRequestAndCheckResponse(ctx, cfg, requestObjectRequestMethod, postbody.Body, http.StatusAccepted, &expected.Body)
 	if err != nil {
 		return "", err
 	}
@@ -84,15 +91,15 @@ func getAuthCode(scope, authlevel string, userID string, password string, codeCh
 			return "", fmt.Errorf("ui_locales is not present in the url")
 		}
 		//make sure ui_locales matches the simulator locales
-		if parameters["ui_locales"][0] != Config.UILocales {
+		if parameters["ui_locales"][0] != cfg.UILocales {
 			return "", fmt.Errorf("the locales param does not match")
 		}
 	}
 
 	var authcode string
-	authcode, err = MyAMGetOIDCAuthCode(userID, password, expected.Body.LoginURL)
+	authcode, err = MyAMGetOIDCAuthCode(ctx, cfg, userID, password, expected.Body.LoginURL)
 	if err != nil {
-		return "", fmt.Errorf("failed to get authcode for user %s :: %v", userID, err)
+		return "", fmt.Errorf("failed to get authcode :: %w", err)
 	}
 
 	if err != nil || authcode == "" {
@@ -101,25 +108,35 @@ func getAuthCode(scope, authlevel string, userID string, password string, codeCh
 	return authcode, nil
 }
 
-func MyAMGetOIDCAuthCode(userID, password, loginurl string) (string, error) {
+func MyAMGetOIDCAuthCode(ctx context.Context, cfg *Configuration, userID, password, loginurl string) (string, error) {
 	oidcAuthURL, err := url.Parse(loginurl)
 	if err != nil {
 		return "", fmt.Errorf("failed to parse loginurl %v, url: %s", err, loginurl)
 	}
-	authenticator := NewMyAMAuthenticator(userID, password, oidcAuthURL)
-	return authenticator.GetOIDCAuthCode()
+	authenticator := NewMyAMAuthenticator(cfg.MyAMClient, userID, password, oidcAuthURL)
+	authenticator.metrics = cfg.Metrics
+	authenticator.breaker = cfg.MyAMBreaker
+	authenticator.tracer = cfg.tracer()
+	return authenticator.GetOIDCAuthCode(ctx)
 }
 
-func NewMyAMAuthenticator(userID, password string, oidcAuthURL *url.URL) *MyAMAuthenticator {
+// NewMyAMAuthenticator returns an authenticator sending its requests through a copy of client,
+// so the cookies and redirect handling of one login never leak into another.
+func NewMyAMAuthenticator(client *http.Client, userID, password string, oidcAuthURL *url.URL) *MyAMAuthenticator {
+	authClient := &http.Client{Timeout: defaultTimeout}
+	if client != nil {
+		*authClient = *client
+	}
 	return &MyAMAuthenticator{
+		client:      authClient,
+		tracer:      noop.NewTracerProvider().Tracer(tracerName),
 		userID:      userID,
 		password:    password,
 		oidcAuthURL: oidcAuthURL,
 	}
 }
 
-func (t *MyAMAuthenticator) GetOIDCAuthCode() (string, error) {
-	t.client = &http.Client{Timeout: defaultTimeout}
+func (t *MyAMAuthenticator) GetOIDCAuthCode(ctx context.Context) (string, error) {
 	var err error
 	t.client.Jar, err = cookiejar.New(nil)
 	if err != nil {
@@ -128,8 +145,7 @@ func (t *MyAMAuthenticator) GetOIDCAuthCode() (string, error) {
 
 	// step 1. visit login URL
 	loginPageURL := t.oidcAuthURL.String()
-	loginPageURLResp, err := t.client.Get(loginPageURL)
-	_, err = t.checkResponse("authorize", loginPageURL, loginPageURLResp, err)
+	loginPageURLResp, err := t.get(ctx, "authorize", loginPageURL)
 	if err != nil {
 		return "", err
 	}
@@ -145,7 +161,7 @@ func (t *MyAMAuthenticator) GetOIDCAuthCode() (string, error) {
                         "rememberMe": false
                 }
         `, t.userID, t.password)
-	authenticateResp, err := t.postRequest("authenticate", "application/json", authPayload)
+	authenticateResp, err := t.postRequest(ctx, "authenticate", "application/json", authPayload)
 	if err != nil {
 		return "", err
 	}
@@ -166,7 +182,7 @@ func (t *MyAMAuthenticator) GetOIDCAuthCode() (string, error) {
 
 	// step 3. submit login form
 	payload := fmt.Sprintf(`username=%s&password=%s`, t.userID, t.password)
-	loginResp, err := t.postRequest("login", "application/x-www-form-urlencoded", payload)
+	loginResp, err := t.postRequest(ctx, "login", "application/x-www-form-urlencoded", payload)
 	if err != nil {
 		return "", err
 	}
@@ -174,15 +190,19 @@ func (t *MyAMAuthenticator) GetOIDCAuthCode() (string, error) {
 	if t.authCode != "" {
 		return t.authCode, nil
 	}
-	if loginResp.ContentLength > 0 {
+	if loginResp.ContentLength != 0 {
 		respbody, err := ioutil.ReadAll(loginResp.Body)
 		if err != nil {
 			return "", err
 		}
 
+		if isLoginPage(string(respbody)) {
+			// MyAM shows the login form again for a wrong password
+			return "", loginRejected("login", loginResp.StatusCode, "the login page again")
+		}
 		if strings.Contains(string(respbody), `action="/myam/oidc/stepup"`) {
 			// step 3.1  - step up authentication, send bogus pin
-			stepUpResp, err := t.sendGetRequest("stepup", "code=1234")
+			stepUpResp, err := t.sendGetRequest(ctx, "stepup", "code=1234")
 			if err != nil {
 				return "", err
 			}
@@ -194,7 +214,7 @@ func (t *MyAMAuthenticator) GetOIDCAuthCode() (string, error) {
 	}
 
 	// step 4. submit consent
-	consentResp, err := t.sendGetRequest("consent", "")
+	consentResp, err := t.sendGetRequest(ctx, "consent", "")
 	if err != nil {
 		return "", err
 	}
@@ -206,24 +226,55 @@ func (t *MyAMAuthenticator) GetOIDCAuthCode() (string, error) {
 	return "", fmt.Errorf("No auth code obtained after successfully sending all necessary requests to MyAM")
 }
 
-func (t *MyAMAuthenticator) postRequest(operation, contentType, payload string) (*http.Response, error) {
+func (t *MyAMAuthenticator) postRequest(ctx context.Context, operation, contentType, payload string) (*http.Response, error) {
 	var body io.Reader
 	if payload != "" {
 		body = strings.NewReader(payload)
 	}
 
 	urlStr := t.getURL(operation)
-	resp, err := t.client.Post(urlStr, contentType, body)
-	return t.checkResponse(operation, urlStr, resp, err)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, urlStr, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return t.do(operation, req)
 }
 
-func (t *MyAMAuthenticator) sendGetRequest(operation, query string) (*http.Response, error) {
+func (t *MyAMAuthenticator) sendGetRequest(ctx context.Context, operation, query string) (*http.Response, error) {
 	urlStr := t.getURL(operation)
 	if query != "" {
 		urlStr += "?" + query
 	}
-	resp, err := t.client.Get(urlStr)
-	return t.checkResponse(operation, urlStr, resp, err)
+	return t.get(ctx, operation, urlStr)
+}
+
+func (t *MyAMAuthenticator) get(ctx context.Context, operation, urlStr string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return t.do(operation, req)
+}
+
+// do sends one hop of the login in its own span, carrying the request ID and trace context, unless MyAM's
+// circuit breaker is open
+func (t *MyAMAuthenticator) do(operation string, req *http.Request) (*http.Response, error) {
+	done, err := t.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	req, span := startClientSpan(t.tracer, "myam "+operation, req)
+	setRequestIDHeader(req)
+	resp, err := t.client.Do(req)
+	resp, err = t.checkResponse(operation, req.URL.String(), resp, err)
+	done(err)
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	endClientSpan(span, statusCode, err)
+	return resp, err
 }
 
 func (t *MyAMAuthenticator) getURL(operation string) string {
@@ -238,17 +289,55 @@ func (t *MyAMAuthenticator) getURL(operation string) string {
 
 func (t *MyAMAuthenticator) checkResponse(operation string, urlStr string, resp *http.Response, err error) (*http.Response, error) {
 	if err != nil {
+		// an intercepted redirect still comes with the response that redirected
+		if resp != nil {
+			t.metrics.observeUpstream(UpstreamMyAM, operation, resp.StatusCode)
+		} else {
+			t.metrics.observeUpstream(UpstreamMyAM, operation, 0)
+		}
 		// check if we already got a redirect with authCode
 		if t.authCode != "" {
 			// done
 			return resp, nil
 		}
-		return nil, fmt.Errorf("Request to %s failed, error: %v, url: %s", operation, err, urlStr)
+		if resp != nil && isLoginRedirect(t.lastRedirect) {
+			return nil, loginRejected(operation, resp.StatusCode, "redirected to "+t.lastRedirect)
+		}
+		return nil, &UpstreamError{Method: operation, ExpectedStatus: http.StatusOK, Err: err}
 	}
+	t.metrics.observeUpstream(UpstreamMyAM, operation, resp.StatusCode)
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		respbody, _ := ioutil.ReadAll(resp.Body)
 		defer resp.Body.Close()
-		return resp, fmt.Errorf("%s endpoint returns non-200, status: %v, response: %s, url: %s", operation, resp.Status, respbody, urlStr)
+		if credentialOperations[operation] && (resp.StatusCode == http.StatusBadRequest ||
+			resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			return resp, loginRejected(operation, resp.StatusCode, string(respbody))
+		}
+		return resp, &UpstreamError{Method: operation, StatusCode: resp.StatusCode, ExpectedStatus: http.StatusOK, Body: string(respbody)}
 	}
 	return resp, nil
 }
+
+// credentialOperations are the MyAM hops checking the user's password or step up PIN
+var credentialOperations = map[string]bool{"authenticate": true, "login": true, "stepup": true}
+
+// loginRejected is the error of a MyAM hop turning down the credentials, carrying what MyAM answered
+func loginRejected(operation string, statusCode int, answer string) error {
+	return fmt.Errorf("%w: %w", ErrLoginRejected, &UpstreamError{Method: operation, StatusCode: statusCode, ExpectedStatus: http.StatusOK, Body: answer})
+}
+
+// isLoginPage reports whether a MyAM page is the login form
+func isLoginPage(body string) bool {
+	return strings.Contains(body, `action="/myam/oidc/login"`) || strings.Contains(body, `type="password"`)
+}
+
+// isLoginRedirect reports whether MyAM redirected back to its login pages or to the client with an error,
+// rather than on with an auth code
+func isLoginRedirect(location string) bool {
+	redirect, err := url.Parse(location)
+	if err != nil || location == "" {
+		return false
+	}
+	return strings.HasSuffix(redirect.Path, "/authorize") || strings.HasSuffix(redirect.Path, "/login") ||
+		redirect.Query().Get("error") != ""
+}
@@ -0,0 +1,167 @@
+package gmlserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const (
+	licenseBatchPath = "/v1/licenses/batch"
+
+	defaultBatchConcurrency = 4
+	defaultBatchMaxItems    = 100
+)
+
+// userLocks serializes license flows of the same MyAM user, so they don't race on the user's lockbox
+type userLocks struct {
+	mu    sync.Mutex
+	locks map[string]*userLock
+}
+
+type userLock struct {
+	held    chan struct{}
+	waiters int
+}
+
+func newUserLocks() *userLocks {
+	return &userLocks{locks: make(map[string]*userLock)}
+}
+
+// lock waits until no other flow holds the username, the returned func releases it
+func (l *userLocks) lock(ctx context.Context, username string) (func(), error) {
+	l.mu.Lock()
+	lock, ok := l.locks[username]
+	if !ok {
+		lock = &userLock{held: make(chan struct{}, 1)}
+		l.locks[username] = lock
+	}
+	lock.waiters++
+	l.mu.Unlock()
+
+	release := func() {
+		l.mu.Lock()
+		lock.waiters--
+		if lock.waiters == 0 {
+			delete(l.locks, username)
+		}
+		l.mu.Unlock()
+	}
+	select {
+	case lock.held <- struct{}{}:
+		return func() {
+			<-lock.held
+			release()
+		}, nil
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+}
+
+// licenseBatchHandler serves POST /v1/licenses/batch
+//
+// swagger:route POST /v1/licenses/batch licenses createLicenseBatch
+//
+// Get DA licenses for several license requests at once.
+//
+// Items run concurrently up to the requested concurrency, items of the same MyAM user run one after
+// the other. Answers once every item has finished, with one result per item in input order.
+// Each item counts against its user's rate limit, the whole batch is rejected if any user is over it.
+//
+// responses:
+//
+//	200: batchLicenseResponse
+//	400: errorResponse
+//	429: errorResponse
+func (t *GmlServer) licenseBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		t.writeError(w, http.StatusMethodNotAllowed, &ErrorResp{Code: ErrCodeMethodNotAllowed, Message: r.Method + " is not supported"})
+		return
+	}
+
+	expectedBody := new(BatchLicenseReqBody)
+	err := decodeRequestBody(r, expectedBody)
+	if err == nil && len(expectedBody.Items) > t.BatchMaxItems {
+		err = fmt.Errorf("a batch takes at most %d items, got %d", t.BatchMaxItems, len(expectedBody.Items))
+	}
+	if err != nil {
+		t.logger().WarnContext(r.Context(), "licenseBatchHandler: invalid request", "err", err)
+		t.writeError(w, http.StatusBadRequest, &ErrorResp{Code: ErrCodeInvalidRequest, Message: err.Error()})
+		return
+	}
+	items := make([]*GmlReqBody, len(expectedBody.Items))
+	usernames := make([]string, len(expectedBody.Items))
+	for i := range expectedBody.Items {
+		items[i] = &expectedBody.Items[i]
+	}
+	envs, ok := t.resolveEnvironments(w, r, items...)
+	if !ok || !t.resolveProfiles(w, r, envs, items...) {
+		return
+	}
+	for i, item := range items {
+		usernames[i] = item.Username
+	}
+	if t.usersRateLimited(w, r, usernames...) {
+		return
+	}
+
+	concurrency := expectedBody.Concurrency
+	if concurrency == 0 || concurrency > t.BatchConcurrency {
+		concurrency = t.BatchConcurrency
+	}
+	respBody := new(BatchLicenseResp)
+	respBody.Body.Results = t.runBatch(r.Context(), expectedBody.Items, envs, concurrency)
+	for _, result := range respBody.Body.Results {
+		if result.Error != nil {
+			respBody.Body.Failed++
+		} else {
+			respBody.Body.Succeeded++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	t.writeResponse(w, &respBody.Body, http.StatusOK)
+}
+
+// runBatch gets a license for every item from its environment in envs, at most concurrency at a time
+func (t *GmlServer) runBatch(ctx context.Context, items []GmlReqBody, envs []*environment, concurrency int) []BatchLicenseResult {
+	results := make([]BatchLicenseResult, len(items))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range items {
+		wg.Add(1)
+		go func(i int, item *GmlReqBody) {
+			defer wg.Done()
+			results[i].Index = i
+			ctx := envs[i].flowContext(ctx)
+			license, err := t.runBatchItem(ctx, envs[i], item, slots)
+			if err != nil {
+				t.logger().ErrorContext(withUser(ctx, envs[i].config.Logging, item.Username), "runBatch: item failed", "index", i, "err", err)
+				_, results[i].Error = errorResponseFor(err)
+				return
+			}
+			results[i].License = license
+		}(i, &items[i])
+	}
+	wg.Wait()
+	return results
+}
+
+func (t *GmlServer) runBatchItem(ctx context.Context, env *environment, item *GmlReqBody, slots chan struct{}) (string, error) {
+	// take the user's lock before a slot, so items waiting on their user don't hold slots,
+	// users of different environments are different users
+	unlock, err := t.userLocks.lock(ctx, env.name+"/"+item.Username)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	select {
+	case slots <- struct{}{}:
+		defer func() { <-slots }()
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	return getLicenseForDA(ctx, env.config, item.Username, item.Password, item.RequestID, item.RequestEncKey, nil)
+}
@@ -0,0 +1,98 @@
+package gmlserver
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowSimServer fails every call with status after delay, recording how many calls were in flight at most
+type slowSimServer struct {
+	delay  time.Duration
+	status int
+
+	mu          sync.Mutex
+	active, max int
+}
+
+func (s *slowSimServer) Call(ctx context.Context, method string, req interface{}, expectedStatus int, resp interface{}) error {
+	s.mu.Lock()
+	s.active++
+	s.max = max(s.max, s.active)
+	s.mu.Unlock()
+	time.Sleep(s.delay)
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+	return &UpstreamError{Method: method, StatusCode: s.status, ExpectedStatus: expectedStatus}
+}
+
+func batchItems(usernames ...string) []GmlReqBody {
+	items := make([]GmlReqBody, len(usernames))
+	for i, username := range usernames {
+		items[i] = GmlReqBody{Username: username, Password: "secret", RequestID: "request-id", RequestEncKey: "enc-key"}
+	}
+	return items
+}
+
+func TestBatchResultsInInputOrder(t *testing.T) {
+	// the items of the slow environment finish last, their results still come first
+	slow := newTestEnvironment("slow", &slowSimServer{delay: 30 * time.Millisecond, status: http.StatusBadRequest})
+	fast := newTestEnvironment("fast", &slowSimServer{status: http.StatusConflict})
+	server := &GmlServer{userLocks: newUserLocks()}
+
+	items := batchItems("alice", "bob", "carol", "dave")
+	results := server.runBatch(context.Background(), items, []*environment{slow, fast, slow, fast}, 4)
+	for i, want := range []int{http.StatusBadRequest, http.StatusConflict, http.StatusBadRequest, http.StatusConflict} {
+		if results[i].Index != i || results[i].Error == nil || results[i].Error.UpstreamStatus != want {
+			t.Errorf("results[%d] = %+v, want index %d failing with %d", i, results[i], i, want)
+		}
+	}
+}
+
+func TestBatchSerializesUsers(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		usernames []string
+		envs      []string
+		wantMax   int
+	}{
+		{"same user", []string{"alice", "alice", "alice"}, []string{"org10", "org10", "org10"}, 1},
+		{"different users", []string{"alice", "bob", "carol"}, []string{"org10", "org10", "org10"}, 3},
+		{"same user in different environments", []string{"alice", "alice"}, []string{"org10", "peerorg10"}, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sim := &slowSimServer{delay: 30 * time.Millisecond, status: http.StatusBadRequest}
+			byName := map[string]*environment{}
+			envs := make([]*environment, len(tc.envs))
+			for i, name := range tc.envs {
+				if byName[name] == nil {
+					byName[name] = newTestEnvironment(name, sim)
+				}
+				envs[i] = byName[name]
+			}
+			server := &GmlServer{userLocks: newUserLocks()}
+
+			server.runBatch(context.Background(), batchItems(tc.usernames...), envs, len(tc.usernames))
+			if sim.max != tc.wantMax {
+				t.Errorf("at most %d flows ran at once, want %d", sim.max, tc.wantMax)
+			}
+			if len(server.userLocks.locks) != 0 {
+				t.Errorf("user locks left behind: %v", server.userLocks.locks)
+			}
+		})
+	}
+}
+
+func TestBatchConcurrencyLimit(t *testing.T) {
+	sim := &slowSimServer{delay: 20 * time.Millisecond, status: http.StatusBadRequest}
+	server := &GmlServer{userLocks: newUserLocks()}
+	env := newTestEnvironment(DefaultEnvironment, sim)
+
+	server.runBatch(context.Background(), batchItems("a", "b", "c", "d", "e"), []*environment{env, env, env, env, env}, 2)
+	if sim.max != 2 {
+		t.Errorf("at most %d flows ran at once, want 2", sim.max)
+	}
+}
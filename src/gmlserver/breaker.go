@@ -0,0 +1,217 @@
+package gmlserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// states of a CircuitBreaker
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// ErrCircuitOpen is matched by the error returned for a call rejected by an open circuit breaker
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitOpenError is returned instead of calling an upstream whose circuit breaker is open
+type CircuitOpenError struct {
+	// Upstream is simserver or myam
+	Upstream string
+	// Failures is the number of consecutive failures that opened the breaker
+	Failures int
+	// Until is when the breaker lets a probe through again
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	if wait := e.RetryAfter(); wait > 0 {
+		return fmt.Sprintf("%s is unavailable: circuit breaker opened after %d consecutive failures, next attempt in %s",
+			e.Upstream, e.Failures, wait.Round(time.Second))
+	}
+	return fmt.Sprintf("%s is unavailable: circuit breaker opened after %d consecutive failures, probing it again",
+		e.Upstream, e.Failures)
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// RetryAfter is the time left until the breaker lets a probe through
+func (e *CircuitOpenError) RetryAfter() time.Duration {
+	if wait := time.Until(e.Until); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// BreakerSettings configures the circuit breaker of an upstream
+type BreakerSettings struct {
+	// Failures is the number of consecutive failed calls that open the breaker, 0 never opens it
+	Failures int `mapstructure:"failures"`
+	// Cooldown is how long the breaker stays open before letting probes through
+	Cooldown time.Duration `mapstructure:"cooldown"`
+	// Probes is the number of calls let through while half-open, the breaker closes once they all succeed
+	// and opens again as soon as one fails
+	Probes int `mapstructure:"probes"`
+}
+
+// DefaultBreakerSettings opens a breaker after 5 failures in a row and probes the upstream again 30s later
+func DefaultBreakerSettings() BreakerSettings {
+	return BreakerSettings{Failures: 5, Cooldown: 30 * time.Second, Probes: 1}
+}
+
+func (s BreakerSettings) validate() error {
+	switch {
+	case s.Failures < 0:
+		return fmt.Errorf("failures must not be negative")
+	case s.Cooldown <= 0:
+		return fmt.Errorf("cooldown must be positive")
+	case s.Probes < 1:
+		return fmt.Errorf("probes must be at least 1")
+	}
+	return nil
+}
+
+// CircuitBreaker stops calls to an upstream that keeps failing, so flows fail fast rather than each waiting
+// out timeouts and retries. A nil *CircuitBreaker lets every call through.
+type CircuitBreaker struct {
+	upstream string
+	settings BreakerSettings
+	metrics  *Metrics
+	now      func() time.Time
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	// generation changes with every state change, so calls let through in one state don't count in the next
+	generation int
+	probes     int
+	succeeded  int
+}
+
+// NewCircuitBreaker returns a closed breaker of upstream, reporting its state to metrics. A cooldown or probes
+// left at zero take their default.
+func NewCircuitBreaker(upstream string, settings BreakerSettings, metrics *Metrics) *CircuitBreaker {
+	if settings.Cooldown <= 0 {
+		settings.Cooldown = DefaultBreakerSettings().Cooldown
+	}
+	if settings.Probes < 1 {
+		settings.Probes = DefaultBreakerSettings().Probes
+	}
+	b := &CircuitBreaker{upstream: upstream, settings: settings, metrics: metrics, now: time.Now, state: CircuitClosed}
+	metrics.circuitState(upstream, CircuitClosed)
+	return b
+}
+
+// State returns closed, open or half_open, an open breaker whose cooldown is over reports half_open
+func (b *CircuitBreaker) State() string {
+	if b == nil {
+		return CircuitClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cooledDown()
+	return b.state
+}
+
+// Allow asks to call the upstream. It returns a *CircuitOpenError if the breaker is open, otherwise done must
+// be called with the call's error once it returns.
+func (b *CircuitBreaker) Allow() (done func(err error), err error) {
+	if b == nil || b.settings.Failures == 0 {
+		return func(error) {}, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cooledDown()
+	switch {
+	case b.state == CircuitOpen,
+		b.state == CircuitHalfOpen && b.probes >= b.settings.Probes:
+		b.metrics.circuitRejected(b.upstream)
+		return nil, &CircuitOpenError{Upstream: b.upstream, Failures: b.failures, Until: b.openedAt.Add(b.settings.Cooldown)}
+	case b.state == CircuitHalfOpen:
+		b.probes++
+	}
+	generation := b.generation
+	return func(err error) { b.record(generation, breakerFailure(err)) }, nil
+}
+
+// cooledDown moves an open breaker to half-open once its cooldown is over
+func (b *CircuitBreaker) cooledDown() {
+	if b.state == CircuitOpen && !b.now().Before(b.openedAt.Add(b.settings.Cooldown)) {
+		b.transition(CircuitHalfOpen)
+	}
+}
+
+func (b *CircuitBreaker) record(generation int, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if generation != b.generation {
+		return
+	}
+	switch {
+	case b.state == CircuitHalfOpen && failed:
+		b.open()
+	case b.state == CircuitHalfOpen:
+		b.succeeded++
+		if b.succeeded >= b.settings.Probes {
+			b.failures = 0
+			b.transition(CircuitClosed)
+			myLogger.Info("circuit breaker closed", "upstream", b.upstream)
+		}
+	case failed:
+		b.failures++
+		if b.failures >= b.settings.Failures {
+			b.open()
+		}
+	default:
+		b.failures = 0
+	}
+}
+
+func (b *CircuitBreaker) open() {
+	b.openedAt = b.now()
+	b.transition(CircuitOpen)
+	myLogger.Warn("circuit breaker opened", "upstream", b.upstream, "failures", b.failures, "cooldown", b.settings.Cooldown)
+}
+
+func (b *CircuitBreaker) transition(state string) {
+	b.state = state
+	b.generation++
+	b.probes, b.succeeded = 0, 0
+	b.metrics.circuitTransitioned(b.upstream, state)
+}
+
+// breakerFailure reports whether err says the upstream is in trouble: no response or a 5xx. Rejections such as
+// a 4xx, or a caller giving up, say nothing about the upstream's health.
+func breakerFailure(err error) bool {
+	var upstreamErr *UpstreamError
+	if !errors.As(err, &upstreamErr) {
+		return false
+	}
+	if upstreamErr.Err != nil {
+		return !errors.Is(upstreamErr.Err, context.Canceled)
+	}
+	return upstreamErr.StatusCode >= http.StatusInternalServerError
+}
+
+// loadBreaker reads the breaker settings under prefix, ie. simserver., starting from the defaults
+func loadBreaker(v *viper.Viper, prefix, upstream string, metrics *Metrics) (*CircuitBreaker, error) {
+	settings := DefaultBreakerSettings()
+	key := prefix + UPSTREAM_BREAKER
+	if err := v.UnmarshalKey(key, &settings); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	if err := settings.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return NewCircuitBreaker(upstream, settings, metrics), nil
+}
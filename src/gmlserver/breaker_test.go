@@ -0,0 +1,160 @@
+package gmlserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestBreaker(failures, probes int) (*CircuitBreaker, *time.Time) {
+	now := time.Now()
+	b := NewCircuitBreaker(UpstreamSimServer, BreakerSettings{Failures: failures, Cooldown: time.Minute, Probes: probes}, nil)
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+func callBreaker(t *testing.T, b *CircuitBreaker, err error) {
+	t.Helper()
+	done, allowErr := b.Allow()
+	if allowErr != nil {
+		t.Fatalf("Allow() = %v, want the call let through", allowErr)
+	}
+	done(err)
+}
+
+func TestCircuitBreakerOpensAndProbes(t *testing.T) {
+	b, now := newTestBreaker(2, 1)
+	unavailable := &UpstreamError{StatusCode: http.StatusServiceUnavailable}
+
+	callBreaker(t, b, &UpstreamError{StatusCode: http.StatusBadRequest})
+	callBreaker(t, b, unavailable)
+	if state := b.State(); state != CircuitClosed {
+		t.Fatalf("state after a 400 and a 503 = %s, want closed", state)
+	}
+	callBreaker(t, b, unavailable)
+	if state := b.State(); state != CircuitOpen {
+		t.Fatalf("state after two 503s = %s, want open", state)
+	}
+	if _, err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow() while open = %v, want ErrCircuitOpen", err)
+	}
+
+	*now = now.Add(time.Minute)
+	if state := b.State(); state != CircuitHalfOpen {
+		t.Fatalf("state after the cooldown = %s, want half_open", state)
+	}
+	done, err := b.Allow()
+	if err != nil {
+		t.Fatalf("first Allow() while half open = %v, want the probe let through", err)
+	}
+	if _, err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("second Allow() while half open = %v, want ErrCircuitOpen", err)
+	}
+	done(unavailable)
+	if state := b.State(); state != CircuitOpen {
+		t.Fatalf("state after a failed probe = %s, want open", state)
+	}
+
+	*now = now.Add(time.Minute)
+	callBreaker(t, b, nil)
+	if state := b.State(); state != CircuitClosed {
+		t.Errorf("state after a successful probe = %s, want closed", state)
+	}
+}
+
+func TestCircuitBreakerIgnoresStaleCalls(t *testing.T) {
+	b, now := newTestBreaker(1, 1)
+	slow, err := b.Allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	callBreaker(t, b, &UpstreamError{Err: context.DeadlineExceeded})
+	*now = now.Add(time.Minute)
+	// a call let through before the breaker opened doesn't count as the probe
+	slow(nil)
+	if state := b.State(); state != CircuitHalfOpen {
+		t.Errorf("state = %s, want half_open", state)
+	}
+}
+
+func TestLicenseFlowFailsFastWhileCircuitOpen(t *testing.T) {
+	fake := &fakeSimServer{status: map[string]int{requestObjectRequestMethod: http.StatusBadGateway}}
+	cfg := NewConfiguration("http://simserver.invalid", "http://myam.invalid")
+	cfg.SimServer = fake
+	cfg.Retry = nil
+	cfg.SimServerBreaker = NewCircuitBreaker(UpstreamSimServer, BreakerSettings{Failures: 2, Cooldown: time.Minute, Probes: 1}, nil)
+
+	var err error
+	for i := 0; i < 3; i++ {
+		_, err = getLicenseForDA(context.Background(), cfg, "alice", "secret", "request-id", "enc-key", nil)
+	}
+	if len(fake.calls) != 2 {
+		t.Errorf("calls = %v, want 2 before the breaker opened", fake.calls)
+	}
+	code, resp := errorResponseFor(err)
+	if code != http.StatusServiceUnavailable || resp.Code != ErrCodeCircuitOpen {
+		t.Errorf("errorResponseFor(%v) = %d %s, want 503 %s", err, code, resp.Code, ErrCodeCircuitOpen)
+	}
+}
+
+func TestReadinessReportsOpenCircuit(t *testing.T) {
+	myam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer myam.Close()
+	fake := &fakeSimServer{}
+	cfg := NewConfiguration("http://simserver.invalid", myam.URL)
+	cfg.SimServer = fake
+	cfg.SimServerBreaker, _ = newTestBreaker(1, 1)
+	callBreaker(t, cfg.SimServerBreaker, &UpstreamError{StatusCode: http.StatusServiceUnavailable})
+	cfg.MyAMBreaker, _ = newTestBreaker(1, 1)
+
+	result := newReadiness(cfg, "http://simserver.invalid", myam.URL, 0, time.Second).check(context.Background())
+	if result.Body.Status != "not_ready" {
+		t.Errorf("status = %s, want not_ready", result.Body.Status)
+	}
+	if dep := result.Body.Dependencies[DependencySimServer]; dep.Status != DependencyDown || dep.Circuit != CircuitOpen {
+		t.Errorf("simserver = %+v, want down with an open circuit", dep)
+	}
+	if dep := result.Body.Dependencies[DependencyMyAM]; dep.Status != DependencyUp || dep.Circuit != CircuitClosed {
+		t.Errorf("myam = %+v, want up with a closed circuit", dep)
+	}
+	if len(fake.calls) != 0 {
+		t.Errorf("simserver probed %d times while its circuit was open", len(fake.calls))
+	}
+}
+
+func TestCircuitBreakerCountsRetriedCallOnce(t *testing.T) {
+	fake := &sequenceSimServer{statuses: []int{503, 503, 503, 503, 503, 503, 503}}
+	cfg := NewConfiguration("http://simserver.invalid", "http://myam.invalid")
+	cfg.SimServer = fake
+	cfg.Retry = &RetryPolicies{Default: fastRetryPolicy(3)}
+	cfg.SimServerBreaker = NewCircuitBreaker(UpstreamSimServer, BreakerSettings{Failures: 2, Cooldown: time.Minute, Probes: 1}, nil)
+
+	SendRequestAndCheckResponse(context.Background(), cfg, requestObjectRequestMethod, "{}", http.StatusAccepted, nil)
+	if state := cfg.SimServerBreaker.State(); state != CircuitClosed || fake.calls != 3 {
+		t.Fatalf("after one call failing 3 attempts the breaker is %s with %d calls made, want closed after 3", state, fake.calls)
+	}
+	SendRequestAndCheckResponse(context.Background(), cfg, requestObjectRequestMethod, "{}", http.StatusAccepted, nil)
+	if state := cfg.SimServerBreaker.State(); state != CircuitOpen {
+		t.Fatalf("after two failed calls the breaker is %s, want open", state)
+	}
+	err := SendRequestAndCheckResponse(context.Background(), cfg, requestObjectRequestMethod, "{}", http.StatusAccepted, nil)
+	if !errors.Is(err, ErrCircuitOpen) || fake.calls != 6 {
+		t.Errorf("call while open = %v with %d calls made, want ErrCircuitOpen and no attempt", err, fake.calls)
+	}
+
+	// a call that succeeds on a retry counts as a success
+	fake = &sequenceSimServer{statuses: []int{503, 202, 503, 503, 503, 503, 503, 503}}
+	cfg.SimServer = fake
+	cfg.SimServerBreaker = NewCircuitBreaker(UpstreamSimServer, BreakerSettings{Failures: 2, Cooldown: time.Minute, Probes: 1}, nil)
+	for i := 0; i < 2; i++ {
+		SendRequestAndCheckResponse(context.Background(), cfg, requestObjectRequestMethod, "{}", http.StatusAccepted, nil)
+	}
+	if state := cfg.SimServerBreaker.State(); state != CircuitClosed {
+		t.Errorf("after a retried success and a failed call the breaker is %s, want closed", state)
+	}
+}
@@ -0,0 +1,574 @@
+package gmlserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CaptureHeader asks for a request's flows to be captured when capture.mode is request, CaptureIDHeader
+	// answers with the ID the capture is downloaded by
+	CaptureHeader   = "X-Capture"
+	CaptureIDHeader = "X-Capture-ID"
+
+	CaptureModeOff     = "off"
+	CaptureModeRequest = "request"
+	CaptureModeAll     = "all"
+
+	capturesPath      = "/v1/captures"
+	defaultCaptureTTL = time.Hour
+	defaultCaptureMax = 100
+	redacted          = "REDACTED"
+)
+
+// redactedHeaders carry credentials or MyAM sessions
+var redactedHeaders = map[string]bool{"Authorization": true, "Proxy-Authorization": true, "Cookie": true, "Set-Cookie": true}
+
+// redactedFields are the JSON fields, query and form parameters holding secrets, in lower case
+var redactedFields = map[string]bool{
+	"password": true, "accesstoken": true, "access_token": true, "idtoken": true, "id_token": true,
+	"refreshtoken": true, "refresh_token": true, "authcode": true, "code_verifier": true,
+}
+
+// redactedParams are the query and form parameters holding secrets besides redactedFields: code is the OIDC auth
+// code, while JSON fields called code are the simulator server's error codes
+var redactedParams = map[string]bool{"code": true}
+
+// redactedStateFields are the DLBstate fields holding keys, besides those named *privatekey, in lower case
+var redactedStateFields = map[string]bool{"pseudodevicekeymap": true, "lockboxenckey": true, "recoverykey": true}
+
+// The har types are the subset of HAR 1.2 GML writes, see http://www.softwareishard.com/blog/har-12-spec/
+type harDocument struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Comment string     `json:"comment,omitempty"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	// Upstream is simserver or myam
+	Upstream string `json:"_upstream"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// flowCapture records the upstream exchanges of the flows of one request
+type flowCapture struct {
+	id        string
+	requestID string
+	created   time.Time
+
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+func (c *flowCapture) add(entry harEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = append(c.entries, entry)
+}
+
+// har returns the exchanges recorded so far
+func (c *flowCapture) har() *harDocument {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	doc := &harDocument{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "gml", Version: "1.0.0"},
+		Comment: fmt.Sprintf("capture %s of request %s", c.id, c.requestID),
+		Entries: append([]harEntry{}, c.entries...),
+	}}
+	return doc
+}
+
+type captureKey struct{}
+
+// withCapture returns a context whose upstream calls are recorded in c, if c is not nil
+func withCapture(ctx context.Context, c *flowCapture) context.Context {
+	if c == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, captureKey{}, c)
+}
+
+func captureFrom(ctx context.Context) *flowCapture {
+	c, _ := ctx.Value(captureKey{}).(*flowCapture)
+	return c
+}
+
+// captureTransport records the exchanges of requests whose context carries a flowCapture, every hop of a
+// redirect included, and passes the others straight through
+type captureTransport struct {
+	upstream string
+	base     http.RoundTripper
+}
+
+func (t *captureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	capture := captureFrom(req.Context())
+	if capture == nil {
+		return t.base.RoundTrip(req)
+	}
+	var reqBody []byte
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			reqBody, _ = ioutil.ReadAll(body)
+			body.Close()
+		}
+	}
+	entry := harEntry{StartedDateTime: time.Now().UTC(), Upstream: t.upstream, Request: harRequestFor(req, reqBody)}
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	wait := time.Since(start)
+	if err != nil {
+		entry.Comment = "no response: " + err.Error()
+		entry.Time = milliseconds(wait)
+		entry.Timings = harTimings{Wait: entry.Time, Send: -1, Receive: -1}
+		capture.add(entry)
+		return resp, err
+	}
+	respBody, readErr := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if readErr != nil {
+		entry.Comment = "response body cut short: " + readErr.Error()
+		// hand the error on to the caller reading the body, as the transport would have
+		resp.Body = ioutil.NopCloser(&errorAfterReader{data: respBody, err: readErr})
+	} else {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	}
+	entry.Response = harResponseFor(resp, respBody)
+	entry.Time = milliseconds(time.Since(start))
+	entry.Timings = harTimings{Wait: milliseconds(wait), Receive: milliseconds(time.Since(start) - wait)}
+	capture.add(entry)
+	return resp, nil
+}
+
+// errorAfterReader returns data and then err
+type errorAfterReader struct {
+	data []byte
+	err  error
+}
+
+func (r *errorAfterReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func harRequestFor(req *http.Request, body []byte) harRequest {
+	u := *req.URL
+	query := u.Query()
+	redactValues(query)
+	u.RawQuery = query.Encode()
+	harReq := harRequest{
+		Method:      req.Method,
+		URL:         u.String(),
+		HTTPVersion: req.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(req.Header),
+		QueryString: harValues(query),
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+	if req.Host != "" {
+		harReq.Headers = append(harReq.Headers, harNameValue{Name: "Host", Value: req.Host})
+	}
+	if len(body) > 0 {
+		mimeType := req.Header.Get("Content-Type")
+		harReq.PostData = &harPostData{MimeType: mimeType, Text: redactBody(mimeType, body)}
+	}
+	return harReq
+}
+
+func harResponseFor(resp *http.Response, body []byte) harResponse {
+	mimeType := resp.Header.Get("Content-Type")
+	return harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(resp.Header),
+		Content:     harContent{Size: len(body), MimeType: mimeType, Text: redactResponseBody(resp.Header, body)},
+		RedirectURL: redactURL(resp.Header.Get("Location")),
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	list := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			list = append(list, harNameValue{Name: name, Value: redactHeaderValue(name, value)})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func harValues(values url.Values) []harNameValue {
+	list := []harNameValue{}
+	for name, vs := range values {
+		for _, value := range vs {
+			list = append(list, harNameValue{Name: name, Value: value})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// redactHeaderValue blanks credentials and MyAM sessions, and the secrets in the query of a redirect's Location
+func redactHeaderValue(name, value string) string {
+	switch name = http.CanonicalHeaderKey(name); {
+	case redactedHeaders[name]:
+		return redacted
+	case name == "Location":
+		return redactURL(value)
+	}
+	return value
+}
+
+// redactURL blanks the secrets in the query of rawURL, ie. the auth code MyAM redirects back with
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redacted
+	}
+	if u.RawQuery == "" {
+		return rawURL
+	}
+	query := u.Query()
+	redactValues(query)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func redactValues(values url.Values) {
+	for name := range values {
+		if lower := strings.ToLower(name); secretField(lower) || redactedParams[lower] {
+			for i := range values[name] {
+				values[name][i] = redacted
+			}
+		}
+	}
+}
+
+// redactResponseBody redacts a response body like redactBody, and blanks the whole body of a redirect whose Location
+// holds secrets since it repeats the link
+func redactResponseBody(header http.Header, body []byte) string {
+	if location := header.Get("Location"); len(body) > 0 && redactURL(location) != location {
+		return redacted
+	}
+	return redactBody(header.Get("Content-Type"), body)
+}
+
+// redactBody blanks the secrets of a JSON or form body, other bodies are returned as they are
+func redactBody(mimeType string, body []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(mimeType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return string(body)
+		}
+		redactValues(values)
+		return values.Encode()
+	case mediaType == "application/json" || json.Valid(body):
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return string(body)
+		}
+		out, err := json.Marshal(redactJSON(doc, secretField))
+		if err != nil {
+			return string(body)
+		}
+		return string(out)
+	}
+	return string(body)
+}
+
+// secretField reports whether a JSON field, query or form parameter holds a secret, name in lower case
+func secretField(name string) bool {
+	return redactedFields[name]
+}
+
+// secretStateField reports whether a DLBstate field holds a secret or a private key, name in lower case
+func secretStateField(name string) bool {
+	return redactedFields[name] || redactedStateFields[name] || strings.HasSuffix(name, "privatekey")
+}
+
+// redactJSON blanks the fields of doc that secret picks out, and the private keys of any serverState
+func redactJSON(doc interface{}, secret func(name string) bool) interface{} {
+	switch doc := doc.(type) {
+	case map[string]interface{}:
+		for name, value := range doc {
+			lower := strings.ToLower(name)
+			switch {
+			case secret(lower):
+				doc[name] = redactValue(value)
+			case lower == "serverstate":
+				if state, ok := value.(string); ok {
+					doc[name] = redactServerState(state)
+				}
+			default:
+				doc[name] = redactJSON(value, secret)
+			}
+		}
+	case []interface{}:
+		for i, value := range doc {
+			doc[i] = redactJSON(value, secret)
+		}
+	}
+	return doc
+}
+
+// redactValue blanks the strings of a secret value, keeping its shape so a redacted DLBstate still decodes,
+// ie. the keys of pseudoDeviceKeyMap
+func redactValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, v := range value {
+			value[name] = redactValue(v)
+		}
+		return value
+	case []interface{}:
+		for i, v := range value {
+			value[i] = redactValue(v)
+		}
+		return value
+	case string:
+		return redacted
+	}
+	return value
+}
+
+// redactServerState blanks the private keys of a base64url encoded DLBstate and encodes it again, a state
+// that cannot be decoded is blanked altogether
+func redactServerState(state string) string {
+	if state == "" {
+		return state
+	}
+	decoded, err := Base64URLDecode(state)
+	if err != nil {
+		return redacted
+	}
+	var doc interface{}
+	if err = json.Unmarshal(decoded, &doc); err != nil {
+		return redacted
+	}
+	encoded, err := json.Marshal(redactJSON(doc, secretStateField))
+	if err != nil {
+		return redacted
+	}
+	return Base64URLEncode(encoded)
+}
+
+// captureStore keeps the captures in memory until their ttl expires, dropping the oldest beyond max
+type captureStore struct {
+	mode string
+	ttl  time.Duration
+	max  int
+
+	mu       sync.Mutex
+	captures map[string]*flowCapture
+}
+
+func newCaptureStore(mode string, ttl time.Duration, max int) (*captureStore, error) {
+	switch mode {
+	case "":
+		mode = CaptureModeOff
+	case CaptureModeOff, CaptureModeRequest, CaptureModeAll:
+	default:
+		return nil, fmt.Errorf("invalid %s %q, want %s, %s or %s", CAPTURE_MODE, mode, CaptureModeOff, CaptureModeRequest, CaptureModeAll)
+	}
+	if ttl <= 0 {
+		ttl = defaultCaptureTTL
+	}
+	if max <= 0 {
+		max = defaultCaptureMax
+	}
+	return &captureStore{mode: mode, ttl: ttl, max: max, captures: make(map[string]*flowCapture)}, nil
+}
+
+// wanted reports whether the flows of r are to be captured
+func (s *captureStore) wanted(r *http.Request) bool {
+	switch s.mode {
+	case CaptureModeAll:
+		return true
+	case CaptureModeRequest:
+		capture, _ := strconv.ParseBool(r.Header.Get(CaptureHeader))
+		return capture
+	}
+	return false
+}
+
+// start stores a new capture, its exchanges can be downloaded as soon as they are recorded
+func (s *captureStore) start(requestID string) (*flowCapture, error) {
+	id, err := GenerateRandomString(16)
+	if err != nil {
+		return nil, err
+	}
+	capture := &flowCapture{id: id, requestID: requestID, created: time.Now()}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purge(capture.created)
+	s.captures[id] = capture
+	return capture, nil
+}
+
+func (s *captureStore) get(id string) (*flowCapture, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purge(time.Now())
+	capture, ok := s.captures[id]
+	return capture, ok
+}
+
+// purge drops the expired captures and the oldest ones beyond max-1, making room for one more, must be called with s.mu held
+func (s *captureStore) purge(now time.Time) {
+	var oldest []*flowCapture
+	for id, capture := range s.captures {
+		if now.Sub(capture.created) > s.ttl {
+			delete(s.captures, id)
+			continue
+		}
+		oldest = append(oldest, capture)
+	}
+	if excess := len(oldest) - s.max + 1; excess > 0 {
+		sort.Slice(oldest, func(i, j int) bool { return oldest[i].created.Before(oldest[j].created) })
+		for _, capture := range oldest[:excess] {
+			delete(s.captures, capture.id)
+		}
+	}
+}
+
+// captureFlows records the upstream exchanges of the license flows a POST to next starts, if capture.mode wants
+// them, and answers with the capture's ID in the X-Capture-ID header
+func (t *GmlServer) captureFlows(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !t.captures.wanted(r) {
+			next(w, r)
+			return
+		}
+		capture, err := t.captures.start(RequestIDFrom(r.Context()))
+		if err != nil {
+			t.logger().ErrorContext(r.Context(), "captureFlows: failed to start capture", "err", err)
+			next(w, r)
+			return
+		}
+		t.logger().InfoContext(r.Context(), "capturing upstream exchanges", "capture", capture.id)
+		w.Header().Set(CaptureIDHeader, capture.id)
+		next(w, r.WithContext(withCapture(r.Context(), capture)))
+	}
+}
+
+// capturesHandler serves GET /v1/captures/{id}
+//
+// swagger:route GET /v1/captures/{id} admin getCapture
+//
+// Download the upstream exchanges of a captured request as a HAR.
+//
+// Holds every simulator server and MyAM request and response of the request's license flows, redirects
+// included, recorded so far. Access tokens, passwords, cookies and the private keys in serverState are
+// redacted, so are the OIDC auth code and code verifier. Captures are kept for capture.ttl. Only for callers in
+// auth.admins once auth is enabled.
+//
+// responses:
+//
+//	200: captureResponse
+//	403: errorResponse
+//	404: errorResponse
+func (t *GmlServer) capturesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		t.writeError(w, http.StatusMethodNotAllowed, &ErrorResp{Code: ErrCodeMethodNotAllowed, Message: r.Method + " is not supported"})
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, capturesPath), "/")
+	capture, ok := t.captures.get(id)
+	if !ok {
+		t.writeError(w, http.StatusNotFound, &ErrorResp{Code: ErrCodeNotFound, Message: "no capture with id " + id})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+id+`.har"`)
+	t.writeResponse(w, capture.har(), http.StatusOK)
+}
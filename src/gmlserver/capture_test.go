@@ -0,0 +1,124 @@
+package gmlserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedactBody(t *testing.T) {
+	state := Base64URLEncode([]byte(`{"masterPrivateKey": "mpk", "pseudoDevicePrivateKey": "pdk", "clientId": "client",
+		"detailedRecoveryInfo": {"lockboxEncKey": "lek", "recoveryKey": "rk", "recoveryDataHash": "hash"},
+		"pseudoDeviceKeyMap": {"p1": "dk"}}`))
+	body := `{"createDigitalAssetBody": {"accessToken": "at", "serverState": "` + state + `", "assetTypes": ["fi"]}}`
+
+	var doc struct {
+		Body struct {
+			AccessToken string   `json:"accessToken"`
+			ServerState string   `json:"serverState"`
+			AssetTypes  []string `json:"assetTypes"`
+		} `json:"createDigitalAssetBody"`
+	}
+	if err := json.Unmarshal([]byte(redactBody("application/json; charset=UTF-8", []byte(body))), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Body.AccessToken != redacted || len(doc.Body.AssetTypes) != 1 {
+		t.Errorf("body = %+v, want the access token redacted and the asset types kept", doc.Body)
+	}
+	decoded, err := Base64URLDecode(doc.Body.ServerState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"mpk", "pdk", "lek", `"rk"`, "dk"} {
+		if strings.Contains(string(decoded), secret) {
+			t.Errorf("serverState %s still holds %s", decoded, secret)
+		}
+	}
+	for _, kept := range []string{"client", "hash"} {
+		if !strings.Contains(string(decoded), kept) {
+			t.Errorf("serverState %s lost %s", decoded, kept)
+		}
+	}
+
+	if got := redactBody("application/x-www-form-urlencoded", []byte("username=alice&password=secret")); got != "password=REDACTED&username=alice" {
+		t.Errorf("form body = %q", got)
+	}
+	// the auth code is a secret in forms, the code of a simulator server error is not
+	if got := redactBody("application/x-www-form-urlencoded", []byte("code=authcode&code_verifier=verifier")); got != "code=REDACTED&code_verifier=REDACTED" {
+		t.Errorf("form body = %q", got)
+	}
+	if got := redactBody("application/json", []byte(`{"code":"E42","authCode":"authcode"}`)); got != `{"authCode":"REDACTED","code":"E42"}` {
+		t.Errorf("JSON body = %q", got)
+	}
+}
+
+func TestRedactHeaderValue(t *testing.T) {
+	for _, tc := range []struct {
+		name, value, want string
+	}{
+		{"Authorization", "Bearer token", redacted},
+		{"location", "https://app.example/callback?code=authcode&state=s", "https://app.example/callback?code=REDACTED&state=s"},
+		{"Location", "/next", "/next"},
+		{"Content-Type", "text/html", "text/html"},
+	} {
+		if got := redactHeaderValue(tc.name, tc.value); got != tc.want {
+			t.Errorf("redactHeaderValue(%s, %q) = %q, want %q", tc.name, tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestCaptureDownload(t *testing.T) {
+	upstream := newAuthUpstream(t)
+	server := newTestServer(t, upstream, nil)
+	server.captures.mode = CaptureModeRequest
+
+	body := `{"username": "alice", "password": "secret", "requestID": "request-id", "requestEncKey": "enc-key"}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/licenses", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, req)
+	if id := rec.Header().Get(CaptureIDHeader); id != "" {
+		t.Fatalf("request without %s captured as %s", CaptureHeader, id)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/licenses", strings.NewReader(body))
+	req.Header.Set(CaptureHeader, "true")
+	rec = httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, req)
+	id := rec.Header().Get(CaptureIDHeader)
+	if id == "" {
+		t.Fatalf("no %s answered", CaptureIDHeader)
+	}
+
+	rec = httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, capturesPath+"/"+id, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET capture = %d: %s", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "secret") || strings.Contains(rec.Body.String(), "authcode") {
+		t.Errorf("capture holds the password or the auth code: %s", rec.Body)
+	}
+	var har harDocument
+	if err := json.Unmarshal(rec.Body.Bytes(), &har); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, entry := range har.Log.Entries {
+		paths = append(paths, entry.Request.URL[len(upstream.URL):])
+		if strings.HasSuffix(entry.Request.URL, "/consent") && entry.Response.RedirectURL != "/callback?code=REDACTED" {
+			t.Errorf("consent redirect = %q", entry.Response.RedirectURL)
+		}
+	}
+	want := []string{"/requestobject", "/myam/oidc/authorize?client_id=myClientID", "/myam/oidc/authenticate", "/myam/oidc/login",
+		"/myam/oidc/consent", "/accesstoken"}
+	if strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Errorf("captured %v, want %v", paths, want)
+	}
+
+	rec = httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, capturesPath+"/unknown", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET unknown capture = %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,348 @@
+package gmlserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// CassetteRecord saves every upstream exchange to the cassette, CassetteReplay answers every upstream call
+	// from it without touching the network
+	CassetteRecord = "record"
+	CassetteReplay = "replay"
+
+	cassetteVersion = 1
+)
+
+// CassetteMatch says which parts of a request must be equal for a recorded exchange to answer it
+type CassetteMatch struct {
+	// Ignore are the JSON fields, query and form parameters left out of the comparison, at any depth
+	Ignore []string `mapstructure:"ignore"`
+	// Body compares request bodies, false matches on the method, path and query alone
+	Body bool `mapstructure:"body"`
+}
+
+// DefaultCassetteMatch compares bodies, ignoring the PKCE values and the tokens and state that change every run
+func DefaultCassetteMatch() CassetteMatch {
+	return CassetteMatch{Ignore: []string{"code_challenge", "code_verifier", "accessToken", "serverState"}, Body: true}
+}
+
+// cassetteFile is the file format, secrets are redacted as in captures
+type cassetteFile struct {
+	Version      int                   `json:"version"`
+	RecordedAt   time.Time             `json:"recordedAt"`
+	Interactions []cassetteInteraction `json:"interactions"`
+}
+
+type cassetteInteraction struct {
+	// Environment is the environment whose upstreams answered, empty in cassettes recorded before environments
+	// were told apart stands for DefaultEnvironment
+	Environment string `json:"environment,omitempty"`
+	// Upstream is simserver or myam
+	Upstream string           `json:"upstream"`
+	Request  cassetteRequest  `json:"request"`
+	Response cassetteResponse `json:"response"`
+}
+
+type cassetteRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+}
+
+type cassetteResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+}
+
+// Cassette records the simulator server and MyAM exchanges of a run to a file, or replays them from it so
+// license flows run without network access
+type Cassette struct {
+	path   string
+	mode   string
+	match  CassetteMatch
+	ignore map[string]bool
+
+	mu   sync.Mutex
+	file cassetteFile
+	// played counts the replays of each match key, the recorded exchanges of a key are replayed in order and
+	// the last one again once they have all been
+	played map[string]int
+	byKey  map[string][]int
+}
+
+// NewCassette returns an empty cassette recording to path, which is written after every exchange
+func NewCassette(path string, match CassetteMatch) *Cassette {
+	c := newCassette(path, CassetteRecord, match)
+	c.file.RecordedAt = time.Now().UTC()
+	return c
+}
+
+// OpenCassette reads the cassette at path for replay
+func OpenCassette(path string, match CassetteMatch) (*Cassette, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cassette: %w", err)
+	}
+	c := newCassette(path, CassetteReplay, match)
+	if err = json.Unmarshal(data, &c.file); err != nil {
+		return nil, fmt.Errorf("cassette %s is corrupt: %v", path, err)
+	}
+	if c.file.Version != cassetteVersion {
+		return nil, fmt.Errorf("cassette %s has version %d, want %d", path, c.file.Version, cassetteVersion)
+	}
+	for i, interaction := range c.file.Interactions {
+		key := c.key(interaction.Environment, interaction.Upstream, interaction.Request.Method, interaction.Request.URL,
+			interaction.Request.Body)
+		c.byKey[key] = append(c.byKey[key], i)
+	}
+	return c, nil
+}
+
+func newCassette(path, mode string, match CassetteMatch) *Cassette {
+	c := &Cassette{path: path, mode: mode, match: match, ignore: make(map[string]bool),
+		file: cassetteFile{Version: cassetteVersion}, played: make(map[string]int), byKey: make(map[string][]int)}
+	for _, name := range match.Ignore {
+		c.ignore[strings.ToLower(name)] = true
+	}
+	return c
+}
+
+// Apply sends the simulator server and MyAM calls of cfg through the cassette as those of DefaultEnvironment. A
+// SimServer other than an *HTTPSimServerClient is left alone.
+func (c *Cassette) Apply(cfg *Configuration) {
+	c.ApplyEnvironment(DefaultEnvironment, cfg)
+}
+
+// ApplyEnvironment sends the simulator server and MyAM calls of cfg through the cassette as those of environment,
+// which are only ever replayed for the same environment
+func (c *Cassette) ApplyEnvironment(environment string, cfg *Configuration) {
+	roundTripper := func(upstream string, base http.RoundTripper) http.RoundTripper {
+		return &cassetteTransport{cassette: c, environment: environment, upstream: upstream, base: base}
+	}
+	if simServer, ok := cfg.SimServer.(*HTTPSimServerClient); ok {
+		simServer.Client = wrapTransport(simServer.Client, UpstreamSimServer, roundTripper)
+	}
+	cfg.MyAMClient = wrapTransport(cfg.MyAMClient, UpstreamMyAM, roundTripper)
+}
+
+// RoundTripper returns a transport recording the exchanges of upstream sent through base, or replaying them, as
+// those of DefaultEnvironment
+func (c *Cassette) RoundTripper(upstream string, base http.RoundTripper) http.RoundTripper {
+	return &cassetteTransport{cassette: c, environment: DefaultEnvironment, upstream: upstream, base: base}
+}
+
+type cassetteTransport struct {
+	cassette    *Cassette
+	environment string
+	upstream    string
+	base        http.RoundTripper
+}
+
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.GetBody != nil {
+		if reqBody, err := req.GetBody(); err == nil {
+			body, _ = ioutil.ReadAll(reqBody)
+			reqBody.Close()
+		}
+	}
+	if t.cassette.mode == CassetteReplay {
+		return t.cassette.replay(t.environment, t.upstream, req, body)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	if err = t.cassette.record(t.environment, t.upstream, req, body, resp, respBody); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Cassette) record(environment, upstream string, req *http.Request, body []byte, resp *http.Response, respBody []byte) error {
+	u := *req.URL
+	query := u.Query()
+	redactValues(query)
+	u.RawQuery = query.Encode()
+	interaction := cassetteInteraction{
+		Environment: environment,
+		Upstream:    upstream,
+		Request: cassetteRequest{Method: req.Method, URL: u.String(), Header: redactHeader(req.Header),
+			Body: redactBody(req.Header.Get("Content-Type"), body)},
+		Response: cassetteResponse{Status: resp.StatusCode, Header: redactHeader(resp.Header),
+			Body: redactResponseBody(resp.Header, respBody)},
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.file.Interactions = append(c.file.Interactions, interaction)
+	data, err := json.MarshalIndent(&c.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(c.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save cassette: %v", err)
+	}
+	return nil
+}
+
+func (c *Cassette) replay(environment, upstream string, req *http.Request, body []byte) (*http.Response, error) {
+	key := c.key(environment, upstream, req.Method, req.URL.String(), redactBody(req.Header.Get("Content-Type"), body))
+
+	c.mu.Lock()
+	indexes := c.byKey[key]
+	if len(indexes) == 0 {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("cassette %s has no %s exchange of environment %s matching %s %s", c.path, upstream, environment,
+			req.Method, req.URL.Path)
+	}
+	played := c.played[key]
+	c.played[key]++
+	c.mu.Unlock()
+	if played >= len(indexes) {
+		played = len(indexes) - 1
+	}
+
+	recorded := c.file.Interactions[indexes[played]].Response
+	header := recorded.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.Status, http.StatusText(recorded.Status)),
+		StatusCode:    recorded.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(recorded.Body)),
+		ContentLength: int64(len(recorded.Body)),
+		Request:       req,
+	}, nil
+}
+
+// key is what two requests must share to match: the environment, upstream, method, path, query and, unless the
+// match leaves it out, the body, all without the ignored fields. The host is left out, so a cassette recorded
+// against one simulator server replays for another standing in for the same environment.
+func (c *Cassette) key(environment, upstream, method, rawURL, body string) string {
+	if environment == "" {
+		environment = DefaultEnvironment
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return environment + " " + upstream + " " + method + " " + rawURL
+	}
+	query := u.Query()
+	c.dropIgnored(query)
+	key := environment + " " + upstream + " " + method + " " + u.Path + "?" + query.Encode()
+	if c.match.Body {
+		key += "\n" + c.normalizeBody(body)
+	}
+	return key
+}
+
+func (c *Cassette) dropIgnored(values url.Values) {
+	for name := range values {
+		if c.ignore[strings.ToLower(name)] {
+			delete(values, name)
+		}
+	}
+}
+
+// normalizeBody drops the ignored fields of a JSON or form body and writes it in a canonical form
+func (c *Cassette) normalizeBody(body string) string {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(body), &doc); err == nil {
+		normalized, err := json.Marshal(c.dropIgnoredJSON(doc))
+		if err == nil {
+			return string(normalized)
+		}
+	}
+	if values, err := url.ParseQuery(body); err == nil && strings.Contains(body, "=") {
+		c.dropIgnored(values)
+		return values.Encode()
+	}
+	return body
+}
+
+func (c *Cassette) dropIgnoredJSON(doc interface{}) interface{} {
+	switch doc := doc.(type) {
+	case map[string]interface{}:
+		for name, value := range doc {
+			if c.ignore[strings.ToLower(name)] {
+				delete(doc, name)
+				continue
+			}
+			doc[name] = c.dropIgnoredJSON(value)
+		}
+	case []interface{}:
+		for i, value := range doc {
+			doc[i] = c.dropIgnoredJSON(value)
+		}
+	}
+	return doc
+}
+
+// redactHeader copies header, blanking credentials, MyAM sessions and the secrets of a redirect's Location
+func redactHeader(header http.Header) http.Header {
+	if len(header) == 0 {
+		return nil
+	}
+	copied := header.Clone()
+	for name, values := range copied {
+		if redactedHeaders[http.CanonicalHeaderKey(name)] {
+			copied[name] = []string{redacted}
+			continue
+		}
+		for i, value := range values {
+			values[i] = redactHeaderValue(name, value)
+		}
+		if len(copied[name]) == 0 {
+			delete(copied, name)
+		}
+	}
+	return copied
+}
+
+// loadCassette opens or starts the cassette of cassette.mode, nil if it is off
+func loadCassette(v *viper.Viper) (*Cassette, error) {
+	mode := v.GetString(CASSETTE_MODE)
+	if mode == "" || mode == "off" {
+		return nil, nil
+	}
+	path := v.GetString(CASSETTE_FILE)
+	if path == "" {
+		return nil, fmt.Errorf("%s %s needs %s", CASSETTE_MODE, mode, CASSETTE_FILE)
+	}
+	match := DefaultCassetteMatch()
+	if err := v.UnmarshalKey(CASSETTE_MATCH, &match); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", CASSETTE_MATCH, err)
+	}
+	switch mode {
+	case CassetteRecord:
+		return NewCassette(path, match), nil
+	case CassetteReplay:
+		return OpenCassette(path, match)
+	}
+	return nil, fmt.Errorf("invalid %s %q, want off, %s or %s", CASSETTE_MODE, mode, CassetteRecord, CassetteReplay)
+}
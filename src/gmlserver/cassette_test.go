@@ -0,0 +1,130 @@
+package gmlserver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestCassetteKey(t *testing.T) {
+	c := newCassette("cassette.json", CassetteReplay, DefaultCassetteMatch())
+	for _, tc := range []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"volatile fields", `{"code_challenge": "abc", "requestID": "r"}`, `{"requestID": "r", "code_challenge": "xyz"}`, true},
+		{"nested", `{"body": {"accessToken": "a", "serverState": "s1", "assetTypes": ["fi"]}}`,
+			`{"body": {"accessToken": "b", "serverState": "s2", "assetTypes": ["fi"]}}`, true},
+		{"other fields", `{"requestID": "r1"}`, `{"requestID": "r2"}`, false},
+		{"form", "username=alice&code_verifier=1", "code_verifier=2&username=alice", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := c.key(DefaultEnvironment, UpstreamSimServer, http.MethodPost, "http://a.example/requestobject", tc.a)
+			b := c.key(DefaultEnvironment, UpstreamSimServer, http.MethodPost, "http://b.example/requestobject", tc.b)
+			if (a == b) != tc.same {
+				t.Errorf("key %q and %q equal %v, want %v", a, b, a == b, tc.same)
+			}
+		})
+	}
+
+	// the same call to two environments is two exchanges, an interaction recorded without one is the default's
+	if c.key("staging", UpstreamMyAM, http.MethodGet, "/authorize", "") == c.key("prod", UpstreamMyAM, http.MethodGet, "/authorize", "") {
+		t.Error("calls to different environments share a key")
+	}
+	if c.key("", UpstreamMyAM, http.MethodGet, "/authorize", "") != c.key(DefaultEnvironment, UpstreamMyAM, http.MethodGet, "/authorize", "") {
+		t.Error("an interaction without an environment does not replay for the default one")
+	}
+
+	c = newCassette("cassette.json", CassetteReplay, CassetteMatch{})
+	if c.key(DefaultEnvironment, UpstreamMyAM, http.MethodGet, "/authorize", "a") != c.key(DefaultEnvironment, UpstreamMyAM, http.MethodGet, "/authorize", "b") {
+		t.Error("bodies compared without match.body")
+	}
+}
+
+func TestCassetteRecordReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	upstream := newAuthUpstream(t)
+
+	cfg := NewConfiguration(upstream.URL, upstream.URL)
+	NewCassette(path, DefaultCassetteMatch()).Apply(cfg)
+	_, recordErr := getLicenseForDA(context.Background(), cfg, "alice", "secret", "request-id", "enc-key", nil)
+	if recordErr == nil {
+		t.Fatal("recorded flow succeeded, want the accesstoken failure of the upstream")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Errorf("cassette holds the password: %s", data)
+	}
+	upstream.Close()
+
+	cassette, err := OpenCassette(path, DefaultCassetteMatch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = NewConfiguration(upstream.URL, upstream.URL)
+	cassette.Apply(cfg)
+	_, err = getLicenseForDA(context.Background(), cfg, "alice", "secret", "request-id", "enc-key", nil)
+	var upstreamErr *UpstreamError
+	if !errors.As(err, &upstreamErr) || upstreamErr.Method != accessTokenRequestMethod || upstreamErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("replayed flow error = %v, want the recorded %v", err, recordErr)
+	}
+
+	_, err = getLicenseForDA(context.Background(), cfg, "bob", "secret", "request-id", "enc-key", nil)
+	if err == nil || !strings.Contains(err.Error(), "no myam exchange of environment default matching") {
+		t.Errorf("flow of an unrecorded user error = %v, want no matching exchange", err)
+	}
+
+	// the exchanges of the default environment do not answer the same calls to another
+	cfg = NewConfiguration(upstream.URL, upstream.URL)
+	cassette.ApplyEnvironment("staging", cfg)
+	_, err = getLicenseForDA(context.Background(), cfg, "alice", "secret", "request-id", "enc-key", nil)
+	if err == nil || !strings.Contains(err.Error(), "no simserver exchange of environment staging matching") {
+		t.Errorf("flow of another environment error = %v, want no matching exchange", err)
+	}
+}
+
+func TestReadinessBypassesCassette(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	upstream := newAuthUpstream(t)
+	v := viper.New()
+	v.Set(SIMSERVER_URL, upstream.URL)
+	v.Set(MYAM_URL, upstream.URL)
+	shared := &Configuration{Logger: quietLogger}
+
+	recording := NewCassette(path, DefaultCassetteMatch())
+	env, err := newEnvironment(DefaultEnvironment, v, shared, nil, recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := env.readiness.check(context.Background()); result.Body.Status != "ready" {
+		t.Fatalf("status while recording = %s: %+v", result.Body.Status, result.Body.Dependencies)
+	}
+	if _, err = ioutil.ReadFile(path); err == nil {
+		t.Error("the readiness probes were recorded")
+	}
+	getLicenseForDA(context.Background(), env.config, "alice", "secret", "request-id", "enc-key", nil)
+	upstream.Close()
+
+	// replaying needs no upstream, so there is nothing to be down
+	replaying, err := OpenCassette(path, DefaultCassetteMatch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err = newEnvironment(DefaultEnvironment, v, shared, nil, replaying)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := env.readiness.check(context.Background()); result.Body.Status != "ready" {
+		t.Errorf("status while replaying = %s: %+v", result.Body.Status, result.Body.Dependencies)
+	}
+}
@@ -1,17 +1,18 @@
 package gmlserver
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 )
 
 // retrieveCurrentTerms returns the ServerState with current terms and conditions updated
-func RetrieveCurrentTerms(accessToken string) (string, error) {
+func RetrieveCurrentTerms(ctx context.Context, cfg *Configuration, accessToken string) (string, error) {
 	payload := new(RetrieveCurrentTermsReq)
 	payload.Body.RetrieveCurrentTermsBody = &RetrieveCurrentTermsReqBody{
 		AccessToken: accessToken,
-		Endpoint:    Config.MyBankBaseURL,
+		Endpoint:    cfg.MyBankBaseURL,
 		Locale:      "en-CA",
 	}
 
@@ -22,27 +23,27 @@ func RetrieveCurrentTerms(accessToken string) (string, error) {
 
 	// this checks expected status
 	result := new(RetrieveCurrentTermsResp)
-	err = SendRequestAndCheckResponse(RequestMethodRetrieveCurrentTerms, payloadBytes, http.StatusAccepted, &result.Body)
+	err = SendRequestAndCheckResponse(ctx, cfg, RequestMethodRetrieveCurrentTerms, payloadBytes, http.StatusAccepted, &result.Body)
 	if err != nil {
-		return "", fmt.Errorf("retrieveCurrentTerms: error when SendRequestToSimServer:: %v", err)
+		return "", fmt.Errorf("retrieveCurrentTerms: error when SendRequestToSimServer:: %w", err)
 	}
 
 	return result.Body.ServerState, nil
 }
 
 // CreateLockboxWithOptionalRecoveryData ...
-func CreateLockboxWithOptionalRecoveryData(accessToken string, withRecoveryData bool) (serverState string, err error) {
+func CreateLockboxWithOptionalRecoveryData(ctx context.Context, cfg *Configuration, accessToken string, withRecoveryData bool) (serverState string, err error) {
 	if accessToken == "" {
 		return "", fmt.Errorf("CreateLockboxWithOptionalRecoveryData -> cannot create Lockbox, must call getAuthToken first")
 	}
 
-	state, err := RetrieveCurrentTerms(accessToken)
+	state, err := RetrieveCurrentTerms(ctx, cfg, accessToken)
 	if err != nil {
-		return "", fmt.Errorf("CreateLockboxWithOptionalRecoveryData->RetrieveCurrentTerms: %v", err)
+		return "", fmt.Errorf("CreateLockboxWithOptionalRecoveryData->RetrieveCurrentTerms: %w", err)
 	}
 	payload := &CreateLockboxReqBody{
 		AccessToken:             accessToken,
-		Endpoint:                Config.MyBankBaseURL,
+		Endpoint:                cfg.MyBankBaseURL,
 		ServerState:             state,
 		DoNotCreateRecoveryData: !withRecoveryData,
 	}
@@ -51,8 +52,8 @@ func CreateLockboxWithOptionalRecoveryData(accessToken string, withRecoveryData
 	postbody.Body.CreateLockBoxbody = payload
 
 	expected := new(CreateLockboxResp)
-	if err = SendRequestAndCheckResponse(EndpointCreateLockbox, postbody.Body, http.StatusAccepted, &expected.Body); err != nil {
-		return "", fmt.Errorf("CreateLockboxWithOptionalRecoveryData: error calling simulator server :: %#v", err)
+	if err = SendRequestAndCheckResponse(ctx, cfg, EndpointCreateLockbox, postbody.Body, http.StatusAccepted, &expected.Body); err != nil {
+		return "", fmt.Errorf("CreateLockboxWithOptionalRecoveryData: error calling simulator server :: %w", err)
 	}
 	if (CreateLockboxResp{}) == *expected {
 		return "", fmt.Errorf("CreateLockboxWithOptionalRecoveryData: error calling simulator server :: the response is zero value")
@@ -1,6 +1,7 @@
 package gmlserver
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -19,7 +20,7 @@ func decodeSimState(b64state string) (*DLBstate, error) {
 	return statestruct, nil
 }
 
-func CreateDA(accessToken string, state string, assetTypes []string) (string, map[string]CreateDigitalAssetRespBody, error) {
+func CreateDA(ctx context.Context, cfg *Configuration, accessToken string, state string, assetTypes []string) (string, map[string]CreateDigitalAssetRespBody, error) {
 	if accessToken == "" || state == "" {
 		return "", nil, fmt.Errorf("createDA -> cannot create DA, must call createLockbox first")
 	}
@@ -49,17 +50,17 @@ func CreateDA(accessToken string, state string, assetTypes []string) (string, ma
 	*/
 	payload := &CreateDigitalAssetReqBody{
 		AccessToken: accessToken,
-		Endpoint:    Config.MyBankBaseURL,
+		Endpoint:    cfg.MyBankBaseURL,
 		AssetTypes:  assetTypes,
 		ServerState: state,
 	}
-	myLogger.Printf("Sending CreateDA, endpoint: %s, channelCode: %v\n", payload.Endpoint, payload.ChannelCode)
+	cfg.logger().DebugContext(ctx, "Sending CreateDA", "endpoint", payload.Endpoint, "channelCode", payload.ChannelCode)
 
 	var postbody = new(CreateDigitalAssetReq)
 	postbody.Body.CreateDigitalAssetBody = payload
 	expected := new(CreateDigitalAssetResp)
-	if err := SendRequestAndCheckResponse(EndpointCreateDigitalAsset, postbody.Body, http.StatusAccepted, &expected.Body); err != nil {
-		return "", nil, fmt.Errorf("sending of createDA request failed to %s", err)
+	if err := SendRequestAndCheckResponse(ctx, cfg, EndpointCreateDigitalAsset, postbody.Body, http.StatusAccepted, &expected.Body); err != nil {
+		return "", nil, fmt.Errorf("sending of createDA request failed to %w", err)
 	}
 
 	if len(expected.Body.CreateDigitalAssetBody) != len(assetTypes) {
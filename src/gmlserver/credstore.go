@@ -0,0 +1,298 @@
+package gmlserver
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	credentialStoreVersion = 1
+
+	// kdfPBKDF2 stretches a passphrase, kdfKeyFile hashes the contents of a key file
+	kdfPBKDF2  = "pbkdf2-sha256"
+	kdfKeyFile = "keyfile"
+
+	pbkdf2Iterations = 600000
+	minKeyFileSize   = 32
+)
+
+// ErrNoPassword is returned by getLicenseForDA for a request without a password whose user is not in the credential store
+var ErrNoPassword = errors.New("no password given and none stored")
+
+// CredentialStoreKey seals a credential store, either a passphrase or the contents of a key file
+type CredentialStoreKey struct {
+	kdf    string
+	secret []byte
+}
+
+// PassphraseKey returns the key of a store sealed with a passphrase
+func PassphraseKey(passphrase string) CredentialStoreKey {
+	return CredentialStoreKey{kdf: kdfPBKDF2, secret: []byte(passphrase)}
+}
+
+// ReadPassphraseFile returns the key of a store sealed with the passphrase held in a file, less any trailing newline
+func ReadPassphraseFile(passphraseFile string) (CredentialStoreKey, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(passphraseFile))
+	if err != nil {
+		return CredentialStoreKey{}, fmt.Errorf("failed to read passphrase file %s: %v", passphraseFile, err)
+	}
+	return PassphraseKey(strings.TrimRight(string(data), "\r\n")), nil
+}
+
+// ReadKeyFile returns the key of a store sealed with the contents of a key file, ie. 32 random bytes
+func ReadKeyFile(keyFile string) (CredentialStoreKey, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(keyFile))
+	if err != nil {
+		return CredentialStoreKey{}, fmt.Errorf("failed to read key file %s: %v", keyFile, err)
+	}
+	if len(data) < minKeyFileSize {
+		return CredentialStoreKey{}, fmt.Errorf("key file %s holds %d bytes, want at least %d", keyFile, len(data), minKeyFileSize)
+	}
+	return CredentialStoreKey{kdf: kdfKeyFile, secret: data}, nil
+}
+
+func (k CredentialStoreKey) derive(salt []byte) ([]byte, error) {
+	switch k.kdf {
+	case kdfPBKDF2:
+		if len(k.secret) == 0 {
+			return nil, fmt.Errorf("empty passphrase")
+		}
+		return pbkdf2.Key(sha256.New, string(k.secret), salt, pbkdf2Iterations, 32)
+	case kdfKeyFile:
+		sum := sha256.Sum256(append(append([]byte{}, salt...), k.secret...))
+		return sum[:], nil
+	default:
+		return nil, fmt.Errorf("no passphrase or key file given")
+	}
+}
+
+// StoredCredential is an entry of a credential store, without its password
+type StoredCredential struct {
+	Username  string    `json:"username"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type storedPassword struct {
+	StoredCredential
+	Password string `json:"password"`
+}
+
+// sealedStore is the file format: the header is authenticated along with the encrypted credentials
+type sealedStore struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+}
+
+func (s *sealedStore) additionalData() []byte {
+	header := *s
+	header.Nonce, header.Ciphertext = nil, nil
+	data, _ := json.Marshal(header)
+	return data
+}
+
+// CredentialStore holds MyAM test credentials encrypted on disk with AES-256-GCM.
+// A nil *CredentialStore holds no credentials.
+type CredentialStore struct {
+	path  string
+	key   CredentialStoreKey
+	creds map[string]storedPassword
+}
+
+// NewCredentialStore returns an empty store that Save writes to path
+func NewCredentialStore(path string, key CredentialStoreKey) *CredentialStore {
+	return &CredentialStore{path: path, key: key, creds: make(map[string]storedPassword)}
+}
+
+// OpenCredentialStore reads and decrypts the store at path
+func OpenCredentialStore(path string, key CredentialStoreKey) (*CredentialStore, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credential store: %w", err)
+	}
+	sealed := new(sealedStore)
+	if err = json.Unmarshal(data, sealed); err != nil {
+		return nil, fmt.Errorf("credential store %s is corrupt: %v", path, err)
+	}
+	if sealed.Version != credentialStoreVersion {
+		return nil, fmt.Errorf("credential store %s has version %d, want %d", path, sealed.Version, credentialStoreVersion)
+	}
+	if sealed.KDF != key.kdf {
+		return nil, fmt.Errorf("credential store %s is sealed with a %s, not a %s", path, describeKDF(sealed.KDF), describeKDF(key.kdf))
+	}
+	aead, err := newStoreAEAD(key, sealed.Salt)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, sealed.Nonce, sealed.Ciphertext, sealed.additionalData())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt credential store %s, wrong %s?", path, describeKDF(key.kdf))
+	}
+	var entries []storedPassword
+	if err = json.Unmarshal(plaintext, &entries); err != nil {
+		return nil, fmt.Errorf("credential store %s is corrupt: %v", path, err)
+	}
+	store := NewCredentialStore(path, key)
+	for _, entry := range entries {
+		store.creds[entry.Username] = entry
+	}
+	return store, nil
+}
+
+func describeKDF(kdf string) string {
+	if kdf == kdfKeyFile {
+		return "key file"
+	}
+	return "passphrase"
+}
+
+func newStoreAEAD(key CredentialStoreKey, salt []byte) (cipher.AEAD, error) {
+	derived, err := key.derive(salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Password returns the stored password of username
+func (s *CredentialStore) Password(username string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	entry, ok := s.creds[username]
+	return entry.Password, ok
+}
+
+// List returns the stored usernames in order
+func (s *CredentialStore) List() []StoredCredential {
+	if s == nil {
+		return nil
+	}
+	list := make([]StoredCredential, 0, len(s.creds))
+	for _, entry := range s.creds {
+		list = append(list, entry.StoredCredential)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list
+}
+
+// Set stores the password of username, reporting whether it replaced one
+func (s *CredentialStore) Set(username, password string) bool {
+	_, replaced := s.creds[username]
+	s.creds[username] = storedPassword{StoredCredential{Username: username, UpdatedAt: time.Now().UTC()}, password}
+	return replaced
+}
+
+// Remove deletes username, reporting whether it was stored
+func (s *CredentialStore) Remove(username string) bool {
+	_, ok := s.creds[username]
+	delete(s.creds, username)
+	return ok
+}
+
+// Rekey seals the store with key from the next Save on
+func (s *CredentialStore) Rekey(key CredentialStoreKey) {
+	s.key = key
+}
+
+// Save encrypts the store with a fresh salt and nonce and replaces the file, readable by its owner only
+func (s *CredentialStore) Save() error {
+	entries := make([]storedPassword, 0, len(s.creds))
+	for _, entry := range s.creds {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Username < entries[j].Username })
+	plaintext, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	sealed := &sealedStore{Version: credentialStoreVersion, KDF: s.key.kdf, Salt: make([]byte, 16)}
+	if _, err = rand.Read(sealed.Salt); err != nil {
+		return err
+	}
+	aead, err := newStoreAEAD(s.key, sealed.Salt)
+	if err != nil {
+		return err
+	}
+	sealed.Nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(sealed.Nonce); err != nil {
+		return err
+	}
+	sealed.Ciphertext = aead.Seal(nil, sealed.Nonce, plaintext, sealed.additionalData())
+	data, err := json.MarshalIndent(sealed, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = writeFileAtomic(s.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save credential store: %v", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data next to path and renames it over path, so a failed write never leaves a truncated
+// file behind
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	return err
+}
+
+// openConfiguredCredentialStore opens credentials.store.file, if set, with its key file or passphrase
+func openConfiguredCredentialStore(v *viper.Viper) (*CredentialStore, error) {
+	path := v.GetString(CREDENTIALS_STORE_FILE)
+	if path == "" {
+		return nil, nil
+	}
+	var key CredentialStoreKey
+	var err error
+	switch {
+	case v.GetString(CREDENTIALS_STORE_KEY_FILE) != "":
+		key, err = ReadKeyFile(v.GetString(CREDENTIALS_STORE_KEY_FILE))
+	case v.GetString(CREDENTIALS_STORE_PASSPHRASE_FILE) != "":
+		key, err = ReadPassphraseFile(v.GetString(CREDENTIALS_STORE_PASSPHRASE_FILE))
+	case v.GetString(CREDENTIALS_STORE_PASSPHRASE) != "":
+		key = PassphraseKey(v.GetString(CREDENTIALS_STORE_PASSPHRASE))
+	default:
+		return nil, fmt.Errorf("%s needs %s, %s or %s", CREDENTIALS_STORE_FILE, CREDENTIALS_STORE_KEY_FILE,
+			CREDENTIALS_STORE_PASSPHRASE_FILE, CREDENTIALS_STORE_PASSPHRASE)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return OpenCredentialStore(path, key)
+}
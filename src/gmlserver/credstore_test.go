@@ -0,0 +1,167 @@
+package gmlserver
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKeyFile writes size random bytes to a key file in dir
+func writeKeyFile(t *testing.T, dir, name string, size int) string {
+	t.Helper()
+	secret := make([]byte, size)
+	rand.Read(secret)
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, secret, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func readKeyFile(t *testing.T, file string) CredentialStoreKey {
+	t.Helper()
+	key, err := ReadKeyFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestCredentialStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name string
+		key  CredentialStoreKey
+	}{
+		{"key file", readKeyFile(t, writeKeyFile(t, dir, "store.key", minKeyFileSize))},
+		{"passphrase", PassphraseKey("correct horse battery staple")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.name+".json")
+			store := NewCredentialStore(path, tc.key)
+			store.Set("bob", "bob-password")
+			store.Set("alice", "alice-password")
+			if err := store.Save(); err != nil {
+				t.Fatal(err)
+			}
+			if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+				t.Errorf("store file = %v, %v, want mode 0600", info, err)
+			}
+			if data, _ := os.ReadFile(path); strings.Contains(string(data), "alice-password") {
+				t.Errorf("store file holds a password in the clear: %s", data)
+			}
+
+			opened, err := OpenCredentialStore(path, tc.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, username := range []string{"alice", "bob"} {
+				if password, ok := opened.Password(username); !ok || password != username+"-password" {
+					t.Errorf("Password(%s) = %q, %v, want %s-password", username, password, ok, username)
+				}
+			}
+			if list := opened.List(); len(list) != 2 || list[0].Username != "alice" || list[1].Username != "bob" {
+				t.Errorf("List = %+v, want alice then bob", list)
+			}
+		})
+	}
+}
+
+func TestCredentialStoreWrongKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFileStore := filepath.Join(dir, "keyfile.json")
+	store := NewCredentialStore(keyFileStore, readKeyFile(t, writeKeyFile(t, dir, "store.key", minKeyFileSize)))
+	store.Set("alice", "secret")
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+	passphraseStore := filepath.Join(dir, "passphrase.json")
+	store = NewCredentialStore(passphraseStore, PassphraseKey("right passphrase"))
+	store.Set("alice", "secret")
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		path string
+		key  CredentialStoreKey
+		err  string
+	}{
+		{"other key file", keyFileStore, readKeyFile(t, writeKeyFile(t, dir, "other.key", minKeyFileSize)), "wrong key file"},
+		{"wrong passphrase", passphraseStore, PassphraseKey("wrong passphrase"), "wrong passphrase"},
+		{"passphrase for a key file store", keyFileStore, PassphraseKey("right passphrase"), "sealed with a key file, not a passphrase"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := OpenCredentialStore(tc.path, tc.key); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("OpenCredentialStore = %v, want an error containing %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestCredentialStoreTampered(t *testing.T) {
+	dir := t.TempDir()
+	key := readKeyFile(t, writeKeyFile(t, dir, "store.key", minKeyFileSize))
+	path := filepath.Join(dir, "creds.json")
+	store := NewCredentialStore(path, key)
+	store.Set("alice", "secret")
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		tamper func(sealed *sealedStore)
+	}{
+		{"salt", func(sealed *sealedStore) { sealed.Salt[0] ^= 1 }},
+		{"nonce", func(sealed *sealedStore) { sealed.Nonce[0] ^= 1 }},
+		{"ciphertext", func(sealed *sealedStore) { sealed.Ciphertext[0] ^= 1 }},
+		// the key is right, only the header the ciphertext is bound to differs
+		{"header", func(sealed *sealedStore) {
+			aead, err := newStoreAEAD(key, sealed.Salt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other := *sealed
+			other.Version = credentialStoreVersion + 1
+			sealed.Ciphertext = aead.Seal(nil, sealed.Nonce, []byte(`[]`), other.additionalData())
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sealed := new(sealedStore)
+			if err := json.Unmarshal(data, sealed); err != nil {
+				t.Fatal(err)
+			}
+			tc.tamper(sealed)
+			tampered, _ := json.Marshal(sealed)
+			tamperedPath := filepath.Join(dir, tc.name+".json")
+			if err := os.WriteFile(tamperedPath, tampered, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := OpenCredentialStore(tamperedPath, key); err == nil || !strings.Contains(err.Error(), "failed to decrypt") {
+				t.Errorf("OpenCredentialStore of a store with a tampered %s = %v, want it to fail to decrypt", tc.name, err)
+			}
+		})
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := ReadKeyFile(writeKeyFile(t, dir, "short.key", minKeyFileSize-1)); err == nil || !strings.Contains(err.Error(), "want at least") {
+		t.Errorf("ReadKeyFile of a short key file = %v, want it refused", err)
+	}
+	if _, err := ReadKeyFile(writeKeyFile(t, dir, "ok.key", minKeyFileSize)); err != nil {
+		t.Errorf("ReadKeyFile of a %d byte key file = %v", minKeyFileSize, err)
+	}
+	if _, err := ReadKeyFile(filepath.Join(dir, "missing.key")); err == nil {
+		t.Error("ReadKeyFile of a missing key file succeeded")
+	}
+}
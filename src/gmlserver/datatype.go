@@ -1,9 +1,13 @@
 package gmlserver
 
 import (
+	"log/slog"
 	"net/http"
 	"net/url"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -20,11 +24,12 @@ const (
 	EndpointCreateLockbox             = "createlockbox"
 	EndpointIssueLicense              = "issuelicense"
 	defaultTimeout                    = time.Minute * 10
+	FoundationalIdentityAssetType     = "vme://assets/foundationalIdentity"
 	RequestMethodRetrieveCurrentTerms = "retrieveCurrentTerms"
 )
 
-var Config Configuration
-
+// Configuration is everything the license flow needs to reach one simulator server and MyAM,
+// each GmlServer resolves its own and passes it to the flow functions.
 type Configuration struct {
 	InteractionTypesDAP   map[string]string `envconfig:"interaction_types_dap" required:"true"`
 	MemberIDMap           map[string]string `envconfig:"member_id_map" required:"true"`
@@ -35,14 +40,39 @@ type Configuration struct {
 	CorrectAudience       string            `envconfig:"oidc_issuer_url" required:"true"`
 	UILocales             string            `envconfig:"ui_locales" required:"true"`
 	ServerAddressDAC      string            `envconfig:"server_address_dac" required:"true"`
-	SimServerURL          string            `envconfig:"sim_server_address" required:"true"`
 	Protocol              string            `envconfig:"protocol" default:"https://"`
 	ParallelTests         bool              `envconfig:"parallel_tests"`
 	MTDACAdapterURL       string            `envconfig:"mtdac_adapter_url"`
 	R12DACAdapterURL      string            `envconfig:"r12dac_adapter_url"`
 	MTDACList             []string          `envconfig:"mtdac_list"`
-}
-
+	// SimServer is called by every flow function that talks to the simulator server
+	SimServer SimServerClient
+	// RecoverLockboxDelay is waited before recoverlockbox, for a lockbox set up moments ago to propagate
+	RecoverLockboxDelay time.Duration
+	// Retry is the retry policy of each simulator server method, nil never retries
+	Retry *RetryPolicies
+	// SimServerLimiter caps the requests per second sent to the simulator server across all flows, nil does not
+	SimServerLimiter *rate.Limiter
+	// SimServerBreaker and MyAMBreaker fail calls fast while their upstream keeps failing, nil never do
+	SimServerBreaker *CircuitBreaker
+	MyAMBreaker      *CircuitBreaker
+	// Credentials are looked up for flows started without a password, nil holds none
+	Credentials *CredentialStore
+	// MyAMClient is copied by every MyAMAuthenticator
+	MyAMClient *http.Client
+	// AssetTypes are the digital assets created and licensed, defaults to the foundational identity
+	AssetTypes []string
+	// Logger receives the flow's log entries, defaults to the gmlserver logger
+	Logger *slog.Logger
+	// Logging switches the logging of simulator server bodies, nil never logs them
+	Logging *Logging
+	// Metrics records the flow's steps and upstream calls, nil records nothing
+	Metrics *Metrics
+	// TracerProvider traces each license flow and its upstream calls, nil traces nothing
+	TracerProvider trace.TracerProvider
+}
+
+// swagger:parameters accesstoken
 type AccessTokenReq struct {
 	//in: body
 	Body struct {
@@ -71,6 +101,7 @@ type AccessTokenReqBody struct {
 	ClientID string `json:"clientId,omitempty"`
 }
 
+// swagger:response accesstoken
 type AccessTokenResp struct {
 	//in: body
 	Body struct {
@@ -81,6 +112,7 @@ type AccessTokenResp struct {
 	}
 }
 
+// swagger:parameters requestobject
 type RequestObjectReq struct {
 	//in: body
 	Body struct {
@@ -130,6 +162,7 @@ type RequestObjectReqBody struct {
 	ClientID string `json:"clientId,omitempty"`
 }
 
+// swagger:response requestobject
 type RequestObjectResp struct {
 	//in: body
 	Body struct {
@@ -139,6 +172,9 @@ type RequestObjectResp struct {
 }
 
 type MyAMAuthenticator struct {
+	metrics      *Metrics
+	breaker      *CircuitBreaker
+	tracer       trace.Tracer
 	userID       string
 	password     string
 	oidcAuthURL  *url.URL
@@ -147,6 +183,7 @@ type MyAMAuthenticator struct {
 	lastRedirect string
 }
 
+// swagger:parameters recoverlockbox
 type RecoverLockboxReq struct {
 	//in: body
 	Body struct {
@@ -172,6 +209,7 @@ type RecoverLockboxReqBody struct {
 	NumberOfCodes int `json:"numberOfCodes,omitempty"`
 }
 
+// swagger:response recoverlockbox
 type RecoverLockboxResp struct {
 	//in: body
 	Body struct {
@@ -192,6 +230,7 @@ type RecoverLockboxRespBody struct {
 	getOrgCodesDeviceRespBody
 }
 
+// swagger:parameters createlockbox
 type CreateLockboxReq struct {
 	//in: body
 	Body struct {
@@ -221,6 +260,7 @@ type CreateLockboxReqBody struct {
 	NumberOfCodes int `json:"numberOfCodes,omitempty"`
 }
 
+// swagger:response createlockbox
 type CreateLockboxResp struct {
 	//in: body
 	Body struct {
@@ -569,6 +609,7 @@ type TxHistoryItem struct {
 	Status string `json:"status,omitempty"`
 }
 
+// swagger:parameters createdigitalasset
 type CreateDigitalAssetReq struct {
 	//in: body
 	Body struct {
@@ -609,6 +650,7 @@ type CreateDigitalAssetReqBody struct {
 	ServerState string `json:"serverState" validate:"required"`
 }
 
+// swagger:response createdigitalasset
 type CreateDigitalAssetResp struct {
 	//in: body
 	Body struct {
@@ -631,6 +673,7 @@ type UserInteractionInfo struct {
 	AppHostState   string `json:"appHostState,omitempty"`
 }
 
+// swagger:parameters retrievelicenserequest
 type RetrieveLicenseRequestReq struct {
 	//in: body
 	Body struct {
@@ -658,6 +701,7 @@ type RetrieveLicenseRequestReqBody struct {
 	ServerState string `json:"serverState" validate:"required"`
 }
 
+// swagger:response retrievelicenserequest
 type RetrieveLicenseRequestResp struct {
 	//in: body
 	Body struct {
@@ -680,6 +724,7 @@ type RetrieveLicenseRequestrespbody struct {
 	RequestHash string `json:"requestHash"`
 }
 
+// swagger:parameters issuelicense
 type IssueLicenseReq struct {
 	//in: body
 	Body struct {
@@ -717,6 +762,7 @@ type IssueLicenseReqBody struct {
 	EncryptWholeAsset bool `json:"encryptWholeAsset"`
 }
 
+// swagger:response issuelicense
 type IssueLicenseResp struct {
 	//in: body
 	Body struct {
@@ -742,20 +788,24 @@ type AssetQueryEntry struct {
 }
 
 type GmlReqBody struct {
-	// MyAM Username.
-	//required: true
-	Username string `json:"username" validate:"required"`
-	// MyAM Password.
-	//required: true
-	Password string `json:"password" validate:"required"`
+	// MyAM Username, required unless profile is set.
+	Username string `json:"username,omitempty" validate:"required_without=Profile"`
+	// MyAM Password, looked up in the server's credential store by username if omitted.
+	Password string `json:"password,omitempty"`
+	// Credential profile configured on the server, used instead of username and password.
+	Profile string `json:"profile,omitempty" validate:"excluded_with=Username Password"`
 	// DAC License Request ID.
 	//required: true
 	RequestID string `json:"requestID" validate:"required"`
 	// DAC License Request Encryption Key.
 	//required: true
 	RequestEncKey string `json:"requestEncKey" validate:"required"`
+	// Environment configured on the server whose simulator server and MyAM get the license, default if omitted.
+	Environment string `json:"environment,omitempty"`
 }
 
+// A DA license.
+// swagger:response licenseResponse
 type GmlResp struct {
 	Body struct {
 		// DA License.
@@ -767,6 +817,172 @@ type ErrorStruct500 struct {
 	Message string `json:"error"`
 }
 
+// ErrorResp is the machine readable error body returned by the /v1 API.
+type ErrorResp struct {
+	// Error code, one of the ErrCode* constants.
+	//required: true
+	Code string `json:"code"`
+	// Human readable description of the failure.
+	//required: true
+	Message string `json:"message"`
+	// Step of the license flow that failed: auth, recoverLockbox, createLockbox, createDA, retrieveLicenseRequest
+	// or issueLicense.
+	Step string `json:"step,omitempty"`
+	// Status returned by the simulator server or MyAM, if any.
+	UpstreamStatus int `json:"upstreamStatus,omitempty"`
+}
+
+// BatchLicenseReqBody asks for several licenses at once.
+type BatchLicenseReqBody struct {
+	// License requests, results are returned in the same order.
+	//required: true
+	Items []GmlReqBody `json:"items" validate:"required,min=1,dive"`
+	// Maximum number of license flows run at once, capped by the server's batch.concurrency.
+	Concurrency int `json:"concurrency,omitempty" validate:"gte=0"`
+}
+
+// BatchLicenseResult is the outcome of one item of a batch.
+type BatchLicenseResult struct {
+	// Position of the item in the batch.
+	//required: true
+	Index int `json:"index"`
+	// DA License, set if the item succeeded.
+	License string `json:"license,omitempty"`
+	// Error, set if the item failed.
+	Error *ErrorResp `json:"error,omitempty"`
+}
+
+// The outcome of every item of a batch, in input order.
+// swagger:response batchLicenseResponse
+type BatchLicenseResp struct {
+	Body struct {
+		// One result per item, in input order.
+		//required: true
+		Results []BatchLicenseResult `json:"results"`
+		// Number of items that got a license.
+		//required: true
+		Succeeded int `json:"succeeded"`
+		// Number of items that failed.
+		//required: true
+		Failed int `json:"failed"`
+	}
+}
+
+// DependencyStatus is the outcome of probing one upstream dependency.
+type DependencyStatus struct {
+	// up or down.
+	//required: true
+	Status string `json:"status"`
+	// URL probed.
+	//required: true
+	URL string `json:"url"`
+	// Time taken by the probe in milliseconds.
+	//required: true
+	LatencyMs int64 `json:"latencyMs"`
+	// Status the dependency answered with, if it answered.
+	HTTPStatus int `json:"httpStatus,omitempty"`
+	// State of the dependency's circuit breaker: closed, open or half_open.
+	Circuit string `json:"circuit,omitempty"`
+	// Why the dependency is down.
+	Error string `json:"error,omitempty"`
+}
+
+// The readiness of GML and of each dependency.
+// swagger:response readinessResponse
+type ReadinessResp struct {
+	Body struct {
+		// ready or not_ready.
+		//required: true
+		Status string `json:"status"`
+		// Environment whose dependencies were probed.
+		//required: true
+		Environment string `json:"environment"`
+		// Status of each dependency, by name.
+		//required: true
+		Dependencies map[string]DependencyStatus `json:"dependencies"`
+		// Time of the probes, results are cached for a short while.
+		//required: true
+		CheckedAt time.Time `json:"checkedAt"`
+	}
+}
+
+// CredentialProfile is a named test user configured on the server, without its password.
+type CredentialProfile struct {
+	// Name requests use as their profile.
+	//required: true
+	Name string `json:"name"`
+	// MyAM Username.
+	//required: true
+	Username string `json:"username"`
+	// What the profile is for.
+	Description string `json:"description,omitempty"`
+	// Where the password is read from: env or file.
+	//required: true
+	PasswordSource string `json:"passwordSource"`
+	// Whether the password can be read right now.
+	//required: true
+	Available bool `json:"available"`
+}
+
+// The configured credential profiles.
+// swagger:response profilesResponse
+type ProfilesResp struct {
+	Body struct {
+		// Profiles in configuration order.
+		//required: true
+		Profiles []CredentialProfile `json:"profiles"`
+	}
+}
+
+// LoggingSettings are the log settings that can be changed while the server runs
+type LoggingSettings struct {
+	// debug, info, warn or error. Unchanged if empty.
+	Level string `json:"level,omitempty"`
+	// Log simulator server request and response bodies at debug level. Unchanged if absent.
+	Bodies *bool `json:"bodies,omitempty"`
+}
+
+// StepEvent reports the start or the end of one step of the license flow.
+type StepEvent struct {
+	// Step of the license flow.
+	//required: true
+	Step string `json:"step"`
+	// One of started, succeeded or failed.
+	//required: true
+	Outcome string `json:"outcome"`
+	// Time the step started.
+	//required: true
+	StartedAt time.Time `json:"startedAt"`
+	// Duration of the step in milliseconds, set once the step has ended.
+	DurationMs int64 `json:"durationMs,omitempty"`
+	// Status returned by the simulator server or MyAM when the step failed.
+	UpstreamStatus int `json:"upstreamStatus,omitempty"`
+	// Error, set when the step failed.
+	Error string `json:"error,omitempty"`
+}
+
+// LicenseJob is the state of an asynchronous license request.
+type LicenseJob struct {
+	// Job ID, used to poll /v1/license-jobs/{id}.
+	//required: true
+	ID string `json:"id"`
+	// One of queued, running, succeeded or failed.
+	//required: true
+	Status string `json:"status"`
+	// Step of the license flow currently running, or the step that failed.
+	Step string `json:"step,omitempty"`
+	// DA License, set once the job has succeeded.
+	License string `json:"license,omitempty"`
+	// Error, set once the job has failed.
+	Error *ErrorResp `json:"error,omitempty"`
+	// Time the job was submitted.
+	//required: true
+	CreatedAt time.Time `json:"createdAt"`
+	// Time the job last changed status or step.
+	//required: true
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
 // RetrieveCurrentTermsReq .
 // swagger:parameters retrievecurrentterms
 type RetrieveCurrentTermsReq struct {
@@ -796,7 +1012,7 @@ type RetrieveCurrentTermsReqBody struct {
 }
 
 // RetrieveCurrentTermsResp A valid response to a retrievecurrentterms POST request coming from the endpoint.
-// swagger:response
+// swagger:response retrievecurrentterms
 type RetrieveCurrentTermsResp struct {
 	//in: body
 	Body struct {
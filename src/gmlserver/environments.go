@@ -0,0 +1,305 @@
+package gmlserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// DefaultEnvironment is the environment of the top-level simserver and myam, used by requests naming none
+	DefaultEnvironment = "default"
+
+	environmentsPathPrefix = "/v1/"
+)
+
+// errUnknownEnvironment is returned for a request naming an environment that is not configured
+var errUnknownEnvironment = errors.New("unknown environment")
+
+var environmentName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// environmentKeys are the settings an entry of environments can have. Credentials and profiles belong to the
+// environment that sets them, the others default to the top-level settings.
+var environmentKeys = map[string]bool{"simserver": true, "myam": true, LOCALE: true, "retry": true, "ratelimit": true,
+	"credentials": true, "profiles": true}
+
+// environment is a simulator server and MyAM license requests can be sent to, with its own upstream clients,
+// credentials, profiles and readiness
+type environment struct {
+	name      string
+	config    *Configuration
+	profiles  *profileStore
+	readiness *readiness
+}
+
+type environmentKey struct{}
+
+// withPathEnvironment records the environment named by the path of a /v1/{environment}/licenses request
+func withPathEnvironment(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, environmentKey{}, name)
+}
+
+func pathEnvironmentFrom(ctx context.Context) string {
+	name, _ := ctx.Value(environmentKey{}).(string)
+	return name
+}
+
+// loadEnvironments reads the entries of environments, each merged over a copy of the top-level settings
+// without credentials and profiles, so an environment only gets those it sets itself
+func loadEnvironments(v *viper.Viper) (map[string]*viper.Viper, error) {
+	entries, ok := v.AllSettings()[ENVIRONMENTS].(map[string]interface{})
+	if !ok {
+		if v.GetString(ENVIRONMENTS) != "" {
+			return nil, fmt.Errorf("%s must map names to environments", ENVIRONMENTS)
+		}
+		return nil, nil
+	}
+	environments := make(map[string]*viper.Viper, len(entries))
+	for name, entry := range entries {
+		settings, ok := entry.(map[string]interface{})
+		switch {
+		case !environmentName.MatchString(name) || name == DefaultEnvironment:
+			return nil, fmt.Errorf("%s: %q is not a valid environment name", ENVIRONMENTS, name)
+		case !ok:
+			return nil, fmt.Errorf("%s.%s has no settings", ENVIRONMENTS, name)
+		}
+		for key := range settings {
+			if !environmentKeys[key] {
+				return nil, fmt.Errorf("%s.%s: %s cannot be set per environment", ENVIRONMENTS, name, key)
+			}
+		}
+		base := v.AllSettings()
+		delete(base, ENVIRONMENTS)
+		delete(base, "credentials")
+		delete(base, PROFILES)
+		env := viper.New()
+		if err := env.MergeConfigMap(base); err != nil {
+			return nil, err
+		}
+		if err := env.MergeConfigMap(settings); err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", ENVIRONMENTS, name, err)
+		}
+		environments[name] = env
+	}
+	return environments, nil
+}
+
+// newEnvironment builds the license flow configuration of an environment from its settings in v. The flows of
+// every environment share the logging and tracing of shared, and record into metrics.
+func newEnvironment(name string, v *viper.Viper, shared *Configuration, metrics *Metrics, cassette *Cassette) (*environment, error) {
+	simServerURL, myamURL := v.GetString(SIMSERVER_URL), v.GetString(MYAM_URL)
+	config := NewConfiguration(simServerURL, myamURL)
+	config.Logging, config.Logger, config.TracerProvider, config.Metrics = shared.Logging, shared.Logger, shared.TracerProvider, metrics
+	if v.IsSet(LOCALE) {
+		config.UILocales = v.GetString(LOCALE)
+	}
+	simServerTLS, err := upstreamTLSConfig(v, "simserver.")
+	if err != nil {
+		return nil, err
+	}
+	simServerTransport, err := loadTransportSettings(v, "simserver.")
+	if err != nil {
+		return nil, err
+	}
+	simServer := NewHTTPSimServerClient(simServerURL, newUpstreamClient(UpstreamSimServer, simServerTLS, simServerTransport, 0))
+	if v.IsSet(SIMSERVER_REPLAY) {
+		simServer.Replayable = make(map[string]bool)
+		for _, method := range v.GetStringSlice(SIMSERVER_REPLAY) {
+			simServer.Replayable[strings.ToLower(method)] = true
+		}
+	}
+	simServer.Timeout = v.GetDuration(SIMSERVER_TIMEOUT)
+	simServer.Header = make(http.Header)
+	for name, value := range v.GetStringMapString(SIMSERVER_HEADERS) {
+		simServer.Header.Set(name, value)
+	}
+	simServer.Logging, simServer.Logger = config.Logging, config.Logger
+	config.SimServer = simServer
+	if v.IsSet(SIMSERVER_RECOVER_DELAY) {
+		config.RecoverLockboxDelay = v.GetDuration(SIMSERVER_RECOVER_DELAY)
+	}
+	config.Retry, err = loadRetryPolicies(v)
+	if err != nil {
+		return nil, err
+	}
+	myamTLS, err := upstreamTLSConfig(v, "myam.")
+	if err != nil {
+		return nil, err
+	}
+	myamTransport, err := loadTransportSettings(v, "myam.")
+	if err != nil {
+		return nil, err
+	}
+	config.MyAMClient = newUpstreamClient(UpstreamMyAM, myamTLS, myamTransport, defaultTimeout)
+	// the readiness probes are no exchanges of the license flows, they bypass the cassette
+	probeSimServer, probeMyAMClient := *simServer, config.MyAMClient
+	if cassette != nil {
+		cassette.ApplyEnvironment(name, config)
+	}
+	config.SimServerLimiter = newSimServerLimiter(v.GetFloat64(RATELIMIT_SIMSERVER_RATE), v.GetInt(RATELIMIT_SIMSERVER_BURST))
+	config.SimServerBreaker, err = loadBreaker(v, "simserver.", UpstreamSimServer, metrics)
+	if err != nil {
+		return nil, err
+	}
+	config.MyAMBreaker, err = loadBreaker(v, "myam.", UpstreamMyAM, metrics)
+	if err != nil {
+		return nil, err
+	}
+	config.Credentials, err = openConfiguredCredentialStore(v)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := loadProfiles(v)
+	if err != nil {
+		return nil, err
+	}
+	cacheTTL := defaultHealthCacheTTL
+	if v.IsSet(HEALTH_CACHE_TTL) {
+		cacheTTL = v.GetDuration(HEALTH_CACHE_TTL)
+	}
+	readiness := newReadiness(config, simServerURL, myamURL, cacheTTL, v.GetDuration(HEALTH_TIMEOUT))
+	readiness.environment = name
+	readiness.simServer, readiness.myamClient = &probeSimServer, probeMyAMClient
+	readiness.replaying = cassette != nil && cassette.mode == CassetteReplay
+	return &environment{name: name, config: config, profiles: profiles, readiness: readiness}, nil
+}
+
+// initEnvironments sets up the default environment and those of environments. Once there is more than the
+// default one, the metrics of each environment's flows carry an environment label.
+func (t *GmlServer) initEnvironments(shared *Configuration, registry *prometheus.Registry, cassette *Cassette) error {
+	named, err := loadEnvironments(t.viper)
+	if err != nil {
+		return err
+	}
+	flowMetrics := func(name string) *Metrics {
+		if len(named) == 0 {
+			return t.metrics.withFlowMetrics(registry)
+		}
+		return t.metrics.withFlowMetrics(prometheus.WrapRegistererWith(prometheus.Labels{"environment": name}, registry))
+	}
+	t.environments = make(map[string]*environment, len(named)+1)
+	t.environments[DefaultEnvironment], err = newEnvironment(DefaultEnvironment, t.viper, shared, flowMetrics(DefaultEnvironment), cassette)
+	if err != nil {
+		return err
+	}
+	for name, v := range named {
+		t.environments[name], err = newEnvironment(name, v, shared, flowMetrics(name), cassette)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %v", ENVIRONMENTS, name, err)
+		}
+	}
+	return nil
+}
+
+// environmentNames lists the configured environments, default first
+func (t *GmlServer) environmentNames() []string {
+	names := make([]string, 0, len(t.environments))
+	for name := range t.environments {
+		if name != DefaultEnvironment {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{DefaultEnvironment}, names...)
+}
+
+// environment returns the environment called name, the default one if name is empty
+func (t *GmlServer) environment(name string) (*environment, error) {
+	if name == "" {
+		name = DefaultEnvironment
+	}
+	env, ok := t.environments[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownEnvironment, name)
+	}
+	return env, nil
+}
+
+// resolveEnvironments returns the environment of every request: the one named by its environment field, or else
+// by the path, or else the default one. It answers 400 for an unknown environment or one contradicting the path,
+// and reports whether all were resolved.
+func (t *GmlServer) resolveEnvironments(w http.ResponseWriter, r *http.Request, reqs ...*GmlReqBody) ([]*environment, bool) {
+	pathName := pathEnvironmentFrom(r.Context())
+	envs := make([]*environment, len(reqs))
+	for i, req := range reqs {
+		name := req.Environment
+		var err error
+		switch {
+		case name == "":
+			name = pathName
+		case pathName != "" && !strings.EqualFold(name, pathName):
+			err = fmt.Errorf("environment %q does not match the path's %q", name, pathName)
+		}
+		if err == nil {
+			envs[i], err = t.environment(name)
+		}
+		if err != nil {
+			if len(reqs) > 1 {
+				err = fmt.Errorf("items[%d]: %w", i, err)
+			}
+			t.logger().WarnContext(r.Context(), "resolveEnvironments: invalid request", "err", err)
+			t.writeError(w, http.StatusBadRequest, &ErrorResp{Code: ErrCodeInvalidRequest, Message: err.Error()})
+			return nil, false
+		}
+	}
+	return envs, true
+}
+
+// flowContext tags ctx with the environment a license flow runs in, unless it is the default one
+func (env *environment) flowContext(ctx context.Context) context.Context {
+	if env.name == DefaultEnvironment {
+		return ctx
+	}
+	return withEnvironment(ctx, env.name)
+}
+
+// queryEnvironment returns the environment named by the environment query parameter of r, answering 404 if it is
+// not configured
+func (t *GmlServer) queryEnvironment(w http.ResponseWriter, r *http.Request) (*environment, bool) {
+	env, err := t.environment(r.URL.Query().Get("environment"))
+	if err != nil {
+		t.writeError(w, http.StatusNotFound, &ErrorResp{Code: ErrCodeNotFound, Message: err.Error()})
+		return nil, false
+	}
+	return env, true
+}
+
+// environmentsHandler serves /v1/{environment}/licenses, the license endpoint of one environment
+//
+// swagger:route POST /v1/{environment}/licenses licenses createEnvironmentLicense
+//
+// Get a DA license for a MyAM user of an environment.
+//
+// Same as POST /v1/licenses, against the simulator server and MyAM of the environment. A request
+// body naming another environment is rejected. Answers 404 for an environment that is not configured.
+//
+// responses:
+//
+//	200: licenseResponse
+//	400: errorResponse
+//	401: errorResponse
+//	404: errorResponse
+//	429: errorResponse
+//	500: errorResponse
+//	502: errorResponse
+//	503: errorResponse
+//	504: errorResponse
+func (t *GmlServer) environmentsHandler(w http.ResponseWriter, r *http.Request) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, environmentsPathPrefix), "/")
+	if rest != "licenses" {
+		t.writeError(w, http.StatusNotFound, &ErrorResp{Code: ErrCodeNotFound, Message: r.URL.Path + " does not exist"})
+		return
+	}
+	if _, err := t.environment(name); name == "" || err != nil {
+		t.writeError(w, http.StatusNotFound, &ErrorResp{Code: ErrCodeNotFound, Message: fmt.Sprintf("%v %q", errUnknownEnvironment, name)})
+		return
+	}
+	t.limitCaller(t.captureFlows(t.licensesHandler))(w, r.WithContext(withPathEnvironment(r.Context(), name)))
+}
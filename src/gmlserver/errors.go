@@ -0,0 +1,146 @@
+package gmlserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// steps of getLicenseForDA, reported back to callers when a flow fails
+const (
+	StepAuth                   = "auth"
+	StepRecoverLockbox         = "recoverLockbox"
+	StepCreateLockbox          = "createLockbox"
+	StepCreateDA               = "createDA"
+	StepRetrieveLicenseRequest = "retrieveLicenseRequest"
+	StepIssueLicense           = "issueLicense"
+)
+
+// machine readable error codes returned in ErrorResp
+const (
+	ErrCodeInvalidRequest   = "invalid_request"
+	ErrCodeMethodNotAllowed = "method_not_allowed"
+	ErrCodeUnauthorized     = "unauthorized"
+	ErrCodeForbidden        = "forbidden"
+	ErrCodeNotFound         = "not_found"
+	ErrCodeUpstream         = "upstream_error"
+	ErrCodeUpstreamTimeout  = "upstream_timeout"
+	ErrCodeInternal         = "internal_error"
+	ErrCodeUnavailable      = "unavailable"
+	ErrCodeRateLimited      = "rate_limited"
+	ErrCodeCircuitOpen      = "circuit_open"
+)
+
+// UpstreamError is returned when a call to the simulator server or MyAM fails,
+// either because no response was received (Err is set) or because the response
+// did not carry the expected status.
+type UpstreamError struct {
+	// Method is the simulator server method or the MyAM operation that was called
+	Method string
+	// StatusCode is the status received, 0 if no response was received
+	StatusCode int
+	// ExpectedStatus is the status the caller was waiting for
+	ExpectedStatus int
+	// Body is the response body received with an unexpected status
+	Body string
+	// Err is the transport error, if any
+	Err error
+}
+
+func (e *UpstreamError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("error sending request to %s :: %v", e.Method, e.Err)
+	}
+	return fmt.Sprintf("%s returned wrong status code: got %v want %v, %s", e.Method, e.StatusCode, e.ExpectedStatus, e.Body)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the upstream call timed out, either on our side or at a gateway
+func (e *UpstreamError) Timeout() bool {
+	if e.StatusCode == http.StatusGatewayTimeout {
+		return true
+	}
+	if errors.Is(e.Err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+// FlowError records which step of getLicenseForDA failed
+type FlowError struct {
+	Step string
+	Err  error
+}
+
+func (e *FlowError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Step, e.Err)
+}
+
+func (e *FlowError) Unwrap() error {
+	return e.Err
+}
+
+// errorResponseFor maps an error returned by getLicenseForDA to a HTTP status and an ErrorResp body
+func errorResponseFor(err error) (int, *ErrorResp) {
+	resp := &ErrorResp{Code: ErrCodeInternal, Message: err.Error()}
+
+	var flowErr *FlowError
+	if errors.As(err, &flowErr) {
+		resp.Step = flowErr.Step
+	}
+	if errors.Is(err, ErrNoPassword) {
+		resp.Code = ErrCodeInvalidRequest
+		return http.StatusBadRequest, resp
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		// the upstream kept failing, the call was not even tried
+		resp.Code = ErrCodeCircuitOpen
+		return http.StatusServiceUnavailable, resp
+	}
+	if errors.Is(err, context.Canceled) {
+		// the flow was cancelled by a shutdown or the caller going away
+		resp.Code = ErrCodeUnavailable
+		return http.StatusServiceUnavailable, resp
+	}
+	if errors.Is(err, ErrThrottled) {
+		// GML's own outbound rate limit held the call back, the simulator server was not asked
+		resp.Code = ErrCodeUnavailable
+		return http.StatusServiceUnavailable, resp
+	}
+
+	var upstreamErr *UpstreamError
+	if errors.Is(err, ErrLoginRejected) {
+		// MyAM turned down the password or step up PIN
+		if errors.As(err, &upstreamErr) {
+			resp.UpstreamStatus = upstreamErr.StatusCode
+		}
+		resp.Code = ErrCodeUnauthorized
+		return http.StatusUnauthorized, resp
+	}
+	if !errors.As(err, &upstreamErr) {
+		if flowErr == nil {
+			return http.StatusInternalServerError, resp
+		}
+		resp.Code = ErrCodeUpstream
+		return http.StatusBadGateway, resp
+	}
+	resp.UpstreamStatus = upstreamErr.StatusCode
+	switch {
+	case upstreamErr.Timeout():
+		resp.Code = ErrCodeUpstreamTimeout
+		return http.StatusGatewayTimeout, resp
+	case resp.Step == StepRetrieveLicenseRequest && upstreamErr.StatusCode == http.StatusNotFound:
+		// the DAC's license request does not exist, any other 404 is a simulator server fault
+		resp.Code = ErrCodeNotFound
+		return http.StatusNotFound, resp
+	default:
+		resp.Code = ErrCodeUpstream
+		return http.StatusBadGateway, resp
+	}
+}
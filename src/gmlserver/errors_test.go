@@ -0,0 +1,183 @@
+package gmlserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestErrorResponseFor(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		status   int
+		code     string
+		step     string
+		upstream int
+	}{
+		{
+			name:     "unknown license request",
+			err:      &FlowError{Step: StepRetrieveLicenseRequest, Err: &UpstreamError{Method: "retrievelicenserequest", StatusCode: http.StatusNotFound}},
+			status:   http.StatusNotFound,
+			code:     ErrCodeNotFound,
+			step:     StepRetrieveLicenseRequest,
+			upstream: http.StatusNotFound,
+		},
+		{
+			name:     "simulator server without the method",
+			err:      &FlowError{Step: StepIssueLicense, Err: &UpstreamError{Method: "issuelicense", StatusCode: http.StatusNotFound}},
+			status:   http.StatusBadGateway,
+			code:     ErrCodeUpstream,
+			step:     StepIssueLicense,
+			upstream: http.StatusNotFound,
+		},
+		{
+			name:     "access token refused",
+			err:      &FlowError{Step: StepAuth, Err: &UpstreamError{Method: "accesstoken", StatusCode: http.StatusBadRequest}},
+			status:   http.StatusBadGateway,
+			code:     ErrCodeUpstream,
+			step:     StepAuth,
+			upstream: http.StatusBadRequest,
+		},
+		{
+			name:     "password rejected",
+			err:      &FlowError{Step: StepAuth, Err: fmt.Errorf("failed to get authcode :: %w", loginRejected("login", http.StatusFound, "redirected"))},
+			status:   http.StatusUnauthorized,
+			code:     ErrCodeUnauthorized,
+			step:     StepAuth,
+			upstream: http.StatusFound,
+		},
+		{
+			name:     "gateway timeout",
+			err:      &FlowError{Step: StepCreateDA, Err: &UpstreamError{Method: "createdigitalasset", StatusCode: http.StatusGatewayTimeout}},
+			status:   http.StatusGatewayTimeout,
+			code:     ErrCodeUpstreamTimeout,
+			step:     StepCreateDA,
+			upstream: http.StatusGatewayTimeout,
+		},
+		{
+			name:   "no response",
+			err:    &FlowError{Step: StepIssueLicense, Err: &UpstreamError{Method: "issuelicense", Err: io.ErrUnexpectedEOF}},
+			status: http.StatusBadGateway,
+			code:   ErrCodeUpstream,
+			step:   StepIssueLicense,
+		},
+		{
+			name:   "circuit open",
+			err:    &FlowError{Step: StepAuth, Err: ErrCircuitOpen},
+			status: http.StatusServiceUnavailable,
+			code:   ErrCodeCircuitOpen,
+			step:   StepAuth,
+		},
+		{
+			name:   "cancelled",
+			err:    &FlowError{Step: StepCreateDA, Err: context.Canceled},
+			status: http.StatusServiceUnavailable,
+			code:   ErrCodeUnavailable,
+			step:   StepCreateDA,
+		},
+		{
+			name:   "no password",
+			err:    ErrNoPassword,
+			status: http.StatusBadRequest,
+			code:   ErrCodeInvalidRequest,
+		},
+		{
+			name:   "flow failure without an upstream error",
+			err:    &FlowError{Step: StepCreateDA, Err: errors.New("malformed state")},
+			status: http.StatusBadGateway,
+			code:   ErrCodeUpstream,
+			step:   StepCreateDA,
+		},
+		{
+			name:   "internal",
+			err:    errors.New("boom"),
+			status: http.StatusInternalServerError,
+			code:   ErrCodeInternal,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			status, resp := errorResponseFor(tc.err)
+			if status != tc.status || resp.Code != tc.code || resp.Step != tc.step || resp.UpstreamStatus != tc.upstream {
+				t.Errorf("errorResponseFor = %d %+v, want %d with code %s, step %q and upstream status %d",
+					status, resp, tc.status, tc.code, tc.step, tc.upstream)
+			}
+		})
+	}
+}
+
+// newLoginServer fakes the MyAM login pages, login answering as given
+func newLoginServer(t *testing.T, login http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/myam/oidc/authorize", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<form action="/myam/oidc/login" method="post"><input name="password" type="password"/></form>`)
+	})
+	mux.HandleFunc("/myam/oidc/authenticate", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"status": "AUTHENTICATED"}`)
+	})
+	mux.HandleFunc("/myam/oidc/login", login)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMyAMLoginRejected(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		login http.HandlerFunc
+	}{
+		{
+			name: "login page again",
+			login: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, `<p>Wrong password</p><form action="/myam/oidc/login" method="post"><input name="password" type="password"/></form>`)
+			},
+		},
+		{
+			name: "redirect to authorize",
+			login: func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, "/myam/oidc/authorize?error=invalid_credentials", http.StatusFound)
+			},
+		},
+		{
+			name: "redirect with an error",
+			login: func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, "https://client.invalid/callback?error=access_denied&state=s", http.StatusFound)
+			},
+		},
+		{
+			name: "401",
+			login: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newLoginServer(t, tc.login)
+			cfg := NewConfiguration(server.URL, server.URL)
+			_, err := MyAMGetOIDCAuthCode(context.Background(), cfg, "alice", "wrong", server.URL+"/myam/oidc/authorize")
+			if !errors.Is(err, ErrLoginRejected) {
+				t.Fatalf("error = %v, want ErrLoginRejected", err)
+			}
+			if status, _ := errorResponseFor(&FlowError{Step: StepAuth, Err: err}); status != http.StatusUnauthorized {
+				t.Errorf("status = %d, want 401", status)
+			}
+		})
+	}
+}
+
+func TestMyAMLoginAuthCode(t *testing.T) {
+	server := newLoginServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://client.invalid/callback?"+url.Values{"code": {"authcode"}, "state": {"s"}}.Encode(), http.StatusFound)
+	})
+	cfg := NewConfiguration(server.URL, server.URL)
+	code, err := MyAMGetOIDCAuthCode(context.Background(), cfg, "alice", "secret", server.URL+"/myam/oidc/authorize")
+	if err != nil || code != "authcode" {
+		t.Errorf("MyAMGetOIDCAuthCode = %q, %v, want authcode", code, err)
+	}
+}
@@ -0,0 +1,91 @@
+package gmlserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const sseKeepAlive = 15 * time.Second
+
+// streamLicenseJob serves GET /v1/license-jobs/{id}/events as Server-Sent Events.
+// Every StepEvent of the job is sent as a "step" event, with its index as the event id so
+// clients reconnecting with Last-Event-ID resume where they left off. Once the job has
+// finished a final "done" event carries the job itself and the stream is closed.
+//
+// swagger:route GET /v1/license-jobs/{id}/events licenses streamLicenseJob
+//
+// Stream the steps of a license job as Server-Sent Events.
+//
+// produces: text/event-stream
+//
+// responses:
+//
+//	200: licenseJobEventsResponse
+//	404: errorResponse
+func (t *GmlServer) streamLicenseJob(w http.ResponseWriter, r *http.Request, id string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		t.writeError(w, http.StatusInternalServerError, &ErrorResp{Code: ErrCodeInternal, Message: "streaming is not supported"})
+		return
+	}
+	next := 0
+	if lastEventID, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil {
+		next = lastEventID + 1
+	}
+
+	job, events, changed, ok := t.jobs.watch(id, next)
+	if !ok {
+		t.writeError(w, http.StatusNotFound, &ErrorResp{Code: ErrCodeNotFound, Message: "no license job with id " + id})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		for _, event := range events {
+			writeSSE(w, strconv.Itoa(next), "step", event)
+			next++
+		}
+		if job.finished() {
+			writeSSE(w, "", "done", job)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-t.draining:
+			// let the server shut down, clients can reconnect with Last-Event-ID elsewhere
+			return
+		}
+		job, events, changed, ok = t.jobs.watch(id, next)
+		if !ok {
+			return
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, id, event string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		myLogger.Error("writeSSE: unable to marshal event", "event", event, "err", err)
+		return
+	}
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+}
@@ -2,12 +2,16 @@ package gmlserver
 
 import (
         "bytes"
-        "encoding/json"
+        "context"
         "crypto/sha256"
-        "io/ioutil"
+        "errors"
         "net/http"
         "fmt"
         "strings"
+        "time"
+
+        "go.opentelemetry.io/otel/attribute"
+        "go.opentelemetry.io/otel/trace"
 )
 
 func generateCodeVerifierAndCaculateCodeChallenge() (string, string, error) {
@@ -29,67 +33,87 @@ func generateCodeVerifierAndCaculateCodeChallenge() (string, string, error) {
         return codeVerifier, codeChallenge, nil
 }
 
-func SendRequestAndCheckResponse(requestMethod string, request interface{}, expectedStatus int, expectedStruct interface{}) error {
-        var payload []byte
-        var err error
-        switch request.(type) {
-        case string:
-                payload = []byte(request.(string))
-        case []byte:
-                payload = request.([]byte)
-        default:
-                payload, err = json.Marshal(request)
-                if err != nil {
-                        return fmt.Errorf("unable to marshal request to %s, reason: %s", requestMethod, err)
-                }
-        }
+// SendRequestAndCheckResponse calls a simulator server method through cfg.SimServer, tracing it, counting it in the
+// metrics, holding it to the simulator server rate limit and circuit breaker and retrying it as the method's retry
+// policy says
+func SendRequestAndCheckResponse(ctx context.Context, cfg *Configuration, requestMethod string, request interface{}, expectedStatus int, expectedStruct interface{}) (err error) {
+        // make requestMethod lowercase as per our simulator server convention
+        requestMethod = strings.ToLower(requestMethod)
 
-        resultBody, err := SendRequestToSimServer(requestMethod, payload, expectedStatus)
+        ctx, span := cfg.tracer().Start(ctx, "simserver "+requestMethod, trace.WithSpanKind(trace.SpanKindClient))
+        statusCode := 0
+        defer func() { endClientSpan(span, statusCode, err) }()
+        // the breaker counts the call once, however many attempts it takes
+        done, err := cfg.SimServerBreaker.Allow()
         if err != nil {
                 return err
         }
-
-        if expectedStruct != nil {
-                err = json.Unmarshal(resultBody, &expectedStruct)
-                if err != nil {
-                        return fmt.Errorf("handler returned unexpected body: could not unmarshal into the structure we were expecting :: %v", err)
+        defer func() { done(err) }()
+        policy := cfg.Retry.For(requestMethod)
+        if policy.Deadline > 0 {
+                var cancel context.CancelFunc
+                ctx, cancel = context.WithTimeout(ctx, policy.Deadline)
+                defer cancel()
+        }
+        for attempt := 1; ; attempt++ {
+                statusCode, err = callSimServer(ctx, cfg, requestMethod, request, expectedStatus, expectedStruct)
+                if err == nil || attempt >= policy.Attempts || !policy.retryable(err) {
+                        return err
+                }
+                backoff := policy.backoff(attempt)
+                if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+                        // no time left for another attempt
+                        return err
+                }
+                cfg.Metrics.simServerRetried(requestMethod)
+                span.AddEvent("retry", trace.WithAttributes(attribute.Int("gml.retry.attempt", attempt), attribute.String("gml.retry.error", err.Error())))
+                cfg.logger().WarnContext(ctx, "retrying simulator server call", "method", requestMethod, "attempt", attempt, "attempts", policy.Attempts, "backoff", backoff, "err", err)
+                if sleepErr := sleepContext(ctx, backoff); sleepErr != nil {
+                        return err
                 }
         }
-        return nil
 }
 
-
-func SendRequestToSimServer(requestMethod string, request []byte, expectedStatus int) ([]byte, error) {
-        // make requestMethod lowercase as per our simulator server convention
-        requestMethod = strings.ToLower(requestMethod)
-
-        var result *http.Response
-        var err error
-        //log.Printf("--> send POST request to %s/%s, request body: %s\n", Config.SimServerURL, requestMethod, string(request))
-        result, err = http.DefaultClient.Do(BuildRequest(http.MethodPost, Config.SimServerURL+"/"+requestMethod, request))
-        if err != nil {
-                return nil, fmt.Errorf("error sending request to Simulator Server :: %v", err)
+// callSimServer makes one attempt at a simulator server call, statusCode is 0 when no response was received
+func callSimServer(ctx context.Context, cfg *Configuration, requestMethod string, request interface{}, expectedStatus int, expectedStruct interface{}) (statusCode int, err error) {
+        if cfg.SimServerLimiter != nil {
+                throttled := time.Now()
+                err = cfg.SimServerLimiter.Wait(ctx)
+                cfg.Metrics.observeSimServerThrottle(time.Since(throttled))
+                if err != nil {
+                        return 0, &ThrottledError{Method: requestMethod, Err: err}
+                }
         }
-
-        defer result.Body.Close()
-        response, err := ioutil.ReadAll(result.Body)
-        if err != nil {
-                return nil, fmt.Errorf("could not read response body :: %v", err)
+        start := time.Now()
+        err = cfg.SimServer.Call(ctx, requestMethod, request, expectedStatus, expectedStruct)
+        var upstreamErr *UpstreamError
+        switch {
+        case err == nil:
+                statusCode = expectedStatus
+        case errors.As(err, &upstreamErr):
+                statusCode = upstreamErr.StatusCode
         }
-        //log.Printf("<-- received response from simulator server: %s\n\n", string(response))
+        cfg.Metrics.observeSimServer(requestMethod, time.Since(start), statusCode)
+        return statusCode, err
+}
 
-        if result.StatusCode != expectedStatus {
-                return nil, fmt.Errorf("handler returned wrong status code: got %v want %v, %s", result.StatusCode, expectedStatus, string(response))
+// SendRequestToSimServer calls a simulator server method like SendRequestAndCheckResponse and returns the raw response body
+func SendRequestToSimServer(ctx context.Context, cfg *Configuration, requestMethod string, request []byte, expectedStatus int) ([]byte, error) {
+        var response []byte
+        err := SendRequestAndCheckResponse(ctx, cfg, requestMethod, request, expectedStatus, &response)
+        if err != nil {
+                return nil, err
         }
         return response, nil
 }
 
-func BuildRequest(method string, url string, payload []byte) *http.Request {
-        req, _ := http.NewRequest(method, url, bytes.NewReader(payload))
+func BuildRequest(ctx context.Context, method string, url string, payload []byte) (*http.Request, error) {
+        req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(payload))
+        if err != nil {
+                return nil, fmt.Errorf("could not build %s request to %s :: %v", method, url, err)
+        }
         req.Header.Add("content-type", "application/json; charset=UTF-8")
         req.Header.Add("cache-control", "no-cache")
-        // set connection: close header to disable keepalive
-        // without this header the request may fail with error message "http: server closed idle connection" when server decide to reset TCP connection
-        req.Header.Add("Connection", "close")
-        return req
+        setRequestIDHeader(req)
+        return req, nil
 }
@@ -2,82 +2,300 @@ package gmlserver
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
-var myLogger = log.New(log.Writer(), "gmlserver ", log.Ldate|log.Ltime|log.Lmicroseconds|log.Llongfile)
-
 const (
 	SERVER_ADDRESS = "http.url"
 	SERVER_PORT    = "http.listen.address"
 	SERVER_UI_PATH = "http.ui.path"
 	SIMSERVER_URL  = "simserver.url"
 	MYAM_URL       = "myam.url"
+	// ui_locales asked of MyAM's login pages
+	LOCALE = "locale"
+	// named simulator servers and MyAMs requests can pick instead of the top-level ones, see loadEnvironments
+	ENVIRONMENTS = "environments"
+	// bound on each simulator server call, 0 leaves it to the license flow, and headers sent with every call
+	SIMSERVER_TIMEOUT = "simserver.timeout"
+	SIMSERVER_HEADERS = "simserver.headers"
+	// methods sent again on a fresh connection when a pooled one turns out to be closed, only those safe to repeat
+	SIMSERVER_REPLAY = "simserver.replay"
+	// wait before recoverlockbox, for a lockbox set up moments ago to propagate
+	SIMSERVER_RECOVER_DELAY = "simserver.recoverlockbox.delay"
+	// retry policy of every simulator server method, and of the methods overriding it, see RetryPolicy
+	RETRY_DEFAULT = "retry.default"
+	RETRY_METHODS = "retry.methods"
+	JOBS_WORKERS  = "jobs.workers"
+	JOBS_TTL      = "jobs.ttl"
+	// default and maximum concurrency of a batch
+	BATCH_CONCURRENCY = "batch.concurrency"
+	BATCH_MAX_ITEMS   = "batch.max.items"
+	// how long /readyz reuses the result of probing the simulator server and MyAM
+	HEALTH_CACHE_TTL = "health.cache.ttl"
+	HEALTH_TIMEOUT   = "health.timeout"
+	// json or text
+	LOG_FORMAT = "log.format"
+	LOG_LEVEL  = "log.level"
+	// log simulator server request and response bodies at debug level, can be switched at /v1/logging
+	LOG_BODIES = "log.bodies"
+	// file holding the secret, at least 32 bytes, usernames are hashed with in logs, a random one per run if unset
+	LOG_USER_HASH_KEY_FILE = "log.user.hash.key.file"
+	// none, stdout or otlp
+	TRACING_EXPORTER = "tracing.exporter"
+	// OTLP/HTTP endpoint, ie. http://localhost:4318, the OTEL_EXPORTER_OTLP_* variables apply if empty
+	TRACING_OTLP_ENDPOINT = "tracing.otlp.endpoint"
+	TRACING_OTLP_INSECURE = "tracing.otlp.insecure"
+	TRACING_SERVICE_NAME  = "tracing.service.name"
+	HTTP_TLS_ENABLED      = "http.tls.enabled"
+	HTTP_TLS_CERT_FILE    = "http.tls.cert.file"
+	HTTP_TLS_KEY_FILE     = "http.tls.key.file"
+	// CA bundle verifying client certificates, setting it requires them
+	HTTP_TLS_CLIENT_CA_FILE = "http.tls.client.ca.file"
+	// regular expressions, one of which the subject of a client certificate must fully match
+	HTTP_TLS_CLIENT_SUBJECTS = "http.tls.client.subjects"
+	// client certificate and CA bundle of an upstream, under simserver. and myam.
+	UPSTREAM_TLS_CERT_FILE = "tls.cert.file"
+	UPSTREAM_TLS_KEY_FILE  = "tls.key.file"
+	UPSTREAM_TLS_CA_FILE   = "tls.ca.file"
+	// circuit breaker of an upstream, under simserver. and myam., see BreakerSettings
+	UPSTREAM_BREAKER = "breaker"
+	// connection pool of an upstream, under simserver. and myam., see TransportSettings
+	UPSTREAM_TRANSPORT = "transport"
+	// require an API key or bearer token on every path but the public ones
+	AUTH_ENABLED       = "auth.enabled"
+	AUTH_PUBLIC_PATHS  = "auth.public.paths"
+	AUTH_KEYS          = "auth.keys"
+	AUTH_TOKEN_SECRETS = "auth.tokens.secrets"
+	// key IDs and token subjects allowed on the admin endpoints
+	AUTH_ADMINS = "auth.admins"
+	// how often the config file is checked for new keys and secrets
+	AUTH_RELOAD_INTERVAL = "auth.reload.interval"
+	// license requests per second and burst allowed to each caller (API key or IP) and to each MyAM username, 0 is unlimited
+	RATELIMIT_CALLER_RATE  = "ratelimit.caller.rate"
+	RATELIMIT_CALLER_BURST = "ratelimit.caller.burst"
+	RATELIMIT_USER_RATE    = "ratelimit.user.rate"
+	RATELIMIT_USER_BURST   = "ratelimit.user.burst"
+	// requests per second sent to the simulator server by all flows together, calls beyond it wait their turn
+	RATELIMIT_SIMSERVER_RATE  = "ratelimit.simserver.rate"
+	RATELIMIT_SIMSERVER_BURST = "ratelimit.simserver.burst"
+	// named test users requests can use instead of a username and password, see profileConfig
+	PROFILES = "profiles"
+	// encrypted store of MyAM passwords, looked up by username for requests without one, see the gml creds command
+	CREDENTIALS_STORE_FILE            = "credentials.store.file"
+	CREDENTIALS_STORE_KEY_FILE        = "credentials.store.key.file"
+	CREDENTIALS_STORE_PASSPHRASE_FILE = "credentials.store.passphrase.file"
+	CREDENTIALS_STORE_PASSPHRASE      = "credentials.store.passphrase"
+	// off, request (flows of requests sending X-Capture: true) or all, and how long and how many captures are kept
+	CAPTURE_MODE = "capture.mode"
+	CAPTURE_TTL  = "capture.ttl"
+	CAPTURE_MAX  = "capture.max"
+	// off, record or replay, the cassette file upstream exchanges are saved to or answered from, and how requests
+	// are matched to recorded exchanges, see CassetteMatch
+	CASSETTE_MODE  = "cassette.mode"
+	CASSETTE_FILE  = "cassette.file"
+	CASSETTE_MATCH = "cassette.match"
+	// time allowed for in-flight license flows to finish on shutdown
+	SHUTDOWN_TIMEOUT = "http.shutdown.timeout"
+	// time spent answering 503 before the listener is closed, so load balancers can take us out of rotation
+	SHUTDOWN_DELAY = "http.shutdown.delay"
+
+	defaultShutdownTimeout     = 30 * time.Second
+	cancelGracePeriod          = time.Second
+	tracingShutdownTimeout     = 5 * time.Second
+	defaultRecoverLockboxDelay = 10 * time.Second
 )
 
 type GmlServer struct {
-	ServerAddress string
-	Port          string
-	UIPath        string
-	SimServerURL  string
-	MyamURL       string
-	listener      net.Listener
+	ServerAddress    string
+	Port             string
+	UIPath           string
+	SimServerURL     string
+	MyamURL          string
+	ShutdownTimeout  time.Duration
+	ShutdownDelay    time.Duration
+	BatchConcurrency int
+	BatchMaxItems    int
+	listener         net.Listener
+	jobs             *jobStore
+	userLocks        *userLocks
+	apiAuth          *apiAuth
+	// environments are the simulator servers and MyAMs requests can pick, by name
+	environments    map[string]*environment
+	metrics         *Metrics
+	captures        *captureStore
+	callerLimiter   *keyedLimiter
+	userLimiter     *keyedLimiter
+	tlsConfig       *tls.Config
+	metricsExporter http.Handler
+	tracerProvider  *sdktrace.TracerProvider
+
+	viper  *viper.Viper
+	config *Configuration
+	mux    *http.ServeMux
+
+	mu     sync.Mutex
+	server *http.Server
+	// flowCtx is the parent of every request and job context, cancelled once the drain timeout is reached
+	flowCtx     context.Context
+	cancelFlows context.CancelFunc
+	// draining is closed as soon as Close is called
+	draining  chan struct{}
+	closeOnce sync.Once
 }
 
 func NewGmlServer(cfgFile string) (*GmlServer, error) {
-	instance := GmlServer{}
+	instance := GmlServer{viper: viper.New(), mux: http.NewServeMux()}
 	err := instance.initConfig(cfgFile)
+	if err != nil {
+		return &instance, err
+	}
+	instance.routes()
+	return &instance, nil
 
-	return &instance, err
+}
 
+// NewConfiguration resolves the configuration of the license flow for a simulator server and a MyAM instance
+func NewConfiguration(simServerURL, myamURL string) *Configuration {
+	return &Configuration{
+		CorrectProviderURL:  myamURL + "/myam/oidc",
+		CorrectAudience:     myamURL + "/myam/oidc/token",
+		MyBankBaseURL:       simServerURL + "/my-bank",
+		UILocales:           "en",
+		SimServer:           NewHTTPSimServerClient(simServerURL, newUpstreamClient(UpstreamSimServer, nil, DefaultTransportSettings(), 0)),
+		RecoverLockboxDelay: defaultRecoverLockboxDelay,
+		Retry:               DefaultRetryPolicies(),
+		MyAMClient:          newUpstreamClient(UpstreamMyAM, nil, DefaultTransportSettings(), defaultTimeout),
+	}
 }
 
-func getLicenseForDA(username, password, licenseRequestID, requestEncKey string) (string, error) {
+func (c *Configuration) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return myLogger
+}
+
+func (t *GmlServer) logger() *slog.Logger {
+	if t.config == nil {
+		return myLogger
+	}
+	return t.config.logger()
+}
+
+func (c *Configuration) assetTypes() []string {
+	if len(c.AssetTypes) != 0 {
+		return c.AssetTypes
+	}
+	return []string{FoundationalIdentityAssetType}
+}
 
-	accessToken, err := GetAccessToken(VerifiedMeScope, username, password, "")
+// GetLicenseForDA runs the license flow of a GmlServer without one, for callers embedding GML in their own process
+func GetLicenseForDA(ctx context.Context, cfg *Configuration, username, password, licenseRequestID, requestEncKey string, observer func(StepEvent)) (string, error) {
+	return getLicenseForDA(ctx, cfg, username, password, licenseRequestID, requestEncKey, observer)
+}
+
+// getLicenseForDA runs the full license flow for a MyAM user, observer (if not nil) is sent a StepEvent as each step starts and ends
+func getLicenseForDA(ctx context.Context, cfg *Configuration, username, password, licenseRequestID, requestEncKey string, observer func(StepEvent)) (string, error) {
+	if password == "" {
+		var ok bool
+		if password, ok = cfg.Credentials.Password(username); !ok {
+			return "", ErrNoPassword
+		}
+	}
+	notify := observer
+	observer = func(event StepEvent) {
+		cfg.Metrics.observeStep(event)
+		if notify != nil {
+			notify(event)
+		}
+	}
+
+	ctx = withUser(ctx, cfg.Logging, username)
+	ctx, span := startFlowSpan(ctx, cfg, licenseRequestID)
+	license, err := runLicenseFlow(ctx, cfg, username, password, licenseRequestID, requestEncKey, observer)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	return license, err
+}
+
+func runLicenseFlow(ctx context.Context, cfg *Configuration, username, password, licenseRequestID, requestEncKey string, observer func(StepEvent)) (string, error) {
+	var accessToken string
+	err := runStep(ctx, cfg, observer, StepAuth, func(ctx context.Context) (err error) {
+		accessToken, err = GetAccessToken(ctx, cfg, VerifiedMeScope, username, password, "")
+		return err
+	})
 	if err != nil {
-		myLogger.Printf("getLicenseForDA->GetAccessToken: %v", err)
 		return "", err
 	}
-	serverState, _, err := RecoverLockboxWithClientID(accessToken, http.StatusAccepted, "")
+
+	var serverState string
+	err = runStep(ctx, cfg, observer, StepRecoverLockbox, func(ctx context.Context) (err error) {
+		serverState, _, err = RecoverLockboxWithClientID(ctx, cfg, accessToken, http.StatusAccepted, "")
+		return err
+	})
 	if err != nil {
-		myLogger.Printf("getLicenseForDA->RecoverLockboxWithClientID for user %s: %v . . . attempting to create Lockbox", username, err)
+		// a flow cancelled on shutdown must not go on to create a lockbox
+		if ctx.Err() != nil {
+			return "", err
+		}
+		cfg.logger().InfoContext(ctx, "getLicenseForDA: lockbox could not be recovered, attempting to create it")
 		// lockbox does not exist, attempt to create it
-		serverState, err = CreateLockboxWithOptionalRecoveryData(accessToken, false)
+		cfg.Metrics.lockboxCreateFallback()
+		err = runStep(ctx, cfg, observer, StepCreateLockbox, func(ctx context.Context) (err error) {
+			serverState, err = CreateLockboxWithOptionalRecoveryData(ctx, cfg, accessToken, false)
+			return err
+		})
 		if err != nil {
-			myLogger.Printf("getLicenseForDA->CreateLockboxWithOptionalRecoveryData for user %s: %v", username, err)
 			return "", err
 		}
 	}
 
-	assets := []string{"vme://assets/foundationalIdentity"}
-	serverState, daMap, err := CreateDA(accessToken, serverState, assets)
+	assets := cfg.assetTypes()
+	var daMap map[string]CreateDigitalAssetRespBody
+	err = runStep(ctx, cfg, observer, StepCreateDA, func(ctx context.Context) (err error) {
+		serverState, daMap, err = CreateDA(ctx, cfg, accessToken, serverState, assets)
+		return err
+	})
 	if err != nil {
-		myLogger.Printf("getLicenseForDA->CreateDA for user %s: %v", username, err)
 		return "", err
 	}
 
-	serverState, _, err = RetrieveLicenseRequest(accessToken, serverState, licenseRequestID, requestEncKey, http.StatusAccepted)
+	err = runStep(ctx, cfg, observer, StepRetrieveLicenseRequest, func(ctx context.Context) (err error) {
+		serverState, _, err = RetrieveLicenseRequest(ctx, cfg, accessToken, serverState, licenseRequestID, requestEncKey, http.StatusAccepted)
+		return err
+	})
 	if err != nil {
-		myLogger.Printf("getLicenseForDA->RetrieveLicenseRequest for user %s: %v", username, err)
 		return "", err
 	}
 
-	issueLicenseResp, err := IssueLicense(accessToken, serverState, licenseRequestID, daMap)
+	var issueLicenseResp *IssueLicenseResp
+	err = runStep(ctx, cfg, observer, StepIssueLicense, func(ctx context.Context) (err error) {
+		issueLicenseResp, err = IssueLicense(ctx, cfg, accessToken, serverState, licenseRequestID, daMap)
+		return err
+	})
 	if err != nil {
-		myLogger.Printf("getLicenseForDA->IssueLicense for user %s: %v", username, err)
 		return "", err
 	}
 	return issueLicenseResp.Body.License, nil
@@ -89,7 +307,34 @@ func (t *GmlServer) processGetMethod(w http.ResponseWriter) {
   <form id="gml" action="/ui" method="post">
   <textarea name="JSON" id="JSON" placeholder='{"username": "", "password": "", "requestId": "", "requestEncKey": ""}' spellcheck="false" rows="20" form="gml"></textarea>
   <input type="submit" value="Send Request<"/>
+  <input type="button" value="Send Request (live)" onclick="live()"/>
   </form>
+  <pre id="events"></pre>
+  <script>
+  function live() {
+    var out = document.getElementById("events");
+    out.textContent = "";
+    fetch("/v1/license-jobs", {method: "POST", body: document.getElementById("JSON").value})
+      .then(function(resp) { return resp.json(); })
+      .then(function(job) {
+        if (!job.id) {
+          out.textContent = JSON.stringify(job, null, 2);
+          return;
+        }
+        var source = new EventSource("/v1/license-jobs/" + job.id + "/events");
+        source.addEventListener("step", function(e) {
+          var step = JSON.parse(e.data);
+          out.textContent += step.startedAt + " " + step.step + " " + step.outcome +
+            (step.outcome == "started" ? "" : " in " + (step.durationMs || 0) + "ms") +
+            (step.upstreamStatus ? " (upstream status " + step.upstreamStatus + ")" : "") + "\n";
+        });
+        source.addEventListener("done", function(e) {
+          source.close();
+          out.textContent += JSON.stringify(JSON.parse(e.data), null, 2);
+        });
+      });
+  }
+  </script>
   <html>
   `
 	fmt.Fprintf(w, "%s", page)
@@ -98,7 +343,7 @@ func (t *GmlServer) processGetMethod(w http.ResponseWriter) {
 func (t *GmlServer) processPostMethod(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		myLogger.Printf("processPostMethod: error parsing form")
+		t.logger().WarnContext(r.Context(), "processPostMethod: error parsing form", "err", err)
 		t.writeResponse(w, &ErrorStruct500{Message: "error parsing form" + err.Error()}, http.StatusInternalServerError)
 		return
 	}
@@ -106,15 +351,19 @@ func (t *GmlServer) processPostMethod(w http.ResponseWriter, r *http.Request) {
 	expectedBody := new(GmlReqBody)
 	err = json.Unmarshal([]byte(r.Form.Get("JSON")), &expectedBody)
 	if err != nil {
-		myLogger.Printf("processPostMethod: could not unmarshal into the structure we were expecting :: %v", err)
+		t.logger().WarnContext(r.Context(), "processPostMethod: could not unmarshal into the structure we were expecting", "err", err)
 		t.writeResponse(w, &ErrorStruct500{Message: err.Error()}, http.StatusInternalServerError)
 		return
 	}
+	envs, ok := t.resolveEnvironments(w, r, expectedBody)
+	if !ok || !t.resolveProfiles(w, r, envs, expectedBody) || t.usersRateLimited(w, r, expectedBody.Username) {
+		return
+	}
 
-	license, err := getLicenseForDA(expectedBody.Username, expectedBody.Password, expectedBody.RequestID, expectedBody.RequestEncKey)
+	license, err := getLicenseForDA(envs[0].flowContext(r.Context()), envs[0].config, expectedBody.Username, expectedBody.Password, expectedBody.RequestID, expectedBody.RequestEncKey, nil)
 
 	if err != nil {
-		myLogger.Printf("processPostMethod->getLicenseForDA : %v", err)
+		t.logger().ErrorContext(r.Context(), "processPostMethod->getLicenseForDA", "err", err)
 		t.writeResponse(w, &ErrorStruct500{Message: err.Error()}, http.StatusInternalServerError)
 		return
 	}
@@ -151,25 +400,41 @@ func (t *GmlServer) writeResponse(w http.ResponseWriter, response interface{}, c
 
 }
 
+// swagger:route POST /gml licenses legacyLicense
+//
+// Get a DA license for a MyAM user, answering every failure with a 500.
+//
+// Kept for existing callers, use POST /v1/licenses instead.
+//
+// responses:
+//
+//	200: licenseResponse
+//	400: errorResponse
+//	429: errorResponse
+//	500: legacyErrorResponse
 func (t *GmlServer) gmlHandler(w http.ResponseWriter, r *http.Request) {
 
 	request, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		myLogger.Printf("could not read request body :: %v", err)
+		t.logger().WarnContext(r.Context(), "could not read request body", "err", err)
 		t.writeResponse(w, &ErrorStruct500{Message: err.Error()}, http.StatusInternalServerError)
 		return
 	}
 	expectedBody := new(GmlReqBody)
 	err = json.Unmarshal(request, &expectedBody)
 	if err != nil {
-		myLogger.Printf("handler recieved unexpected body: could not unmarshal into the structure we were expecting :: %v", err)
+		t.logger().WarnContext(r.Context(), "handler recieved unexpected body: could not unmarshal into the structure we were expecting", "err", err)
 		t.writeResponse(w, &ErrorStruct500{Message: err.Error()}, http.StatusInternalServerError)
 		return
 	}
+	envs, ok := t.resolveEnvironments(w, r, expectedBody)
+	if !ok || !t.resolveProfiles(w, r, envs, expectedBody) || t.usersRateLimited(w, r, expectedBody.Username) {
+		return
+	}
 
-	license, err := getLicenseForDA(expectedBody.Username, expectedBody.Password, expectedBody.RequestID, expectedBody.RequestEncKey)
+	license, err := getLicenseForDA(envs[0].flowContext(r.Context()), envs[0].config, expectedBody.Username, expectedBody.Password, expectedBody.RequestID, expectedBody.RequestEncKey, nil)
 	if err != nil {
-		myLogger.Printf("getLicenseForDA: %v", err)
+		t.logger().ErrorContext(r.Context(), "getLicenseForDA", "err", err)
 		t.writeResponse(w, &ErrorStruct500{Message: err.Error()}, http.StatusInternalServerError)
 		return
 	}
@@ -180,51 +445,130 @@ func (t *GmlServer) gmlHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (t *GmlServer) Start() (server *http.Server, err error) {
-	server = &http.Server{Addr: t.Port}
+	server = &http.Server{
+		Addr:    t.Port,
+		Handler: t.Handler(),
+		// requests inherit flowCtx so Close can cancel the flows they run
+		BaseContext: func(net.Listener) context.Context { return t.flowCtx },
+		TLSConfig:   t.tlsConfig,
+	}
+	t.mu.Lock()
+	t.server = server
+	t.mu.Unlock()
 
-	http.HandleFunc("/"+t.UIPath, t.uiHandler)
-	http.HandleFunc("/gml", t.gmlHandler)
 	err = t.startServer(server)
-	if err != nil {
-		myLogger.Printf("Error starting server: %s", err)
+	if err != nil && err != http.ErrServerClosed {
+		t.logger().Error("Error starting server", "err", err)
 		return nil, err
 	}
 	return server, nil
 }
 
+func (t *GmlServer) routes() {
+	t.mux.HandleFunc("/"+t.UIPath, t.limitCaller(t.uiHandler))
+	t.mux.HandleFunc("/gml", t.limitCaller(t.gmlHandler))
+	t.mux.HandleFunc("/v1/licenses", t.limitCaller(t.captureFlows(t.licensesHandler)))
+	t.mux.HandleFunc(environmentsPathPrefix, t.environmentsHandler)
+	t.mux.HandleFunc(licenseBatchPath, t.limitCaller(t.captureFlows(t.licenseBatchHandler)))
+	t.mux.HandleFunc(licenseJobsPath, t.limitCaller(t.captureFlows(t.licenseJobsHandler)))
+	t.mux.HandleFunc(licenseJobsPath+"/", t.licenseJobsHandler)
+	t.mux.HandleFunc(healthzPath, t.healthzHandler)
+	t.mux.HandleFunc(readyzPath, t.readyzHandler)
+	t.mux.HandleFunc(metricsPath, t.metricsHandler)
+	t.mux.HandleFunc(loggingPath, t.adminOnly(t.loggingHandler))
+	t.mux.HandleFunc(profilesPath, t.adminOnly(t.profilesHandler))
+	t.mux.HandleFunc(capturesPath+"/", t.adminOnly(t.capturesHandler))
+	t.mux.HandleFunc("/openapi.json", t.openAPIHandler)
+	t.mux.HandleFunc("/docs", t.apiExplorerHandler)
+}
+
+// Handler returns the server's own router, wrapped so it answers 503 while draining, tags each request
+// with an ID, continues the caller's trace and authenticates the caller
+func (t *GmlServer) Handler() http.Handler {
+	return requestIDHandler(traceContextHandler(t.drainHandler(t.apiAuthHandler(t.metrics.instrument(t.mux)))))
+}
+
+// drainHandler answers every request with a 503 once Close has been called
+func (t *GmlServer) drainHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-t.draining:
+			w.Header().Set("Connection", "close")
+			t.writeError(w, http.StatusServiceUnavailable, &ErrorResp{Code: ErrCodeUnavailable, Message: "server is shutting down"})
+			return
+		default:
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (t *GmlServer) startServer(server *http.Server) error {
-	var certFile string
-	var keyFile string
 	var err error
-	if viper.GetBool("http.tls.enabled") {
-		certFile = viper.GetString("http.tls.cert.file")
-		keyFile = viper.GetString("http.tls.key.file")
-		err = server.ListenAndServeTLS(certFile, keyFile)
-	} else {
-		//use your own listener so we can close the server when we want!
-		t.listener, err = net.Listen("tcp", fmt.Sprintf("%s", t.Port))
-		if err != nil {
-			myLogger.Printf("%s\n", t.ServerAddress)
-			myLogger.Fatalf("startup error: %v", err.Error())
-		}
-		err = server.Serve(t.listener)
+	//use your own listener so we can close the server when we want!
+	t.listener, err = net.Listen("tcp", t.Port)
+	if err != nil {
+		t.logger().Error("could not listen", "address", t.Port, "err", err)
+		return fmt.Errorf("startup error: %v", err)
 	}
-	return err
+	if t.viper.GetBool(HTTP_TLS_ENABLED) {
+		certFile := t.viper.GetString(HTTP_TLS_CERT_FILE)
+		keyFile := t.viper.GetString(HTTP_TLS_KEY_FILE)
+		return server.ServeTLS(t.listener, certFile, keyFile)
+	}
+	return server.Serve(t.listener)
 }
 
+// Close drains the server: new requests get a 503, in-flight requests and license jobs
+// are given ShutdownTimeout to finish, after which their flows are cancelled. Close before Start does nothing.
 func (t *GmlServer) Close() error {
-	if t.listener == nil {
+	t.mu.Lock()
+	server := t.server
+	t.mu.Unlock()
+	if server == nil {
 		return nil
 	}
-	err := t.listener.Close()
+
+	t.closeOnce.Do(func() { close(t.draining) })
+	defer t.shutdownTracing()
+	defer t.cancelFlows()
+
+	t.logger().Info("draining in-flight license flows", "timeout", t.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), t.ShutdownTimeout)
+	defer cancel()
+	if t.ShutdownDelay > 0 {
+		sleepContext(ctx, t.ShutdownDelay)
+	}
+	err := server.Shutdown(ctx)
+	if err == nil {
+		err = t.jobs.wait(ctx)
+	}
 	if err != nil {
-		return err
+		t.logger().Warn("drain did not complete, cancelling in-flight license flows", "err", err)
+		t.cancelFlows()
+		// give cancelled handlers a moment to answer before connections are cut
+		graceCtx, graceCancel := context.WithTimeout(context.Background(), cancelGracePeriod)
+		defer graceCancel()
+		if server.Shutdown(graceCtx) != nil {
+			server.Close()
+		}
+	}
+	return err
+}
+
+// shutdownTracing flushes the spans still batched for export
+func (t *GmlServer) shutdownTracing() {
+	if t.tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+	if err := t.tracerProvider.Shutdown(ctx); err != nil {
+		t.logger().Warn("failed to flush spans", "err", err)
 	}
-	return nil
 }
 
-func (t *GmlServer) setupViper(cfgFile string) error {
-	v := viper.GetViper()
+// setupViper loads cfgFile into v, expanding environment variables in it
+func setupViper(v *viper.Viper, cfgFile string) error {
 	var err error
 	var data []byte
 	confType := "yaml"
@@ -270,24 +614,100 @@ func (t *GmlServer) setupViper(cfgFile string) error {
 }
 
 func (t *GmlServer) initConfig(cfgFile string) error {
-	err := t.setupViper(cfgFile)
+	err := setupViper(t.viper, cfgFile)
 	if err != nil {
 		return fmt.Errorf("failed to set up viper using config file and environmental variables %v", err)
 	}
 
-	t.ServerAddress = viper.GetString(SERVER_ADDRESS)
-	t.Port = viper.GetString(SERVER_PORT)
-	t.UIPath = viper.GetString(SERVER_UI_PATH)
-	t.SimServerURL = viper.GetString(SIMSERVER_URL)
-	t.MyamURL = viper.GetString(MYAM_URL)
-
-	Config.CorrectProviderURL = t.MyamURL + "/myam/oidc"
-	Config.CorrectAudience = t.MyamURL + "/myam/oidc/token"
-	Config.MyBankBaseURL = t.SimServerURL + "/my-bank"
-	Config.UILocales = "en"
-	Config.SimServerURL = t.SimServerURL
+	t.ServerAddress = t.viper.GetString(SERVER_ADDRESS)
+	t.Port = t.viper.GetString(SERVER_PORT)
+	t.UIPath = t.viper.GetString(SERVER_UI_PATH)
+	t.SimServerURL = t.viper.GetString(SIMSERVER_URL)
+	t.MyamURL = t.viper.GetString(MYAM_URL)
+	t.ShutdownTimeout = t.viper.GetDuration(SHUTDOWN_TIMEOUT)
+	if t.ShutdownTimeout <= 0 {
+		t.ShutdownTimeout = defaultShutdownTimeout
+	}
+	t.ShutdownDelay = t.viper.GetDuration(SHUTDOWN_DELAY)
+	t.flowCtx, t.cancelFlows = context.WithCancel(context.Background())
+	t.draining = make(chan struct{})
+	t.BatchConcurrency = t.viper.GetInt(BATCH_CONCURRENCY)
+	if t.BatchConcurrency <= 0 {
+		t.BatchConcurrency = defaultBatchConcurrency
+	}
+	t.BatchMaxItems = t.viper.GetInt(BATCH_MAX_ITEMS)
+	if t.BatchMaxItems <= 0 {
+		t.BatchMaxItems = defaultBatchMaxItems
+	}
+	t.userLocks = newUserLocks()
+	t.tlsConfig, err = serverTLSConfig(t.viper.GetString(HTTP_TLS_CLIENT_CA_FILE), t.viper.GetStringSlice(HTTP_TLS_CLIENT_SUBJECTS))
+	if err != nil {
+		return err
+	}
+	if t.tlsConfig != nil && !t.viper.GetBool(HTTP_TLS_ENABLED) {
+		return fmt.Errorf("%s needs %s", HTTP_TLS_CLIENT_CA_FILE, HTTP_TLS_ENABLED)
+	}
+	// logging and tracing are shared by the flows of every environment
+	shared := new(Configuration)
+	shared.Logging = new(Logging)
+	if level := t.viper.GetString(LOG_LEVEL); level != "" {
+		err = shared.Logging.Level.UnmarshalText([]byte(level))
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", LOG_LEVEL, err)
+		}
+	}
+	shared.Logging.SetLogBodies(t.viper.GetBool(LOG_BODIES))
+	if keyFile := t.viper.GetString(LOG_USER_HASH_KEY_FILE); keyFile != "" {
+		key, err := readUserHashKey(keyFile)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", LOG_USER_HASH_KEY_FILE, err)
+		}
+		shared.Logging.SetUserHashKey(key)
+	}
+	shared.Logger, err = NewLogger(os.Stderr, t.viper.GetString(LOG_FORMAT), shared.Logging)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", LOG_FORMAT, err)
+	}
+	t.tracerProvider, err = newTracerProvider(t.flowCtx, t.viper.GetString(TRACING_EXPORTER), t.viper.GetString(TRACING_OTLP_ENDPOINT),
+		t.viper.GetBool(TRACING_OTLP_INSECURE), t.viper.GetString(TRACING_SERVICE_NAME))
+	if err != nil {
+		return err
+	}
+	if t.tracerProvider != nil {
+		shared.TracerProvider = t.tracerProvider
+	}
+	t.apiAuth, err = newAPIAuth(t.viper)
+	if err != nil {
+		return err
+	}
+	if t.apiAuth.enabled {
+		reloadInterval := t.viper.GetDuration(AUTH_RELOAD_INTERVAL)
+		if reloadInterval <= 0 {
+			reloadInterval = defaultAuthReloadInterval
+		}
+		go t.watchAPICredentials(t.flowCtx, cfgFile, reloadInterval)
+	}
+	t.callerLimiter = newKeyedLimiter(t.viper.GetFloat64(RATELIMIT_CALLER_RATE), t.viper.GetInt(RATELIMIT_CALLER_BURST))
+	t.userLimiter = newKeyedLimiter(t.viper.GetFloat64(RATELIMIT_USER_RATE), t.viper.GetInt(RATELIMIT_USER_BURST))
+	registry := newMetricsRegistry()
+	t.metrics = newServerMetrics(registry)
+	cassette, err := loadCassette(t.viper)
+	if err != nil {
+		return err
+	}
+	err = t.initEnvironments(shared, registry, cassette)
+	if err != nil {
+		return err
+	}
+	t.config = t.environments[DefaultEnvironment].config
+	t.metricsExporter = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	t.captures, err = newCaptureStore(t.viper.GetString(CAPTURE_MODE), t.viper.GetDuration(CAPTURE_TTL), t.viper.GetInt(CAPTURE_MAX))
+	if err != nil {
+		return err
+	}
+	t.jobs = newJobStore(t.flowCtx, t.viper.GetInt(JOBS_WORKERS), t.viper.GetDuration(JOBS_TTL))
 
-	myLogger.Printf("simulator Web UI is up on: " + t.ServerAddress + "/" + t.UIPath)
-	myLogger.Printf("config initialization has completed.")
+	t.logger().Info("simulator Web UI is up", "url", t.ServerAddress+"/"+t.UIPath)
+	t.logger().Info("config initialization has completed.", "environments", t.environmentNames())
 	return nil
 }
@@ -0,0 +1,78 @@
+package gmlserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newShutdownUpstream plays the simulator server and MyAM through the auth step, then fails recoverLockbox after
+// calling cancel, as Close does once the drain timeout is reached
+func newShutdownUpstream(t *testing.T, cancel context.CancelFunc) *httptest.Server {
+	server := httptest.NewServer(nil)
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + requestObjectRequestMethod:
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]string{"loginurl": server.URL + "/myam/oidc/authorize?client_id=myClientID"})
+		case "/myam/oidc/authorize", "/myam/oidc/authenticate", "/myam/oidc/login":
+			w.WriteHeader(http.StatusOK)
+		case "/myam/oidc/consent":
+			http.Redirect(w, r, "/callback?code=authcode", http.StatusFound)
+		case "/" + accessTokenRequestMethod:
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]string{"accesstoken": "token"})
+		case "/" + strings.ToLower(RequestMethodRecoverLockbox):
+			cancel()
+			http.Error(w, "lockbox not found", http.StatusNotFound)
+		default:
+			http.Error(w, "unexpected call", http.StatusInternalServerError)
+		}
+	})
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCancelledFlowDoesNotCreateLockbox(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := newShutdownUpstream(t, cancel)
+	cfg := NewConfiguration(upstream.URL, upstream.URL)
+	cfg.Retry = nil
+	cfg.RecoverLockboxDelay = 0
+	cfg.Logger = quietLogger
+
+	var steps []string
+	_, err := getLicenseForDA(ctx, cfg, "alice", "secret", "request-id", "enc-key", func(event StepEvent) {
+		steps = append(steps, event.Step)
+	})
+	var flowErr *FlowError
+	if !errors.As(err, &flowErr) || flowErr.Step != StepRecoverLockbox {
+		t.Fatalf("getLicenseForDA error = %v, want a failure of the recoverLockbox step", err)
+	}
+	for _, step := range steps {
+		if step == StepCreateLockbox {
+			t.Errorf("steps = %v, want no %s once the flow is cancelled", steps, StepCreateLockbox)
+		}
+	}
+}
+
+func TestCloseBeforeStart(t *testing.T) {
+	server := newTestServer(t, newAuthUpstream(t), nil)
+
+	if err := server.Close(); err != nil {
+		t.Fatalf("Close = %v, want nil", err)
+	}
+	select {
+	case <-server.draining:
+		t.Error("Close before Start left the server draining")
+	default:
+	}
+	if err := server.flowCtx.Err(); err != nil {
+		t.Errorf("Close before Start cancelled the flows: %v", err)
+	}
+}
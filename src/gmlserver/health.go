@@ -0,0 +1,240 @@
+package gmlserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+
+	DependencySimServer = "simserver"
+	DependencyMyAM      = "myam"
+
+	DependencyUp   = "up"
+	DependencyDown = "down"
+
+	defaultHealthCacheTTL = 5 * time.Second
+	defaultHealthTimeout  = 5 * time.Second
+)
+
+// readiness probes the upstream dependencies, keeping the result for cacheTTL so frequent
+// probes from a load balancer don't all reach the simulator server and MyAM
+type readiness struct {
+	// environment is the name of the environment whose dependencies are probed
+	environment  string
+	config       *Configuration
+	simServerURL string
+	myamURL      string
+	cacheTTL     time.Duration
+	timeout      time.Duration
+	// simServer and myamClient send the probes, the flow's SimServer and MyAMClient unless set
+	simServer  SimServerClient
+	myamClient *http.Client
+	// replaying reports the dependencies up without probing them, a replayed cassette answers for them
+	replaying bool
+
+	mu     sync.Mutex
+	result *ReadinessResp
+}
+
+func newReadiness(config *Configuration, simServerURL, myamURL string, cacheTTL, timeout time.Duration) *readiness {
+	if cacheTTL < 0 {
+		cacheTTL = defaultHealthCacheTTL
+	}
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+	return &readiness{config: config, simServerURL: simServerURL, myamURL: myamURL, cacheTTL: cacheTTL, timeout: timeout}
+}
+
+// check returns the cached result if it is fresh, otherwise probes every dependency at once.
+// Concurrent callers wait for the probe in progress rather than starting their own.
+func (r *readiness) check(ctx context.Context) *ReadinessResp {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.result != nil && time.Since(r.result.Body.CheckedAt) < r.cacheTTL {
+		return r.result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	probes := map[string]func(context.Context) DependencyStatus{
+		DependencySimServer: r.probeSimServer,
+		DependencyMyAM:      r.probeMyAM,
+	}
+	result := new(ReadinessResp)
+	result.Body.Status = "ready"
+	result.Body.Environment = r.environment
+	result.Body.Dependencies = make(map[string]DependencyStatus, len(probes))
+	result.Body.CheckedAt = time.Now()
+	if r.replaying {
+		result.Body.Dependencies[DependencySimServer] = DependencyStatus{Status: DependencyUp, URL: r.simServerURL}
+		result.Body.Dependencies[DependencyMyAM] = DependencyStatus{Status: DependencyUp, URL: r.myamURL}
+		r.result = result
+		return result
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, probe := range probes {
+		wg.Add(1)
+		go func(name string, probe func(context.Context) DependencyStatus) {
+			defer wg.Done()
+			status := probe(ctx)
+			mu.Lock()
+			defer mu.Unlock()
+			result.Body.Dependencies[name] = status
+			if status.Status != DependencyUp {
+				result.Body.Status = "not_ready"
+			}
+		}(name, probe)
+	}
+	wg.Wait()
+
+	// a cancelled caller says nothing about the dependencies, don't keep its result
+	if ctx.Err() != context.Canceled {
+		r.result = result
+	}
+	return result
+}
+
+// withBreaker probes url unless breaker is open, reporting the breaker's state either way. While the breaker
+// is open the flows fail fast, so the dependency counts as down and is left alone until probes are let through.
+func withBreaker(breaker *CircuitBreaker, url string, probe func() DependencyStatus) DependencyStatus {
+	state := breaker.State()
+	if state == CircuitOpen {
+		return DependencyStatus{Status: DependencyDown, URL: url, Circuit: state, Error: ErrCircuitOpen.Error()}
+	}
+	status := probe()
+	status.Circuit = state
+	return status
+}
+
+// probeSimServer sends an empty requestobject call through the flow's SimServer, any answer short of a 5xx
+// means the simulator server is serving
+func (r *readiness) probeSimServer(ctx context.Context) DependencyStatus {
+	url := r.simServerURL + "/" + requestObjectRequestMethod
+	return withBreaker(r.config.SimServerBreaker, url, func() DependencyStatus {
+		status := DependencyStatus{Status: DependencyDown, URL: url}
+		start := time.Now()
+		simServer := r.simServer
+		if simServer == nil {
+			simServer = r.config.SimServer
+		}
+		err := simServer.Call(ctx, requestObjectRequestMethod, "{}", http.StatusAccepted, nil)
+		status.LatencyMs = time.Since(start).Milliseconds()
+		var upstreamErr *UpstreamError
+		switch {
+		case err == nil:
+			status.HTTPStatus = http.StatusAccepted
+		case errors.As(err, &upstreamErr) && upstreamErr.StatusCode != 0:
+			status.HTTPStatus = upstreamErr.StatusCode
+		default:
+			status.Error = err.Error()
+			return status
+		}
+		if status.HTTPStatus >= http.StatusInternalServerError {
+			status.Error = fmt.Sprintf("answered %d %s", status.HTTPStatus, http.StatusText(status.HTTPStatus))
+			return status
+		}
+		status.Status = DependencyUp
+		return status
+	})
+}
+
+// probeMyAM loads the OIDC authorize endpoint the flow starts with, without parameters MyAM rejects the request
+// but answering it shows it is reachable
+func (r *readiness) probeMyAM(ctx context.Context) DependencyStatus {
+	url := r.myamURL + "/myam/oidc/authorize"
+	client := r.myamClient
+	if client == nil {
+		client = r.config.MyAMClient
+	}
+	return withBreaker(r.config.MyAMBreaker, url, func() DependencyStatus { return probe(ctx, client, url) })
+}
+
+func probe(ctx context.Context, client *http.Client, url string) DependencyStatus {
+	status := DependencyStatus{Status: DependencyDown, URL: url}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	setRequestIDHeader(req)
+
+	// don't follow MyAM's redirects, the first answer is enough
+	probeClient := *client
+	probeClient.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	start := time.Now()
+	resp, err := probeClient.Do(req)
+	status.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	status.HTTPStatus = resp.StatusCode
+	if resp.StatusCode >= http.StatusInternalServerError {
+		status.Error = fmt.Sprintf("answered %s", resp.Status)
+		return status
+	}
+	status.Status = DependencyUp
+	return status
+}
+
+// healthzHandler serves GET /healthz
+//
+// swagger:route GET /healthz health getHealth
+//
+// Check GML is alive.
+//
+// Answers as long as the process serves requests, without checking any dependency.
+//
+// responses:
+//
+//	200: healthResponse
+func (t *GmlServer) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	t.writeResponse(w, map[string]string{"status": "ok"}, http.StatusOK)
+}
+
+// readyzHandler serves GET /readyz
+//
+// swagger:route GET /readyz health getReadiness
+//
+// Check GML can get licenses.
+//
+// Probes the simulator server and MyAM of the default environment, or of the environment named by the
+// environment query parameter, and reports the status, latency and circuit breaker state of each.
+// A dependency whose circuit breaker is open is down without being probed. Results are cached for
+// health.cache.ttl. Answers 503 if any dependency is down, 404 for an environment that is not configured.
+// The probes bypass the cassette, while one is replayed the dependencies are up without being probed.
+//
+// responses:
+//
+//	200: readinessResponse
+//	404: errorResponse
+//	503: readinessResponse
+func (t *GmlServer) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	env, ok := t.queryEnvironment(w, r)
+	if !ok {
+		return
+	}
+	result := env.readiness.check(r.Context())
+	code := http.StatusOK
+	if result.Body.Status != "ready" {
+		t.logger().WarnContext(r.Context(), "readyzHandler: not ready", "environment", env.name, "dependencies", result.Body.Dependencies)
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	t.writeResponse(w, &result.Body, code)
+}
@@ -0,0 +1,153 @@
+package gmlserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// probedSimServer answers every call with status, once release is closed if it is set
+type probedSimServer struct {
+	status  int
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (p *probedSimServer) Call(ctx context.Context, method string, req interface{}, expectedStatus int, resp interface{}) error {
+	p.calls.Add(1)
+	if p.release != nil {
+		select {
+		case <-p.release:
+		case <-ctx.Done():
+			return &UpstreamError{Method: method, ExpectedStatus: expectedStatus, Err: ctx.Err()}
+		}
+	}
+	if p.status == expectedStatus {
+		return nil
+	}
+	return &UpstreamError{Method: method, StatusCode: p.status, ExpectedStatus: expectedStatus}
+}
+
+// newProbedReadiness returns the readiness of sim and a MyAM answering 400, as it does to a bare authorize
+func newProbedReadiness(t *testing.T, sim *probedSimServer, cacheTTL time.Duration) *readiness {
+	t.Helper()
+	myam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	t.Cleanup(myam.Close)
+	cfg := NewConfiguration("http://simserver.invalid", myam.URL)
+	cfg.SimServer = sim
+	return newReadiness(cfg, "http://simserver.invalid", myam.URL, cacheTTL, time.Second)
+}
+
+func TestReadinessCache(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		cacheTTL time.Duration
+		calls    int32
+	}{
+		{"cached", time.Hour, 1},
+		{"not cached", 0, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sim := &probedSimServer{status: http.StatusBadRequest}
+			r := newProbedReadiness(t, sim, tc.cacheTTL)
+			for i := 0; i < 3; i++ {
+				if result := r.check(context.Background()); result.Body.Status != "ready" {
+					t.Fatalf("status = %s, want ready: %+v", result.Body.Status, result.Body.Dependencies)
+				}
+			}
+			if calls := sim.calls.Load(); calls != tc.calls {
+				t.Errorf("simserver probed %d times, want %d", calls, tc.calls)
+			}
+		})
+	}
+}
+
+func TestReadinessCoalescesConcurrentChecks(t *testing.T) {
+	sim := &probedSimServer{status: http.StatusBadRequest, release: make(chan struct{})}
+	r := newProbedReadiness(t, sim, time.Hour)
+
+	const callers = 5
+	results := make([]*ReadinessResp, callers)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = r.check(context.Background())
+		}(i)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for sim.calls.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("simserver never probed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// give the other callers time to queue up behind the probe in progress
+	time.Sleep(20 * time.Millisecond)
+	close(sim.release)
+	wg.Wait()
+
+	if calls := sim.calls.Load(); calls != 1 {
+		t.Errorf("simserver probed %d times by %d concurrent callers, want once", calls, callers)
+	}
+	for i, result := range results {
+		if result != results[0] {
+			t.Errorf("caller %d got result %+v, want the shared %+v", i, result.Body, results[0].Body)
+		}
+	}
+}
+
+func TestReadinessDoesNotCacheCancelledCheck(t *testing.T) {
+	sim := &probedSimServer{status: http.StatusBadRequest, release: make(chan struct{})}
+	r := newProbedReadiness(t, sim, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if result := r.check(ctx); result.Body.Status != "not_ready" {
+		t.Errorf("status of a cancelled check = %s, want not_ready", result.Body.Status)
+	}
+
+	close(sim.release)
+	if result := r.check(context.Background()); result.Body.Status != "ready" {
+		t.Errorf("status after a cancelled check = %s, want ready: %+v", result.Body.Status, result.Body.Dependencies)
+	}
+	if calls := sim.calls.Load(); calls != 2 {
+		t.Errorf("simserver probed %d times, want the cancelled check's result thrown away and probed again", calls)
+	}
+}
+
+func TestReadyzStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		simStatus int
+		code      int
+		status    string
+	}{
+		// any answer short of a 5xx means the simulator server is serving
+		{"simserver rejects the empty call", http.StatusBadRequest, http.StatusOK, DependencyUp},
+		{"simserver fails", http.StatusServiceUnavailable, http.StatusServiceUnavailable, DependencyDown},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newProbedReadiness(t, &probedSimServer{status: tc.simStatus}, 0)
+			server := &GmlServer{environments: map[string]*environment{
+				DefaultEnvironment: {name: DefaultEnvironment, config: r.config, readiness: r},
+			}}
+			server.config = &Configuration{Logger: quietLogger}
+			rec := httptest.NewRecorder()
+			server.readyzHandler(rec, httptest.NewRequest(http.MethodGet, readyzPath, nil))
+			if rec.Code != tc.code {
+				t.Errorf("GET %s = %d, want %d: %s", readyzPath, rec.Code, tc.code, rec.Body)
+			}
+			if dep := r.check(context.Background()).Body.Dependencies[DependencySimServer]; dep.Status != tc.status || dep.HTTPStatus != tc.simStatus {
+				t.Errorf("simserver = %+v, want %s with %d", dep, tc.status, tc.simStatus)
+			}
+		})
+	}
+}
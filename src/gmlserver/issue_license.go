@@ -1,11 +1,13 @@
 package gmlserver
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"path"
 )
 
-func IssueLicense(accessToken string, state string, licenseRequestID string, daMap map[string]CreateDigitalAssetRespBody) (*IssueLicenseResp, error) {
+func IssueLicense(ctx context.Context, cfg *Configuration, accessToken string, state string, licenseRequestID string, daMap map[string]CreateDigitalAssetRespBody) (*IssueLicenseResp, error) {
 
 	if accessToken == "" || state == "" {
 		return nil, fmt.Errorf("IssueLicense -> cannot issue license, must call createLockbox first")
@@ -26,7 +28,7 @@ func IssueLicense(accessToken string, state string, licenseRequestID string, daM
 	issueLicensePayload := &IssueLicenseReqBody{
 		AccessToken:       accessToken,
 		ServerState:       state,
-		Endpoint:          Config.MyBankBaseURL,
+		Endpoint:          cfg.MyBankBaseURL,
 		LicenseRequestID:  licenseRequestID,
 		EncryptWholeAsset: true,
 		DoNotNotifyDAC:    true,
@@ -34,17 +36,21 @@ func IssueLicense(accessToken string, state string, licenseRequestID string, daM
 
 	issueLicenseReq := new(IssueLicenseReq)
 	issueLicenseReq.Body.IssueLicenseBody = issueLicensePayload
+	// the DAC queries the assets as asset1, asset2... in the order they were created,
+	// ie. vme://assets/foundationalIdentity is matched as foundationalIdentityName
 	matchedAssets := make(map[string]AssetQueryEntry)
-	matchedAssets["foundationalIdentityName"] = AssetQueryEntry{
-		AssetSeqNo:     1,
-		DigitalAssetID: daMap["vme://assets/foundationalIdentity"].DigitalAssetID,
-		Name:           "asset1",
+	for i, assetType := range cfg.assetTypes() {
+		matchedAssets[path.Base(assetType)+"Name"] = AssetQueryEntry{
+			AssetSeqNo:     1,
+			DigitalAssetID: daMap[assetType].DigitalAssetID,
+			Name:           fmt.Sprintf("asset%d", i+1),
+		}
 	}
 	issueLicenseReq.Body.MatchedAssets = matchedAssets
 	var expected = new(IssueLicenseResp)
-	err = SendRequestAndCheckResponse(EndpointIssueLicense, issueLicenseReq.Body, http.StatusAccepted, &expected.Body)
+	err = SendRequestAndCheckResponse(ctx, cfg, EndpointIssueLicense, issueLicenseReq.Body, http.StatusAccepted, &expected.Body)
 	if err != nil {
-		return nil, fmt.Errorf("%v", err)
+		return nil, fmt.Errorf("%w", err)
 	}
 	return expected, nil
 
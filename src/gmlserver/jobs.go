@@ -0,0 +1,261 @@
+package gmlserver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+
+	defaultJobWorkers = 8
+	defaultJobTTL     = time.Hour
+	licenseJobsPath   = "/v1/license-jobs"
+)
+
+// jobStore keeps asynchronous license jobs in memory until their ttl expires
+type jobStore struct {
+	mu      sync.Mutex
+	jobs    map[string]*jobEntry
+	ttl     time.Duration
+	workers chan struct{}
+	// ctx is the parent of every job's license flow
+	ctx     context.Context
+	running sync.WaitGroup
+}
+
+type jobEntry struct {
+	job    LicenseJob
+	events []StepEvent
+	// changed is closed and replaced every time the job or its events change
+	changed chan struct{}
+}
+
+func (j *LicenseJob) finished() bool {
+	return j.Status == JobStatusSucceeded || j.Status == JobStatusFailed
+}
+
+func newJobStore(ctx context.Context, workers int, ttl time.Duration) *jobStore {
+	if workers <= 0 {
+		workers = defaultJobWorkers
+	}
+	if ttl <= 0 {
+		ttl = defaultJobTTL
+	}
+	return &jobStore{
+		jobs:    make(map[string]*jobEntry),
+		ttl:     ttl,
+		workers: make(chan struct{}, workers),
+		ctx:     ctx,
+	}
+}
+
+// submit queues a license flow for the request in env and returns the new job, the flow logs with the fields and continues the trace of ctx
+func (s *jobStore) submit(ctx context.Context, env *environment, req *GmlReqBody) (LicenseJob, error) {
+	id, err := GenerateRandomString(16)
+	if err != nil {
+		return LicenseJob{}, err
+	}
+	now := time.Now().UTC()
+	job := LicenseJob{ID: id, Status: JobStatusQueued, CreatedAt: now, UpdatedAt: now}
+
+	s.mu.Lock()
+	s.purgeExpired(now)
+	s.jobs[id] = &jobEntry{job: job, changed: make(chan struct{})}
+	s.mu.Unlock()
+
+	s.running.Add(1)
+	go s.run(env.flowContext(detachContext(s.ctx, ctx)), env.config, id, req)
+	return job, nil
+}
+
+func (s *jobStore) run(ctx context.Context, config *Configuration, id string, req *GmlReqBody) {
+	defer s.running.Done()
+	select {
+	case s.workers <- struct{}{}:
+		defer func() { <-s.workers }()
+	case <-ctx.Done():
+		s.update(id, func(job *LicenseJob) {
+			_, job.Error = errorResponseFor(ctx.Err())
+			job.Status = JobStatusFailed
+		})
+		return
+	}
+
+	s.update(id, func(job *LicenseJob) { job.Status = JobStatusRunning })
+	license, err := getLicenseForDA(ctx, config, req.Username, req.Password, req.RequestID, req.RequestEncKey, func(event StepEvent) {
+		s.record(id, event)
+	})
+	s.update(id, func(job *LicenseJob) {
+		if err != nil {
+			config.logger().ErrorContext(ctx, "license job failed", "job", id, "err", err)
+			_, job.Error = errorResponseFor(err)
+			job.Status = JobStatusFailed
+			return
+		}
+		job.Status = JobStatusSucceeded
+		job.Step = ""
+		job.License = license
+	})
+}
+
+func (s *jobStore) update(id string, fn func(job *LicenseJob)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.jobs[id]
+	if !ok {
+		return
+	}
+	fn(&entry.job)
+	entry.job.UpdatedAt = time.Now().UTC()
+	entry.notify()
+}
+
+// record appends a step event to the job, the job's current step follows the last step started
+func (s *jobStore) record(id string, event StepEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.jobs[id]
+	if !ok {
+		return
+	}
+	entry.events = append(entry.events, event)
+	entry.job.Step = event.Step
+	entry.job.UpdatedAt = time.Now().UTC()
+	entry.notify()
+}
+
+// notify wakes up everyone watching the entry, must be called with s.mu held
+func (e *jobEntry) notify() {
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// get returns a copy of the job, ok is false if the job is unknown or has expired
+func (s *jobStore) get(id string) (LicenseJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.jobs[id]
+	if !ok {
+		return LicenseJob{}, false
+	}
+	return entry.job, true
+}
+
+// watch returns the job, its step events from index from onwards and a channel closed on the next change
+func (s *jobStore) watch(id string, from int) (LicenseJob, []StepEvent, <-chan struct{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.jobs[id]
+	if !ok {
+		return LicenseJob{}, nil, nil, false
+	}
+	var events []StepEvent
+	if from < len(entry.events) {
+		events = append(events, entry.events[from:]...)
+	}
+	return entry.job, events, entry.changed, true
+}
+
+// wait blocks until every submitted job has finished or ctx is done
+func (s *jobStore) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// purgeExpired drops finished jobs older than the ttl, must be called with s.mu held
+func (s *jobStore) purgeExpired(now time.Time) {
+	for id, entry := range s.jobs {
+		if entry.job.finished() && now.Sub(entry.job.UpdatedAt) > s.ttl {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// licenseJobsHandler serves POST /v1/license-jobs, GET /v1/license-jobs/{id} and GET /v1/license-jobs/{id}/events
+func (t *GmlServer) licenseJobsHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, licenseJobsPath), "/")
+	events := strings.HasSuffix(id, "/events")
+	id = strings.TrimSuffix(id, "/events")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		t.submitLicenseJob(w, r)
+	case id != "" && events && r.Method == http.MethodGet:
+		t.streamLicenseJob(w, r, id)
+	case id != "" && r.Method == http.MethodGet:
+		t.getLicenseJob(w, id)
+	default:
+		if id == "" {
+			w.Header().Set("Allow", http.MethodPost)
+		} else {
+			w.Header().Set("Allow", http.MethodGet)
+		}
+		t.writeError(w, http.StatusMethodNotAllowed, &ErrorResp{Code: ErrCodeMethodNotAllowed, Message: r.Method + " is not supported"})
+	}
+}
+
+// swagger:route POST /v1/license-jobs licenses submitLicenseJob
+//
+// Submit an asynchronous license request.
+//
+// Answers right away with the queued job, poll it or stream its events until it has succeeded or failed.
+//
+// responses:
+//
+//	202: licenseJobResponse
+//	400: errorResponse
+//	429: errorResponse
+func (t *GmlServer) submitLicenseJob(w http.ResponseWriter, r *http.Request) {
+	expectedBody, err := decodeGmlReqBody(r)
+	if err != nil {
+		t.logger().WarnContext(r.Context(), "submitLicenseJob: invalid request", "err", err)
+		t.writeError(w, http.StatusBadRequest, &ErrorResp{Code: ErrCodeInvalidRequest, Message: err.Error()})
+		return
+	}
+	envs, ok := t.resolveEnvironments(w, r, expectedBody)
+	if !ok || !t.resolveProfiles(w, r, envs, expectedBody) || t.usersRateLimited(w, r, expectedBody.Username) {
+		return
+	}
+	job, err := t.jobs.submit(r.Context(), envs[0], expectedBody)
+	if err != nil {
+		t.logger().ErrorContext(r.Context(), "submitLicenseJob", "err", err)
+		t.writeError(w, http.StatusInternalServerError, &ErrorResp{Code: ErrCodeInternal, Message: err.Error()})
+		return
+	}
+	w.Header().Set("Location", licenseJobsPath+"/"+job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	t.writeResponse(w, &job, http.StatusAccepted)
+}
+
+// swagger:route GET /v1/license-jobs/{id} licenses getLicenseJob
+//
+// Get the status of a license job.
+//
+// responses:
+//
+//	200: licenseJobResponse
+//	404: errorResponse
+func (t *GmlServer) getLicenseJob(w http.ResponseWriter, id string) {
+	job, ok := t.jobs.get(id)
+	if !ok {
+		t.writeError(w, http.StatusNotFound, &ErrorResp{Code: ErrCodeNotFound, Message: "no license job with id " + id})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	t.writeResponse(w, &job, http.StatusOK)
+}
@@ -0,0 +1,157 @@
+package gmlserver
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var quietLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// gatedSimServer holds every call until release is closed, then answers it with status
+type gatedSimServer struct {
+	release chan struct{}
+	status  int
+}
+
+func (g *gatedSimServer) Call(ctx context.Context, method string, req interface{}, expectedStatus int, resp interface{}) error {
+	select {
+	case <-g.release:
+	case <-ctx.Done():
+		return &UpstreamError{Method: method, ExpectedStatus: expectedStatus, Err: ctx.Err()}
+	}
+	return &UpstreamError{Method: method, StatusCode: g.status, ExpectedStatus: expectedStatus}
+}
+
+// newTestEnvironment runs license flows against sim without retrying
+func newTestEnvironment(name string, sim SimServerClient) *environment {
+	cfg := NewConfiguration("http://simserver.invalid", "http://myam.invalid")
+	cfg.SimServer = sim
+	cfg.Retry = nil
+	cfg.Logger = quietLogger
+	return &environment{name: name, config: cfg}
+}
+
+func waitForJob(t *testing.T, jobs *jobStore, id string, done func(job LicenseJob) bool) LicenseJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, ok := jobs.get(id)
+		if !ok {
+			t.Fatalf("job %s is gone", id)
+		}
+		if done(job) {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job = %+v, gave up waiting", job)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestJobLifecycle(t *testing.T) {
+	sim := &gatedSimServer{release: make(chan struct{}), status: http.StatusBadRequest}
+	env := newTestEnvironment(DefaultEnvironment, sim)
+	jobs := newJobStore(context.Background(), 1, time.Minute)
+	req := &GmlReqBody{Username: "alice", Password: "secret", RequestID: "request-id", RequestEncKey: "enc-key"}
+
+	first, err := jobs.submit(context.Background(), env, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Status != JobStatusQueued {
+		t.Errorf("submitted job = %+v, want queued", first)
+	}
+	waitForJob(t, jobs, first.ID, func(job LicenseJob) bool { return job.Status == JobStatusRunning })
+	second, err := jobs.submit(context.Background(), env, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the only worker is busy with the first job
+	time.Sleep(10 * time.Millisecond)
+	if job, _ := jobs.get(second.ID); job.Status != JobStatusQueued {
+		t.Errorf("second job = %+v, want it queued behind the first", job)
+	}
+
+	close(sim.release)
+	if err := jobs.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{first.ID, second.ID} {
+		job, _ := jobs.get(id)
+		if job.Status != JobStatusFailed || job.Error == nil || job.Error.Step != StepAuth || job.Error.UpstreamStatus != http.StatusBadRequest {
+			t.Errorf("job = %+v, want it failed at the auth step", job)
+		}
+	}
+	_, events, _, _ := jobs.watch(first.ID, 0)
+	if len(events) != 2 || events[0].Outcome != StepStarted || events[1].Outcome != StepFailed {
+		t.Errorf("events = %+v, want auth started and failed", events)
+	}
+
+	// a job still running never expires
+	jobs.mu.Lock()
+	jobs.jobs["running"] = &jobEntry{job: LicenseJob{ID: "running", Status: JobStatusRunning, UpdatedAt: time.Now()}, changed: make(chan struct{})}
+	jobs.purgeExpired(time.Now().Add(time.Minute + time.Second))
+	jobs.mu.Unlock()
+	for _, id := range []string{first.ID, second.ID} {
+		if _, ok := jobs.get(id); ok {
+			t.Errorf("job %s outlived its ttl", id)
+		}
+	}
+	if _, ok := jobs.get("running"); !ok {
+		t.Error("a running job expired")
+	}
+}
+
+func TestJobEventsResume(t *testing.T) {
+	sim := &gatedSimServer{release: make(chan struct{}), status: http.StatusBadRequest}
+	env := newTestEnvironment(DefaultEnvironment, sim)
+	server := &GmlServer{jobs: newJobStore(context.Background(), 1, time.Minute), draining: make(chan struct{})}
+	job, err := server.jobs.submit(context.Background(), env, &GmlReqBody{Username: "alice", Password: "secret", RequestID: "r", RequestEncKey: "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForJob(t, server.jobs, job.ID, func(job LicenseJob) bool { return job.Step == StepAuth })
+
+	// a live stream gets the steps as they happen, then the finished job
+	stream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.streamLicenseJob(w, r, job.ID)
+	}))
+	defer stream.Close()
+	resp, err := http.Get(stream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	close(sim.release)
+	live, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(live), "id: 0\nevent: step\n") || !strings.Contains(string(live), "id: 1\nevent: step\n") ||
+		!strings.Contains(string(live), "event: done\n") {
+		t.Errorf("live stream = %q, want steps 0 and 1 and done", live)
+	}
+
+	// a client reconnecting with Last-Event-ID only gets what it missed
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, licenseJobsPath+"/"+job.ID+"/events", nil)
+	req.Header.Set("Last-Event-ID", "0")
+	server.streamLicenseJob(rec, req, job.ID)
+	resumed := rec.Body.String()
+	if strings.Contains(resumed, "id: 0\n") || !strings.Contains(resumed, "id: 1\nevent: step\n") || !strings.Contains(resumed, "event: done\n") {
+		t.Errorf("resumed stream = %q, want step 1 and done only", resumed)
+	}
+
+	rec = httptest.NewRecorder()
+	server.streamLicenseJob(rec, httptest.NewRequest(http.MethodGet, licenseJobsPath+"/unknown/events", nil), "unknown")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("stream of an unknown job = %d, want 404", rec.Code)
+	}
+}
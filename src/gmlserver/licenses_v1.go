@@ -0,0 +1,132 @@
+package gmlserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+var validate = newValidator()
+
+// newValidator returns a validator reporting failed fields by their json name
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	return v
+}
+
+// decodeGmlReqBody reads a GmlReqBody from the request and checks it against its validate tags
+func decodeGmlReqBody(r *http.Request) (*GmlReqBody, error) {
+	expectedBody := new(GmlReqBody)
+	err := decodeRequestBody(r, expectedBody)
+	if err != nil {
+		return nil, err
+	}
+	return expectedBody, nil
+}
+
+// decodeRequestBody reads the JSON request body into expectedBody and checks it against its validate tags
+func decodeRequestBody(r *http.Request, expectedBody interface{}) error {
+	request, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("could not read request body :: %v", err)
+	}
+	err = json.Unmarshal(request, expectedBody)
+	if err != nil {
+		return fmt.Errorf("could not unmarshal into the structure we were expecting :: %v", err)
+	}
+	err = validate.Struct(expectedBody)
+	if err != nil {
+		validationErrs, ok := err.(validator.ValidationErrors)
+		if !ok {
+			return err
+		}
+		fields := make([]string, 0, len(validationErrs))
+		for _, fieldErr := range validationErrs {
+			// drop the struct name, ie. GmlReqBody.username or BatchLicenseReqBody.items[1].username
+			field := fieldErr.Namespace()
+			if i := strings.Index(field, "."); i >= 0 {
+				field = field[i+1:]
+			}
+			fields = append(fields, fmt.Sprintf("%s (%s)", field, fieldErr.Tag()))
+		}
+		return fmt.Errorf("invalid request fields: %s", strings.Join(fields, ", "))
+	}
+	return nil
+}
+
+func (t *GmlServer) writeError(w http.ResponseWriter, code int, resp *ErrorResp) {
+	w.Header().Set("Content-Type", "application/json")
+	t.writeResponse(w, resp, code)
+}
+
+// licensesHandler serves POST /v1/licenses, answering failures with an ErrorResp
+//
+// swagger:route POST /v1/licenses licenses createLicense
+//
+// Get a DA license for a MyAM user.
+//
+// Runs the whole license flow before answering, which can take more than 30 seconds, against the
+// environment the request names, the default one if it names none. Answers 503 with a Retry-After
+// header at once while the circuit breaker of the simulator server or MyAM is open.
+//
+// responses:
+//
+//	200: licenseResponse
+//	400: errorResponse
+//	401: errorResponse
+//	404: errorResponse
+//	429: errorResponse
+//	500: errorResponse
+//	502: errorResponse
+//	503: errorResponse
+//	504: errorResponse
+func (t *GmlServer) licensesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		t.writeError(w, http.StatusMethodNotAllowed, &ErrorResp{Code: ErrCodeMethodNotAllowed, Message: r.Method + " is not supported"})
+		return
+	}
+
+	expectedBody, err := decodeGmlReqBody(r)
+	if err != nil {
+		t.logger().WarnContext(r.Context(), "licensesHandler: invalid request", "err", err)
+		t.writeError(w, http.StatusBadRequest, &ErrorResp{Code: ErrCodeInvalidRequest, Message: err.Error()})
+		return
+	}
+	envs, ok := t.resolveEnvironments(w, r, expectedBody)
+	if !ok || !t.resolveProfiles(w, r, envs, expectedBody) || t.usersRateLimited(w, r, expectedBody.Username) {
+		return
+	}
+
+	ctx := envs[0].flowContext(r.Context())
+	license, err := getLicenseForDA(ctx, envs[0].config, expectedBody.Username, expectedBody.Password, expectedBody.RequestID, expectedBody.RequestEncKey, nil)
+	if err != nil {
+		t.logger().ErrorContext(ctx, "licensesHandler->getLicenseForDA", "err", err)
+		code, resp := errorResponseFor(err)
+		var openErr *CircuitOpenError
+		if errors.As(err, &openErr) {
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(openErr.RetryAfter().Seconds())))))
+		}
+		t.writeError(w, code, resp)
+		return
+	}
+	respBody := new(GmlResp)
+	respBody.Body.License = license
+	w.Header().Set("Content-Type", "application/json")
+	t.writeResponse(w, &respBody.Body, http.StatusOK)
+}
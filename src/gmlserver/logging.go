@@ -0,0 +1,282 @@
+package gmlserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// RequestIDHeader carries the request ID in and out of GML, and on every call to the simulator server and MyAM
+	RequestIDHeader = "X-Request-ID"
+
+	loggingPath = "/v1/logging"
+)
+
+// logFields are added to every entry logged with a context carrying them
+type logFields struct {
+	requestID   string
+	caller      string
+	environment string
+	user        string
+	step        string
+}
+
+type logFieldsKey struct{}
+
+func logFieldsFrom(ctx context.Context) logFields {
+	fields, _ := ctx.Value(logFieldsKey{}).(logFields)
+	return fields
+}
+
+// WithRequestID returns a context whose log entries, simulator server and MyAM calls carry requestID
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	fields := logFieldsFrom(ctx)
+	fields.requestID = requestID
+	return context.WithValue(ctx, logFieldsKey{}, fields)
+}
+
+// RequestIDFrom returns the request ID ctx carries, if any
+func RequestIDFrom(ctx context.Context) string {
+	return logFieldsFrom(ctx).requestID
+}
+
+// withCaller tags the context's log entries with the identity of GML's caller
+func withCaller(ctx context.Context, caller string) context.Context {
+	fields := logFieldsFrom(ctx)
+	fields.caller = caller
+	return context.WithValue(ctx, logFieldsKey{}, fields)
+}
+
+// CallerFrom returns the identity of the caller authenticated for ctx, if any
+func CallerFrom(ctx context.Context) string {
+	return logFieldsFrom(ctx).caller
+}
+
+// withEnvironment tags the context's log entries with the environment its license flows run in
+func withEnvironment(ctx context.Context, name string) context.Context {
+	fields := logFieldsFrom(ctx)
+	fields.environment = name
+	return context.WithValue(ctx, logFieldsKey{}, fields)
+}
+
+// withUser tags the context's log entries with a hash of the MyAM username, keyed with the user hash key of
+// logging, never the username itself
+func withUser(ctx context.Context, logging *Logging, username string) context.Context {
+	fields := logFieldsFrom(ctx)
+	fields.user = logging.hashUsername(username)
+	return context.WithValue(ctx, logFieldsKey{}, fields)
+}
+
+func withStep(ctx context.Context, step string) context.Context {
+	fields := logFieldsFrom(ctx)
+	fields.step = step
+	return context.WithValue(ctx, logFieldsKey{}, fields)
+}
+
+// hashUsername returns a truncated HMAC-SHA256 of username, which can't be matched against a list of known
+// usernames without the key
+func (l *Logging) hashUsername(username string) string {
+	key := runUserHashKey
+	if l != nil && len(l.userHashKey) != 0 {
+		key = l.userHashKey
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(username))
+	return hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+// runUserHashKey hashes usernames when no key is set, the hashes of a user then differ from one run to the next
+var runUserHashKey = func() []byte {
+	key := make([]byte, minKeyFileSize)
+	rand.Read(key)
+	return key
+}()
+
+// readUserHashKey reads the secret usernames are hashed with from keyFile
+func readUserHashKey(keyFile string) ([]byte, error) {
+	key, err := ioutil.ReadFile(filepath.Clean(keyFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user hash key: %v", err)
+	}
+	if len(key) < minKeyFileSize {
+		return nil, fmt.Errorf("user hash key file %s holds %d bytes, want at least %d", keyFile, len(key), minKeyFileSize)
+	}
+	return key, nil
+}
+
+// setRequestIDHeader passes the request ID of the request's context on to the upstream
+func setRequestIDHeader(req *http.Request) {
+	if requestID := RequestIDFrom(req.Context()); requestID != "" {
+		req.Header.Set(RequestIDHeader, requestID)
+	}
+}
+
+// contextHandler adds the log fields of the context to each record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	fields := logFieldsFrom(ctx)
+	if fields.requestID != "" {
+		r.AddAttrs(slog.String("requestID", fields.requestID))
+	}
+	if fields.caller != "" {
+		r.AddAttrs(slog.String("caller", fields.caller))
+	}
+	if fields.environment != "" {
+		r.AddAttrs(slog.String("environment", fields.environment))
+	}
+	if fields.user != "" {
+		r.AddAttrs(slog.String("user", fields.user))
+	}
+	if fields.step != "" {
+		r.AddAttrs(slog.String("step", fields.step))
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		r.AddAttrs(slog.String("traceID", spanContext.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Logging holds the log settings that can be changed while the server runs
+type Logging struct {
+	Level  slog.LevelVar
+	bodies atomic.Bool
+	// userHashKey is the secret usernames are hashed with, set before any flow runs
+	userHashKey []byte
+}
+
+// LogBodies reports whether simulator server request and response bodies are logged, redacted, at debug level
+func (l *Logging) LogBodies() bool {
+	return l != nil && l.bodies.Load()
+}
+
+// SetUserHashKey sets the secret the usernames in log entries are hashed with, before any flow runs
+func (l *Logging) SetUserHashKey(key []byte) {
+	l.userHashKey = key
+}
+
+// SetLogBodies switches the logging of simulator server request and response bodies
+func (l *Logging) SetLogBodies(enabled bool) {
+	l.bodies.Store(enabled)
+}
+
+// NewLogger returns a logger writing format ("json" or "text") to w, at the level held by logging,
+// that adds the request ID, hashed username and step of the context to each entry
+func NewLogger(w io.Writer, format string, logging *Logging) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: &logging.Level}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q, want json or text", format)
+	}
+	return slog.New(contextHandler{handler}), nil
+}
+
+// myLogger is used by flows whose Configuration has no Logger
+var myLogger = slog.New(contextHandler{slog.NewTextHandler(os.Stderr, nil)})
+
+// requestIDHandler gives each request an ID, the caller's X-Request-ID if it sent one, and echoes it in the response
+func requestIDHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if requestID == "" {
+			requestID, _ = GenerateRandomString(16)
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+		next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), requestID)))
+	})
+}
+
+// loggingHandler serves GET and PUT /v1/logging
+//
+// swagger:route GET /v1/logging admin getLogging
+//
+// Get the log level and whether simulator server bodies are logged.
+//
+// Only for callers in auth.admins once auth is enabled.
+//
+// responses:
+//
+//	200: loggingResponse
+//	403: errorResponse
+func (t *GmlServer) loggingHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		t.updateLogging(w, r)
+		return
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPut)
+		t.writeError(w, http.StatusMethodNotAllowed, &ErrorResp{Code: ErrCodeMethodNotAllowed, Message: r.Method + " is not supported"})
+		return
+	}
+	t.writeLogging(w)
+}
+
+// swagger:route PUT /v1/logging admin updateLogging
+//
+// Change the log level or switch the logging of simulator server bodies.
+//
+// Takes effect right away and lasts until the server restarts. Bodies are logged at debug level, with their
+// secrets redacted as in captures. Only for callers in auth.admins once auth is enabled.
+//
+// responses:
+//
+//	200: loggingResponse
+//	400: errorResponse
+//	403: errorResponse
+func (t *GmlServer) updateLogging(w http.ResponseWriter, r *http.Request) {
+	settings := new(LoggingSettings)
+	err := decodeRequestBody(r, settings)
+	var level slog.Level
+	if err == nil && settings.Level != "" {
+		err = level.UnmarshalText([]byte(settings.Level))
+	}
+	if err != nil {
+		t.logger().WarnContext(r.Context(), "updateLogging: invalid request", "err", err)
+		t.writeError(w, http.StatusBadRequest, &ErrorResp{Code: ErrCodeInvalidRequest, Message: err.Error()})
+		return
+	}
+	if settings.Level != "" {
+		t.config.Logging.Level.Set(level)
+	}
+	if settings.Bodies != nil {
+		t.config.Logging.SetLogBodies(*settings.Bodies)
+	}
+	t.logger().InfoContext(r.Context(), "logging changed", "level", t.config.Logging.Level.Level().String(), "bodies", t.config.Logging.LogBodies())
+	t.writeLogging(w)
+}
+
+func (t *GmlServer) writeLogging(w http.ResponseWriter) {
+	bodies := t.config.Logging.LogBodies()
+	w.Header().Set("Content-Type", "application/json")
+	t.writeResponse(w, &LoggingSettings{Level: t.config.Logging.Level.Level().String(), Bodies: &bodies}, http.StatusOK)
+}
@@ -0,0 +1,75 @@
+package gmlserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashUsername(t *testing.T) {
+	key, other := new(Logging), new(Logging)
+	key.SetUserHashKey([]byte(strings.Repeat("k", minKeyFileSize)))
+	other.SetUserHashKey([]byte(strings.Repeat("o", minKeyFileSize)))
+	if hash := key.hashUsername("alice"); hash != key.hashUsername("alice") || len(hash) != 12 {
+		t.Errorf("hashUsername(alice) = %q, want the same 12 hex digits every time", hash)
+	}
+	if key.hashUsername("alice") == key.hashUsername("bob") {
+		t.Error("alice and bob hash the same")
+	}
+	// without the key a hash can't be matched against a list of usernames
+	if key.hashUsername("alice") == other.hashUsername("alice") {
+		t.Error("alice hashes the same under two keys")
+	}
+	var unset *Logging
+	if unset.hashUsername("alice") != new(Logging).hashUsername("alice") {
+		t.Error("the hashes of a run without a key differ")
+	}
+}
+
+func TestReadUserHashKey(t *testing.T) {
+	dir := t.TempDir()
+	short := filepath.Join(dir, "short.key")
+	if err := os.WriteFile(short, []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readUserHashKey(short); err == nil || !strings.Contains(err.Error(), "want at least") {
+		t.Errorf("readUserHashKey of a short key = %v, want it refused", err)
+	}
+	if _, err := readUserHashKey(filepath.Join(dir, "missing.key")); err == nil {
+		t.Error("readUserHashKey of a missing file succeeded")
+	}
+}
+
+func TestFlowErrorsLeaveOutUsername(t *testing.T) {
+	// MyAM fails the login, the simulator server answers the requestobject call
+	var myam *httptest.Server
+	myam = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/"+requestObjectRequestMethod {
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]string{"loginurl": myam.URL + "/myam/oidc/authorize?client_id=myClientID"})
+			return
+		}
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer myam.Close()
+	cfg := NewConfiguration(myam.URL, myam.URL)
+	cfg.Logger = quietLogger
+	cfg.Retry = nil
+	for _, tc := range []struct {
+		name     string
+		password string
+	}{
+		{"no password", ""},
+		{"auth code", "secret"},
+	} {
+		_, err := getLicenseForDA(context.Background(), cfg, "alice.tester", tc.password, "request-id", "enc-key", nil)
+		if err == nil || strings.Contains(err.Error(), "alice.tester") {
+			t.Errorf("%s: error = %v, want one without the username", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package gmlserver
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsPath = "/metrics"
+
+	UpstreamSimServer = "simserver"
+	UpstreamMyAM      = "myam"
+)
+
+// Metrics records the license flow's steps and upstream calls, a nil *Metrics records nothing
+type Metrics struct {
+	stepDuration       *prometheus.HistogramVec
+	simServerDuration  *prometheus.HistogramVec
+	upstreamResponses  *prometheus.CounterVec
+	lockboxFallbacks   prometheus.Counter
+	simServerRetries   *prometheus.CounterVec
+	inFlight           prometheus.Gauge
+	rateLimitedTotal   *prometheus.CounterVec
+	simServerThrottle  prometheus.Histogram
+	circuitStates      *prometheus.GaugeVec
+	circuitTransitions *prometheus.CounterVec
+	circuitRejections  *prometheus.CounterVec
+}
+
+// NewMetrics creates the flow's metrics and registers them with reg
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	return newServerMetrics(reg).withFlowMetrics(reg)
+}
+
+// newServerMetrics creates the metrics of GML's own requests, shared by the flows of every environment
+func newServerMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gml_http_requests_in_flight",
+			Help: "Requests being served by GML.",
+		}),
+		rateLimitedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gml_rate_limited_total",
+			Help: "License requests rejected with a 429, by the limit they exceeded: caller or user.",
+		}, []string{"limit"}),
+	}
+	reg.MustRegister(m.inFlight, m.rateLimitedTotal)
+	return m
+}
+
+// withFlowMetrics returns a copy of m that records license flows too, in metrics registered with reg
+func (m *Metrics) withFlowMetrics(reg prometheus.Registerer) *Metrics {
+	flow := *m
+	flow.stepDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gml_step_duration_seconds",
+		Help:    "Time taken by each step of the license flow.",
+		Buckets: []float64{.1, .25, .5, 1, 2.5, 5, 10, 15, 20, 30, 60},
+	}, []string{"step", "outcome"})
+	flow.simServerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gml_simserver_request_duration_seconds",
+		Help:    "Time taken by each simulator server method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+	flow.upstreamResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gml_upstream_responses_total",
+		Help: "Responses from the simulator server and MyAM by method and status code, code is \"error\" when no response was received.",
+	}, []string{"upstream", "method", "code"})
+	flow.lockboxFallbacks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gml_lockbox_create_fallbacks_total",
+		Help: "Flows that created a lockbox because recovering it failed.",
+	})
+	flow.simServerRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gml_simserver_retries_total",
+		Help: "Simulator server calls retried under the method's retry policy.",
+	}, []string{"method"})
+	flow.simServerThrottle = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gml_simserver_throttle_wait_seconds",
+		Help:    "Time simulator server calls waited for the outbound rate limit.",
+		Buckets: []float64{0, .01, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	})
+	flow.circuitStates = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gml_circuit_breaker_state",
+		Help: "State of the circuit breaker of each upstream: 0 closed, 1 half open, 2 open.",
+	}, []string{"upstream"})
+	flow.circuitTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gml_circuit_breaker_transitions_total",
+		Help: "Circuit breaker state changes by upstream and the state entered.",
+	}, []string{"upstream", "state"})
+	flow.circuitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gml_circuit_breaker_rejected_total",
+		Help: "Upstream calls failed fast because the upstream's circuit breaker was open.",
+	}, []string{"upstream"})
+	reg.MustRegister(flow.stepDuration, flow.simServerDuration, flow.upstreamResponses, flow.lockboxFallbacks, flow.simServerRetries,
+		flow.simServerThrottle, flow.circuitStates, flow.circuitTransitions, flow.circuitRejections)
+	return &flow
+}
+
+// observeStep records the duration of a step once it has ended
+func (m *Metrics) observeStep(event StepEvent) {
+	if m == nil || event.Outcome == StepStarted {
+		return
+	}
+	m.stepDuration.WithLabelValues(event.Step, event.Outcome).Observe(float64(event.DurationMs) / 1000)
+}
+
+// observeSimServer records a simulator server call, statusCode is 0 when no response was received
+func (m *Metrics) observeSimServer(method string, duration time.Duration, statusCode int) {
+	if m == nil {
+		return
+	}
+	m.simServerDuration.WithLabelValues(method).Observe(duration.Seconds())
+	m.observeUpstream(UpstreamSimServer, method, statusCode)
+}
+
+func (m *Metrics) observeUpstream(upstream, method string, statusCode int) {
+	if m == nil {
+		return
+	}
+	code := "error"
+	if statusCode != 0 {
+		code = strconv.Itoa(statusCode)
+	}
+	m.upstreamResponses.WithLabelValues(upstream, method, code).Inc()
+}
+
+func (m *Metrics) lockboxCreateFallback() {
+	if m != nil {
+		m.lockboxFallbacks.Inc()
+	}
+}
+
+func (m *Metrics) simServerRetried(method string) {
+	if m != nil {
+		m.simServerRetries.WithLabelValues(method).Inc()
+	}
+}
+
+func (m *Metrics) rateLimited(limit string) {
+	if m != nil {
+		m.rateLimitedTotal.WithLabelValues(limit).Inc()
+	}
+}
+
+func (m *Metrics) observeSimServerThrottle(wait time.Duration) {
+	if m != nil {
+		m.simServerThrottle.Observe(wait.Seconds())
+	}
+}
+
+// circuitStateValues are the values of gml_circuit_breaker_state
+var circuitStateValues = map[string]float64{CircuitClosed: 0, CircuitHalfOpen: 1, CircuitOpen: 2}
+
+// circuitState records the state a breaker starts in
+func (m *Metrics) circuitState(upstream, state string) {
+	if m != nil {
+		m.circuitStates.WithLabelValues(upstream).Set(circuitStateValues[state])
+	}
+}
+
+func (m *Metrics) circuitTransitioned(upstream, state string) {
+	if m != nil {
+		m.circuitStates.WithLabelValues(upstream).Set(circuitStateValues[state])
+		m.circuitTransitions.WithLabelValues(upstream, state).Inc()
+	}
+}
+
+func (m *Metrics) circuitRejected(upstream string) {
+	if m != nil {
+		m.circuitRejections.WithLabelValues(upstream).Inc()
+	}
+}
+
+// instrument counts the requests in flight through next
+func (m *Metrics) instrument(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return promhttp.InstrumentHandlerInFlight(m.inFlight, next)
+}
+
+// newMetricsRegistry returns a registry holding the Go runtime and process collectors, each GmlServer has its own
+func newMetricsRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return reg
+}
+
+// metricsHandler serves GET /metrics
+//
+// swagger:route GET /metrics health getMetrics
+//
+// Get metrics in the Prometheus text format.
+//
+// Latency of each flow step and simulator server method, upstream status codes, lockbox-create
+// fallbacks, simulator server retries, requests in flight, rate limited requests, the time spent
+// waiting for the outbound simulator server rate limit and the state of each upstream's circuit breaker.
+//
+// produces: text/plain
+//
+// responses:
+//
+//	200: metricsResponse
+func (t *GmlServer) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	t.metricsExporter.ServeHTTP(w, r)
+}
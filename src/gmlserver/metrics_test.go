@@ -0,0 +1,123 @@
+package gmlserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// newLockboxUpstream serves a flow that gets its access token, fails to recover the lockbox with 503s and then to
+// create it, the current terms it needs failing with a 500
+func newLockboxUpstream(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + requestObjectRequestMethod:
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]string{"loginurl": server.URL + "/myam/oidc/authorize?client_id=myClientID"})
+		case "/myam/oidc/authorize", "/myam/oidc/authenticate", "/myam/oidc/login":
+			w.WriteHeader(http.StatusOK)
+		case "/myam/oidc/consent":
+			http.Redirect(w, r, "/callback?code=authcode", http.StatusFound)
+		case "/" + accessTokenRequestMethod:
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]string{"accesstoken": "token"})
+		case "/" + recoverLockboxMethod:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			http.Error(w, "no lockbox for you", http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// the simulator server methods as the metrics label them
+var (
+	recoverLockboxMethod = strings.ToLower(RequestMethodRecoverLockbox)
+	currentTermsMethod   = strings.ToLower(RequestMethodRetrieveCurrentTerms)
+)
+
+// histogramCount returns the number of observations of the histogram vec's series with labels
+func histogramCount(t *testing.T, vec *prometheus.HistogramVec, labels ...string) uint64 {
+	t.Helper()
+	metric := new(dto.Metric)
+	if err := vec.WithLabelValues(labels...).(prometheus.Metric).Write(metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestFlowMetrics(t *testing.T) {
+	upstream := newLockboxUpstream(t)
+	cfg := NewConfiguration(upstream.URL, upstream.URL)
+	cfg.Logger = quietLogger
+	cfg.Metrics = NewMetrics(prometheus.NewRegistry())
+	cfg.Retry = &RetryPolicies{Default: fastRetryPolicy(2)}
+	cfg.RecoverLockboxDelay = 0
+	m := cfg.Metrics
+
+	if _, err := getLicenseForDA(context.Background(), cfg, "alice", "secret", "request-id", "enc-key", nil); err == nil {
+		t.Fatal("flow succeeded, want the createLockbox failure of the upstream")
+	}
+
+	for _, tc := range []struct {
+		step, outcome string
+		count         uint64
+	}{
+		{StepAuth, StepSucceeded, 1},
+		{StepRecoverLockbox, StepFailed, 1},
+		{StepCreateLockbox, StepFailed, 1},
+		{StepCreateDA, StepFailed, 0},
+	} {
+		if count := histogramCount(t, m.stepDuration, tc.step, tc.outcome); count != tc.count {
+			t.Errorf("gml_step_duration_seconds{step=%q,outcome=%q} count = %d, want %d", tc.step, tc.outcome, count, tc.count)
+		}
+	}
+	if count := histogramCount(t, m.simServerDuration, recoverLockboxMethod); count != 2 {
+		t.Errorf("gml_simserver_request_duration_seconds{method=%q} count = %d, want 2", recoverLockboxMethod, count)
+	}
+
+	for _, tc := range []struct {
+		upstream, method, code string
+		count                  float64
+	}{
+		{UpstreamSimServer, accessTokenRequestMethod, "202", 1},
+		{UpstreamSimServer, recoverLockboxMethod, "503", 2},
+		// a 500 is not retried
+		{UpstreamSimServer, currentTermsMethod, "500", 1},
+		{UpstreamMyAM, "consent", "302", 1},
+	} {
+		if count := testutil.ToFloat64(m.upstreamResponses.WithLabelValues(tc.upstream, tc.method, tc.code)); count != tc.count {
+			t.Errorf("gml_upstream_responses_total{upstream=%q,method=%q,code=%q} = %v, want %v", tc.upstream, tc.method, tc.code, count, tc.count)
+		}
+	}
+
+	if count := testutil.ToFloat64(m.lockboxFallbacks); count != 1 {
+		t.Errorf("gml_lockbox_create_fallbacks_total = %v, want 1", count)
+	}
+	for method, want := range map[string]float64{accessTokenRequestMethod: 0, recoverLockboxMethod: 1, currentTermsMethod: 0} {
+		if count := testutil.ToFloat64(m.simServerRetries.WithLabelValues(method)); count != want {
+			t.Errorf("gml_simserver_retries_total{method=%q} = %v, want %v", method, count, want)
+		}
+	}
+}
+
+func TestRequestsInFlight(t *testing.T) {
+	m := NewMetrics(prometheus.NewRegistry())
+	var during float64
+	handler := m.instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		during = testutil.ToFloat64(m.inFlight)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, healthzPath, nil))
+	if after := testutil.ToFloat64(m.inFlight); during != 1 || after != 0 {
+		t.Errorf("gml_http_requests_in_flight = %v during a request and %v after, want 1 and 0", during, after)
+	}
+}
@@ -0,0 +1,166 @@
+package gmlserver
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:generate go run ../openapigen -dir . -out openapi.json -title GML -description "Get Me a License: fronts an app simulator server and gets a DA license for a MyAM user."
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+//go:embed explorer.html
+var apiExplorerPage []byte
+
+// The types below only describe GML's endpoints to openapigen.
+
+// swagger:parameters createLicense submitLicenseJob
+type licenseParams struct {
+	// in: body
+	Body GmlReqBody
+	// true records the flow's upstream exchanges when capture.mode is request, download them with the X-Capture-ID answered.
+	// in: header
+	Capture bool `json:"X-Capture"`
+}
+
+// swagger:parameters createEnvironmentLicense
+type environmentLicenseParams struct {
+	// Environment configured on the server.
+	// in: path
+	Environment string `json:"environment"`
+	// in: body
+	Body GmlReqBody
+	// true records the flow's upstream exchanges when capture.mode is request, download them with the X-Capture-ID answered.
+	// in: header
+	Capture bool `json:"X-Capture"`
+}
+
+// swagger:parameters getReadiness listProfiles
+type environmentParams struct {
+	// Environment configured on the server, default if omitted.
+	// in: query
+	Environment string `json:"environment"`
+}
+
+// swagger:parameters legacyLicense
+type legacyLicenseParams struct {
+	// in: body
+	Body GmlReqBody
+}
+
+// swagger:parameters createLicenseBatch
+type licenseBatchParams struct {
+	// in: body
+	Body BatchLicenseReqBody
+	// true records the flows' upstream exchanges when capture.mode is request, download them with the X-Capture-ID answered.
+	// in: header
+	Capture bool `json:"X-Capture"`
+}
+
+// swagger:parameters getCapture
+type captureParams struct {
+	// Capture ID answered in the X-Capture-ID header.
+	// in: path
+	ID string `json:"id"`
+}
+
+// swagger:parameters getLicenseJob streamLicenseJob
+type licenseJobParams struct {
+	// Job ID returned when the job was submitted.
+	// in: path
+	ID string `json:"id"`
+}
+
+// swagger:parameters updateLogging
+type loggingParams struct {
+	// in: body
+	Body LoggingSettings
+}
+
+// A structured error.
+// swagger:response errorResponse
+type errorResponse struct {
+	// in: body
+	Body ErrorResp
+}
+
+// An error.
+// swagger:response legacyErrorResponse
+type legacyErrorResponse struct {
+	// in: body
+	Body ErrorStruct500
+}
+
+// The license job.
+// swagger:response licenseJobResponse
+type licenseJobResponse struct {
+	// in: body
+	Body LicenseJob
+}
+
+// A stream of "step" events, each carrying a StepEvent, ended by a "done" event carrying the LicenseJob.
+// swagger:response licenseJobEventsResponse
+type licenseJobEventsResponse struct {
+	// in: body
+	Body string
+}
+
+// GML is alive.
+// swagger:response healthResponse
+type healthResponse struct {
+	// in: body
+	Body struct {
+		// Always ok.
+		//required: true
+		Status string `json:"status"`
+	}
+}
+
+// Metrics in the Prometheus text exposition format.
+// swagger:response metricsResponse
+type metricsResponse struct {
+	// in: body
+	Body string
+}
+
+// The log settings.
+// swagger:response loggingResponse
+type loggingResponse struct {
+	// in: body
+	Body LoggingSettings
+}
+
+// The captured exchanges in HAR 1.2 format.
+// swagger:response captureResponse
+type captureResponse struct {
+	// in: body
+	Body map[string]interface{}
+}
+
+// This document.
+// swagger:response openAPIResponse
+type openAPIResponse struct {
+	// in: body
+	Body map[string]interface{}
+}
+
+// openAPIHandler serves the OpenAPI document generated from the swagger annotations
+//
+// swagger:route GET /openapi.json docs getOpenAPI
+//
+// Get this OpenAPI document.
+//
+// responses:
+//
+//	200: openAPIResponse
+func (t *GmlServer) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	t.writeResponse(w, openAPIDocument, http.StatusOK)
+}
+
+// apiExplorerHandler serves a page listing the operations of the OpenAPI document, with a form to try each of them
+func (t *GmlServer) apiExplorerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t.writeResponse(w, apiExplorerPage, http.StatusOK)
+}
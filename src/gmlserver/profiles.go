@@ -0,0 +1,166 @@
+package gmlserver
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	profilesPath = "/v1/profiles"
+
+	PasswordSourceEnv  = "env"
+	PasswordSourceFile = "file"
+)
+
+// errUnknownProfile is returned for a request naming a profile that is not configured
+var errUnknownProfile = errors.New("unknown profile")
+
+// profileConfig is an entry of profiles, its password is read from an environment variable or a file
+type profileConfig struct {
+	Name        string `mapstructure:"name"`
+	Username    string `mapstructure:"username"`
+	Description string `mapstructure:"description"`
+	Password    struct {
+		Env  string `mapstructure:"env"`
+		File string `mapstructure:"file"`
+	} `mapstructure:"password"`
+}
+
+// password reads the profile's password, on every use so a rotated secret is picked up without a restart
+func (p *profileConfig) password() (string, error) {
+	if p.Password.Env != "" {
+		password, ok := os.LookupEnv(p.Password.Env)
+		if !ok || password == "" {
+			return "", fmt.Errorf("profile %q: environment variable %s is not set", p.Name, p.Password.Env)
+		}
+		return password, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Clean(p.Password.File))
+	if err != nil {
+		return "", fmt.Errorf("profile %q: failed to read password file: %v", p.Name, err)
+	}
+	// files written by editors and secret mounts often end with a newline
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func (p *profileConfig) info() CredentialProfile {
+	info := CredentialProfile{Name: p.Name, Username: p.Username, Description: p.Description}
+	if p.Password.Env != "" {
+		info.PasswordSource = PasswordSourceEnv
+	} else {
+		info.PasswordSource = PasswordSourceFile
+	}
+	_, err := p.password()
+	info.Available = err == nil
+	return info
+}
+
+// profileStore holds the named test users callers can ask for instead of sending a username and password
+type profileStore struct {
+	byName map[string]*profileConfig
+	names  []string
+}
+
+func loadProfiles(v *viper.Viper) (*profileStore, error) {
+	var profiles []profileConfig
+	if err := v.UnmarshalKey(PROFILES, &profiles); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", PROFILES, err)
+	}
+	store := &profileStore{byName: make(map[string]*profileConfig, len(profiles))}
+	for i := range profiles {
+		p := &profiles[i]
+		switch {
+		case p.Name == "" || p.Username == "":
+			return nil, fmt.Errorf("%s[%d] needs a name and a username", PROFILES, i)
+		case store.byName[p.Name] != nil:
+			return nil, fmt.Errorf("%s[%d]: profile %q is defined twice", PROFILES, i, p.Name)
+		case (p.Password.Env == "") == (p.Password.File == ""):
+			return nil, fmt.Errorf("%s[%d] needs exactly one of password.env and password.file", PROFILES, i)
+		}
+		store.byName[p.Name] = p
+		store.names = append(store.names, p.Name)
+	}
+	return store, nil
+}
+
+// apply replaces the profile named by req with its username and password
+func (s *profileStore) apply(req *GmlReqBody) error {
+	if req.Profile == "" {
+		return nil
+	}
+	p, ok := s.byName[req.Profile]
+	if !ok {
+		return fmt.Errorf("%w %q", errUnknownProfile, req.Profile)
+	}
+	password, err := p.password()
+	if err != nil {
+		return err
+	}
+	req.Username, req.Password = p.Username, password
+	return nil
+}
+
+// resolveProfiles fills in the username and password of every request naming a profile from the profiles of
+// the request's environment in envs. It answers 400 for an unknown profile and 500 for a profile whose password
+// cannot be read, and reports whether all were resolved.
+func (t *GmlServer) resolveProfiles(w http.ResponseWriter, r *http.Request, envs []*environment, reqs ...*GmlReqBody) bool {
+	for i, req := range reqs {
+		err := envs[i].profiles.apply(req)
+		if err == nil {
+			continue
+		}
+		if len(reqs) > 1 {
+			err = fmt.Errorf("items[%d]: %w", i, err)
+		}
+		if errors.Is(err, errUnknownProfile) {
+			t.logger().WarnContext(r.Context(), "resolveProfiles: invalid request", "err", err)
+			t.writeError(w, http.StatusBadRequest, &ErrorResp{Code: ErrCodeInvalidRequest, Message: err.Error()})
+		} else {
+			t.logger().ErrorContext(r.Context(), "resolveProfiles", "err", err)
+			t.writeError(w, http.StatusInternalServerError, &ErrorResp{Code: ErrCodeInternal, Message: "the password of profile " + req.Profile + " is not available"})
+		}
+		return false
+	}
+	return true
+}
+
+// profilesHandler serves GET /v1/profiles
+//
+// swagger:route GET /v1/profiles admin listProfiles
+//
+// List the credential profiles requests can name instead of a username and password.
+//
+// Lists the profiles of the default environment, or of the environment named by the environment query
+// parameter. Passwords are never returned, only where they are read from and whether they can be read right now.
+// Only for callers in auth.admins once auth is enabled.
+//
+// responses:
+//
+//	200: profilesResponse
+//	403: errorResponse
+//	404: errorResponse
+func (t *GmlServer) profilesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		t.writeError(w, http.StatusMethodNotAllowed, &ErrorResp{Code: ErrCodeMethodNotAllowed, Message: r.Method + " is not supported"})
+		return
+	}
+	env, ok := t.queryEnvironment(w, r)
+	if !ok {
+		return
+	}
+	respBody := new(ProfilesResp)
+	respBody.Body.Profiles = make([]CredentialProfile, 0, len(env.profiles.names))
+	for _, name := range env.profiles.names {
+		respBody.Body.Profiles = append(respBody.Body.Profiles, env.profiles.byName[name].info())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	t.writeResponse(w, &respBody.Body, http.StatusOK)
+}
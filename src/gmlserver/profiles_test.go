@@ -0,0 +1,123 @@
+package gmlserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testProfilesConfig = `
+simserver:
+  url: http://simserver.invalid
+myam:
+  url: http://myam.invalid
+profiles:
+  - name: env-user
+    username: alice
+    description: password from the environment
+    password:
+      env: GML_TEST_PROFILE_PASSWORD
+  - name: file-user
+    username: bob
+    password:
+      file: %[1]s/bob.password
+  - name: unset-user
+    username: carol
+    password:
+      env: GML_TEST_PROFILE_UNSET
+  - name: missing-file-user
+    username: dave
+    password:
+      file: %[1]s/missing.password
+`
+
+// newProfilesTestServer returns a GmlServer with the profiles of testProfilesConfig, their passwords in place
+func newProfilesTestServer(t *testing.T) *GmlServer {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bob.password"), []byte("bob-password\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GML_TEST_PROFILE_PASSWORD", "alice-password")
+	server, _ := newAuthTestServer(t, fmt.Sprintf(testProfilesConfig, dir))
+	return server
+}
+
+func TestProfilePasswords(t *testing.T) {
+	profiles := newProfilesTestServer(t).environments[DefaultEnvironment].profiles
+	for _, tc := range []struct {
+		profile, username, password string
+	}{
+		{"env-user", "alice", "alice-password"},
+		// the trailing newline of the file is not part of the password
+		{"file-user", "bob", "bob-password"},
+	} {
+		req := &GmlReqBody{Profile: tc.profile}
+		if err := profiles.apply(req); err != nil || req.Username != tc.username || req.Password != tc.password {
+			t.Errorf("apply(%s) = %v with %q/%q, want %q/%q", tc.profile, err, req.Username, req.Password, tc.username, tc.password)
+		}
+	}
+}
+
+func TestResolveProfilesStatus(t *testing.T) {
+	server := newProfilesTestServer(t)
+	for _, tc := range []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{"unknown profile", `{"profile": "nobody"}`, http.StatusBadRequest, ErrCodeInvalidRequest},
+		{"unset environment variable", `{"profile": "unset-user"}`, http.StatusInternalServerError, ErrCodeInternal},
+		{"unreadable password file", `{"profile": "missing-file-user"}`, http.StatusInternalServerError, ErrCodeInternal},
+		{"profile with a username", `{"profile": "env-user", "username": "alice"}`, http.StatusBadRequest, ErrCodeInvalidRequest},
+		{"profile with a password", `{"profile": "env-user", "password": "secret"}`, http.StatusBadRequest, ErrCodeInvalidRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body := strings.Replace(tc.body, "{", `{"requestID": "r", "requestEncKey": "k", `, 1)
+			rec := httptest.NewRecorder()
+			server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/licenses", strings.NewReader(body)))
+			var resp ErrorResp
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			if rec.Code != tc.status || resp.Code != tc.code {
+				t.Errorf("POST %s = %d %s, want %d %s: %s", body, rec.Code, resp.Code, tc.status, tc.code, rec.Body)
+			}
+			if strings.Contains(rec.Body.String(), "GML_TEST_PROFILE") || strings.Contains(rec.Body.String(), ".password") {
+				t.Errorf("error names where the password is read from: %s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestProfilesHandler(t *testing.T) {
+	server := newProfilesTestServer(t)
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, profilesPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d: %s", profilesPath, rec.Code, rec.Body)
+	}
+	for _, secret := range []string{"alice-password", "bob-password", "GML_TEST_PROFILE", ".password"} {
+		if strings.Contains(rec.Body.String(), secret) {
+			t.Errorf("GET %s holds %s: %s", profilesPath, secret, rec.Body)
+		}
+	}
+
+	var resp ProfilesResp
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	want := []CredentialProfile{
+		{Name: "env-user", Username: "alice", Description: "password from the environment", PasswordSource: PasswordSourceEnv, Available: true},
+		{Name: "file-user", Username: "bob", PasswordSource: PasswordSourceFile, Available: true},
+		{Name: "unset-user", Username: "carol", PasswordSource: PasswordSourceEnv},
+		{Name: "missing-file-user", Username: "dave", PasswordSource: PasswordSourceFile},
+	}
+	if fmt.Sprint(resp.Body.Profiles) != fmt.Sprint(want) {
+		t.Errorf("profiles = %+v, want %+v", resp.Body.Profiles, want)
+	}
+}
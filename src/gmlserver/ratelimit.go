@@ -0,0 +1,188 @@
+package gmlserver
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	LimitCaller = "caller"
+	LimitUser   = "user"
+
+	limiterPurgeInterval = time.Minute
+)
+
+// keyedLimiter holds a token bucket per key, ie. per caller or per MyAM username.
+// Buckets idle long enough to have refilled are dropped.
+type keyedLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPurge time.Time
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newKeyedLimiter returns a limiter allowing perSecond events per key with bursts of burst, nil if perSecond is not positive
+func newKeyedLimiter(perSecond float64, burst int) *keyedLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(perSecond))
+	}
+	return &keyedLimiter{limit: rate.Limit(perSecond), burst: burst, buckets: make(map[string]*bucket)}
+}
+
+// reserve takes n tokens from the bucket of each key, or none at all. If any bucket is short it returns
+// how long until all of them would have the tokens, or a negative duration if n exceeds a bucket's burst.
+func (l *keyedLimiter) reserve(counts map[string]int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.purgeIdle(now)
+
+	var wait time.Duration
+	reservations := make([]*rate.Reservation, 0, len(counts))
+	for key, n := range counts {
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &bucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+			l.buckets[key] = b
+		}
+		b.lastSeen = now
+		reservation := b.limiter.ReserveN(now, n)
+		if !reservation.OK() {
+			wait = -1
+			break
+		}
+		reservations = append(reservations, reservation)
+		if delay := reservation.DelayFrom(now); delay > wait {
+			wait = delay
+		}
+	}
+	if wait != 0 {
+		for _, reservation := range reservations {
+			reservation.CancelAt(now)
+		}
+	}
+	return wait
+}
+
+func (l *keyedLimiter) purgeIdle(now time.Time) {
+	if now.Sub(l.lastPurge) < limiterPurgeInterval {
+		return
+	}
+	l.lastPurge = now
+	refill := time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) > refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// ErrThrottled is matched by the error returned for a simulator server call that could not get its turn under
+// ratelimit.simserver
+var ErrThrottled = errors.New("simulator server rate limit")
+
+// ThrottledError is returned instead of calling the simulator server when waiting for the outbound rate limit
+// failed, ie. the wait would outlast the flow. The call was never sent, so it says nothing about the simulator
+// server: it is not retried, counted by the circuit breaker or recorded as an upstream response.
+type ThrottledError struct {
+	// Method is the simulator server method that was not called
+	Method string
+	// Err is why the wait failed
+	Err error
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%s was not sent, waiting for the simulator server rate limit failed :: %v", e.Method, e.Err)
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ThrottledError) Is(target error) bool {
+	return target == ErrThrottled
+}
+
+// newSimServerLimiter caps the requests sent to the simulator server, nil if perSecond is not positive
+func newSimServerLimiter(perSecond float64, burst int) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(perSecond))
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+// callerKey identifies the caller for rate limiting: its authenticated identity, or else its IP address
+func callerKey(r *http.Request) string {
+	if caller := CallerFrom(r.Context()); caller != "" {
+		return "caller:" + caller
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// rateLimited answers 429 with a Retry-After header if wait is not zero, and reports whether it did
+func (t *GmlServer) rateLimited(w http.ResponseWriter, r *http.Request, limit string, wait time.Duration) bool {
+	if wait == 0 {
+		return false
+	}
+	t.metrics.rateLimited(limit)
+	message := "too many requests"
+	if limit == LimitUser {
+		message = "too many license requests for this user"
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	} else {
+		message += ", more at once than the limit allows"
+	}
+	t.logger().WarnContext(r.Context(), "rate limited", "limit", limit, "retryAfter", wait)
+	t.writeError(w, http.StatusTooManyRequests, &ErrorResp{Code: ErrCodeRateLimited, Message: message})
+	return true
+}
+
+// limitCaller wraps a license endpoint so each caller gets at most ratelimit.caller.rate POSTs per second,
+// other methods only read and are not counted
+func (t *GmlServer) limitCaller(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && t.rateLimited(w, r, LimitCaller, t.callerLimiter.reserve(map[string]int{callerKey(r): 1})) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// usersRateLimited takes a license flow from the bucket of each username, answering 429 if any is empty
+func (t *GmlServer) usersRateLimited(w http.ResponseWriter, r *http.Request, usernames ...string) bool {
+	counts := make(map[string]int, len(usernames))
+	for _, username := range usernames {
+		counts[username]++
+	}
+	return t.rateLimited(w, r, LimitUser, t.userLimiter.reserve(counts))
+}
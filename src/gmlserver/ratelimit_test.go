@@ -0,0 +1,132 @@
+package gmlserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/time/rate"
+)
+
+func TestKeyedLimiterReservesAllOrNothing(t *testing.T) {
+	limiter := newKeyedLimiter(1, 2)
+	for _, tc := range []struct {
+		name   string
+		counts map[string]int
+		// the sign of the wait: 0 reserved, 1 short of tokens, -1 more than the burst
+		want int
+	}{
+		{"full buckets", map[string]int{"alice": 2, "bob": 1}, 0},
+		{"one bucket empty", map[string]int{"alice": 1, "carol": 2}, 1},
+		{"carol kept her tokens", map[string]int{"carol": 2}, 0},
+		{"more than the burst", map[string]int{"bob": 1, "dave": 3}, -1},
+		{"bob and dave kept their tokens", map[string]int{"bob": 1, "dave": 2}, 0},
+	} {
+		wait := limiter.reserve(tc.counts)
+		if got := sign(int64(wait)); got != tc.want {
+			t.Errorf("%s: reserve(%v) = %v, want a wait of sign %d", tc.name, tc.counts, wait, tc.want)
+		}
+	}
+}
+
+func sign(n int64) int {
+	switch {
+	case n > 0:
+		return 1
+	case n < 0:
+		return -1
+	}
+	return 0
+}
+
+func TestUsersRateLimited(t *testing.T) {
+	server := &GmlServer{config: newTestEnvironment(DefaultEnvironment, nil).config, userLimiter: newKeyedLimiter(1, 2)}
+	for _, tc := range []struct {
+		name       string
+		usernames  []string
+		status     int
+		retryAfter string
+	}{
+		// a batch asking more of a user than the burst can never pass, there is nothing to wait for
+		{"batch over the user limit", []string{"alice", "bob", "alice", "alice"}, http.StatusTooManyRequests, ""},
+		{"nothing was taken by the rejected batch", []string{"alice", "alice", "bob", "bob"}, http.StatusOK, ""},
+		{"bucket empty", []string{"alice"}, http.StatusTooManyRequests, "1"},
+		{"batch with a user whose bucket is empty", []string{"carol", "bob"}, http.StatusTooManyRequests, "1"},
+		{"nor by the batch waiting for a user", []string{"carol", "carol"}, http.StatusOK, ""},
+	} {
+		rec := httptest.NewRecorder()
+		if !server.usersRateLimited(rec, httptest.NewRequest(http.MethodPost, licenseBatchPath, nil), tc.usernames...) {
+			rec.WriteHeader(http.StatusOK)
+		}
+		if rec.Code != tc.status || rec.Header().Get("Retry-After") != tc.retryAfter {
+			t.Errorf("%s: usersRateLimited(%v) = %d with Retry-After %q, want %d with %q",
+				tc.name, tc.usernames, rec.Code, rec.Header().Get("Retry-After"), tc.status, tc.retryAfter)
+		}
+	}
+}
+
+func TestLimitCaller(t *testing.T) {
+	server := &GmlServer{config: newTestEnvironment(DefaultEnvironment, nil).config, callerLimiter: newKeyedLimiter(1, 1)}
+	handler := server.limitCaller(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tc := range []struct {
+		method     string
+		remoteAddr string
+		status     int
+		retryAfter string
+	}{
+		{http.MethodPost, "192.0.2.1:1234", http.StatusOK, ""},
+		{http.MethodPost, "192.0.2.1:5678", http.StatusTooManyRequests, "1"},
+		// reads are not counted
+		{http.MethodGet, "192.0.2.1:1234", http.StatusOK, ""},
+		{http.MethodPost, "192.0.2.2:1234", http.StatusOK, ""},
+	} {
+		req := httptest.NewRequest(tc.method, "/v1/licenses", nil)
+		req.RemoteAddr = tc.remoteAddr
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != tc.status || rec.Header().Get("Retry-After") != tc.retryAfter {
+			t.Errorf("%s from %s = %d with Retry-After %q, want %d with %q",
+				tc.method, tc.remoteAddr, rec.Code, rec.Header().Get("Retry-After"), tc.status, tc.retryAfter)
+		}
+	}
+}
+
+func TestSimServerThrottleIsNotAnUpstreamFailure(t *testing.T) {
+	fake := &fakeSimServer{status: map[string]int{requestObjectRequestMethod: http.StatusAccepted}}
+	cfg := NewConfiguration("http://simserver.invalid", "http://myam.invalid")
+	cfg.SimServer = fake
+	cfg.Metrics = NewMetrics(prometheus.NewRegistry())
+	cfg.Retry = &RetryPolicies{Default: fastRetryPolicy(3)}
+	cfg.SimServerBreaker = NewCircuitBreaker(UpstreamSimServer, BreakerSettings{Failures: 1, Cooldown: time.Minute, Probes: 1}, nil)
+	// the only token is taken, the next one comes long after the flow's deadline
+	cfg.SimServerLimiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+	cfg.SimServerLimiter.Allow()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := SendRequestAndCheckResponse(ctx, cfg, requestObjectRequestMethod, "{}", http.StatusAccepted, nil)
+	var upstreamErr *UpstreamError
+	if !errors.Is(err, ErrThrottled) || errors.As(err, &upstreamErr) {
+		t.Fatalf("error = %v, want a throttled call rather than an upstream error", err)
+	}
+	if len(fake.calls) != 0 {
+		t.Errorf("simserver called %v", fake.calls)
+	}
+	if state := cfg.SimServerBreaker.State(); state != CircuitClosed {
+		t.Errorf("breaker = %s after a throttled call, want closed", state)
+	}
+	if n := testutil.CollectAndCount(cfg.Metrics.upstreamResponses); n != 0 {
+		t.Errorf("gml_upstream_responses_total has %d series after a throttled call, want none", n)
+	}
+	if n := testutil.CollectAndCount(cfg.Metrics.simServerRetries); n != 0 {
+		t.Errorf("gml_simserver_retries_total has %d series after a throttled call, want none", n)
+	}
+	if code, resp := errorResponseFor(&FlowError{Step: StepAuth, Err: err}); code != http.StatusServiceUnavailable || resp.Code != ErrCodeUnavailable {
+		t.Errorf("errorResponseFor(%v) = %d %s, want 503 %s", err, code, resp.Code, ErrCodeUnavailable)
+	}
+}
@@ -1,19 +1,14 @@
 package gmlserver
 
 import (
+	"context"
 	"strings"
-	"time"
 )
 
-const (
-	retry_attempts = 3
-	retry_backoff  = 10
-)
-
-func RecoverLockboxWithClientID(accessToken string, expectedStatus int, clientID string) (string, *RecoverLockboxRespBody, error) {
+func RecoverLockboxWithClientID(ctx context.Context, cfg *Configuration, accessToken string, expectedStatus int, clientID string) (string, *RecoverLockboxRespBody, error) {
 	payload := &RecoverLockboxReqBody{
 		AccessToken: accessToken,
-		Endpoint:    Config.MyBankBaseURL,
+		Endpoint:    cfg.MyBankBaseURL,
 		Locale:      "en",
 		ClientID:    clientID,
 	}
@@ -21,20 +16,13 @@ func RecoverLockboxWithClientID(accessToken string, expectedStatus int, clientID
 	var req = new(RecoverLockboxReq)
 	req.Body.RecoverLockBoxBody = payload
 	// give a few seconds for pre-conditions to propagte
-	time.Sleep(10 * time.Second)
+	if err := sleepContext(ctx, cfg.RecoverLockboxDelay); err != nil {
+		return "", nil, err
+	}
 	var expected = new(RecoverLockboxResp)
-	retries := 0
-retry:
-	err := SendRequestAndCheckResponse(strings.ToLower(RequestMethodRecoverLockbox), req.Body, expectedStatus, &expected.Body)
+	// a 504 while the lockbox is still being set up is retried by the recoverlockbox retry policy
+	err := SendRequestAndCheckResponse(ctx, cfg, strings.ToLower(RequestMethodRecoverLockbox), req.Body, expectedStatus, &expected.Body)
 	if err != nil {
-		if strings.Contains(err.Error(), "504") {
-			if retries < 3 {
-				retries++
-				myLogger.Printf("RecoverLockboxWithClientID: recieved gateway 504 timeout, retry attempt %d/%d with %ds backoff", retries, retry_attempts, retry_backoff)
-				time.Sleep(retry_backoff * time.Second)
-				goto retry
-			}
-		}
 		return "", nil, err
 	}
 	return expected.Body.ServerState, expected.Body.RecoverLockboxBody, nil
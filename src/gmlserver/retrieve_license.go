@@ -1,11 +1,12 @@
 package gmlserver
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 )
 
-func RetrieveLicenseRequest(accessToken, state, licenseRequestID, requestEncKey string, expectedStatus int) (string, *RetrieveLicenseRequestResp, error) {
+func RetrieveLicenseRequest(ctx context.Context, cfg *Configuration, accessToken, state, licenseRequestID, requestEncKey string, expectedStatus int) (string, *RetrieveLicenseRequestResp, error) {
 	if accessToken == "" || state == "" {
 		return "", nil, fmt.Errorf("retrieveLicenseRequest -> cannot retrieve license, must call createLockbox first")
 	}
@@ -18,14 +19,14 @@ func RetrieveLicenseRequest(accessToken, state, licenseRequestID, requestEncKey
 	payload := RetrieveLicenseRequestReqBody{
 		AccessToken:      accessToken,
 		ServerState:      state,
-		Endpoint:         Config.MyBankBaseURL,
+		Endpoint:         cfg.MyBankBaseURL,
 		LicenseRequestID: licenseRequestID,
 		RequestEncKey:    requestEncKey,
 	}
 	request := new(RetrieveLicenseRequestReq)
 	request.Body.RetrieveLicenseRequestBody = &payload
 	expected := new(RetrieveLicenseRequestResp)
-	err = SendRequestAndCheckResponse("retrievelicenserequest", request.Body, http.StatusAccepted, &expected.Body)
+	err = SendRequestAndCheckResponse(ctx, cfg, "retrievelicenserequest", request.Body, http.StatusAccepted, &expected.Body)
 	if err != nil {
 		return "", nil, err
 	}
@@ -0,0 +1,222 @@
+package gmlserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// RetryOnTimeout retries calls that timed out without a response, RetryOnConnection those whose connection
+	// was refused, reset or closed before the response was read
+	RetryOnTimeout    = "timeout"
+	RetryOnConnection = "connection"
+)
+
+// RetryPolicy says which failed simulator server calls are tried again, how often and how long to wait in between
+type RetryPolicy struct {
+	// Attempts is the most calls made, including the first, 1 never retries
+	Attempts int `mapstructure:"attempts"`
+	Backoff  struct {
+		// Initial is the wait before the first retry, multiplied by Multiplier before every next one up to Max
+		Initial    time.Duration `mapstructure:"initial"`
+		Max        time.Duration `mapstructure:"max"`
+		Multiplier float64       `mapstructure:"multiplier"`
+		// Jitter spreads each wait by up to this fraction either way, so flows failing together don't retry together
+		Jitter float64 `mapstructure:"jitter"`
+	} `mapstructure:"backoff"`
+	// Deadline bounds all the attempts together, 0 leaves it to the license flow
+	Deadline time.Duration `mapstructure:"deadline"`
+	// Statuses are the response statuses retried
+	Statuses []int `mapstructure:"statuses"`
+	// Errors are the failures without a response retried: timeout or connection
+	Errors []string `mapstructure:"errors"`
+}
+
+// DefaultRetryPolicy retries gateway errors, timeouts and dropped connections twice, half a second and a second later
+func DefaultRetryPolicy() RetryPolicy {
+	p := RetryPolicy{
+		Attempts: 3,
+		Deadline: time.Minute,
+		Statuses: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		Errors:   []string{RetryOnTimeout, RetryOnConnection},
+	}
+	p.Backoff.Initial = 500 * time.Millisecond
+	p.Backoff.Max = 10 * time.Second
+	p.Backoff.Multiplier = 2
+	p.Backoff.Jitter = 0.2
+	return p
+}
+
+// nonIdempotentMethods change state on the simulator server, or spend the single-use auth code for accesstoken.
+// A call whose connection dropped, that timed out or that a gateway gave up on with a 502 or 504 may have been
+// carried out all the same, so they are only retried after a 503.
+var nonIdempotentMethods = []string{accessTokenRequestMethod, EndpointCreateLockbox, EndpointCreateDigitalAsset, EndpointIssueLicense}
+
+// defaultMethodRetryPolicies are the policies of methods that differ from base: recoverlockbox answers 504
+// while the lockbox is still being set up, so it waits longer before trying again, and the non-idempotent
+// methods leave out every failure that may have been carried out
+func defaultMethodRetryPolicies(base RetryPolicy) map[string]RetryPolicy {
+	recoverLockbox := base.clone()
+	recoverLockbox.Attempts = 4
+	recoverLockbox.Backoff.Initial = 10 * time.Second
+	recoverLockbox.Backoff.Multiplier = 1
+	recoverLockbox.Deadline = 2 * time.Minute
+	policies := map[string]RetryPolicy{strings.ToLower(RequestMethodRecoverLockbox): recoverLockbox}
+	for _, method := range nonIdempotentMethods {
+		policy := base.clone()
+		policy.Statuses = slices.DeleteFunc(policy.Statuses, func(status int) bool {
+			return status == http.StatusBadGateway || status == http.StatusGatewayTimeout
+		})
+		policy.Errors = nil
+		policies[method] = policy
+	}
+	return policies
+}
+
+// clone copies the policy, so decoding a config over the copy leaves p alone
+func (p RetryPolicy) clone() RetryPolicy {
+	p.Statuses = append([]int(nil), p.Statuses...)
+	p.Errors = append([]string(nil), p.Errors...)
+	return p
+}
+
+func (p RetryPolicy) validate() error {
+	switch {
+	case p.Attempts < 1:
+		return fmt.Errorf("attempts must be at least 1")
+	case p.Backoff.Initial < 0 || p.Backoff.Max < 0 || p.Deadline < 0:
+		return fmt.Errorf("durations must not be negative")
+	case p.Backoff.Multiplier < 1:
+		return fmt.Errorf("backoff.multiplier must be at least 1")
+	case p.Backoff.Jitter < 0 || p.Backoff.Jitter > 1:
+		return fmt.Errorf("backoff.jitter must be between 0 and 1")
+	}
+	for _, kind := range p.Errors {
+		if kind != RetryOnTimeout && kind != RetryOnConnection {
+			return fmt.Errorf("unknown error %q, want %s or %s", kind, RetryOnTimeout, RetryOnConnection)
+		}
+	}
+	return nil
+}
+
+// retryable reports whether err is worth another attempt under the policy
+func (p RetryPolicy) retryable(err error) bool {
+	var upstreamErr *UpstreamError
+	if !errors.As(err, &upstreamErr) {
+		return false
+	}
+	if upstreamErr.Err == nil {
+		for _, status := range p.Statuses {
+			if upstreamErr.StatusCode == status {
+				return true
+			}
+		}
+		return false
+	}
+	// the flow itself was cancelled or ran out of time, trying again cannot help
+	if errors.Is(upstreamErr.Err, context.Canceled) || errors.Is(upstreamErr.Err, context.DeadlineExceeded) {
+		return false
+	}
+	for _, kind := range p.Errors {
+		switch {
+		case kind == RetryOnTimeout && upstreamErr.Timeout():
+			return true
+		case kind == RetryOnConnection && isConnectionError(upstreamErr.Err):
+			return true
+		}
+	}
+	return false
+}
+
+// isConnectionError reports whether err is a connection refused, reset or closed before the response was read
+func isConnectionError(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && !opErr.Timeout()
+}
+
+// backoff returns the wait before retry number retry, counting from 1
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	wait := float64(p.Backoff.Initial) * math.Pow(p.Backoff.Multiplier, float64(retry-1))
+	if p.Backoff.Max > 0 && wait > float64(p.Backoff.Max) {
+		wait = float64(p.Backoff.Max)
+	}
+	if p.Backoff.Jitter > 0 {
+		wait *= 1 + p.Backoff.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(wait)
+}
+
+// RetryPolicies holds the retry policy of each simulator server method, MyAM calls are never retried
+type RetryPolicies struct {
+	Default RetryPolicy
+	Methods map[string]RetryPolicy
+}
+
+// For returns the policy of method, a nil *RetryPolicies never retries
+func (r *RetryPolicies) For(method string) RetryPolicy {
+	if r == nil {
+		return RetryPolicy{Attempts: 1}
+	}
+	if p, ok := r.Methods[strings.ToLower(method)]; ok {
+		return p
+	}
+	return r.Default
+}
+
+// DefaultRetryPolicies are the policies used unless the config overrides them: DefaultRetryPolicy, except for
+// recoverlockbox and the methods not safe to repeat after a call that may have been carried out
+func DefaultRetryPolicies() *RetryPolicies {
+	policy := DefaultRetryPolicy()
+	return &RetryPolicies{Default: policy, Methods: defaultMethodRetryPolicies(policy)}
+}
+
+// loadRetryPolicies reads retry.default and retry.methods.<method>, each method starting from the default
+// policy, or its built-in one, so a config only lists what it changes
+func loadRetryPolicies(v *viper.Viper) (*RetryPolicies, error) {
+	policies := &RetryPolicies{Default: DefaultRetryPolicy()}
+	if err := v.UnmarshalKey(RETRY_DEFAULT, &policies.Default); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", RETRY_DEFAULT, err)
+	}
+	if err := policies.Default.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", RETRY_DEFAULT, err)
+	}
+	policies.Methods = defaultMethodRetryPolicies(policies.Default)
+	methods := make(map[string]bool)
+	for method := range policies.Methods {
+		methods[method] = true
+	}
+	for method := range v.GetStringMap(RETRY_METHODS) {
+		methods[strings.ToLower(method)] = true
+	}
+	for method := range methods {
+		policy, ok := policies.Methods[method]
+		if !ok {
+			policy = policies.Default.clone()
+		}
+		key := RETRY_METHODS + "." + method
+		if err := v.UnmarshalKey(key, &policy); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", key, err)
+		}
+		if err := policy.validate(); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", key, err)
+		}
+		policies.Methods[method] = policy
+	}
+	return policies, nil
+}
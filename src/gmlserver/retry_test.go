@@ -0,0 +1,198 @@
+package gmlserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// sequenceSimServer answers each call with the next of its statuses, 0 fails the call without a response
+type sequenceSimServer struct {
+	statuses []int
+	calls    int
+}
+
+func (s *sequenceSimServer) Call(ctx context.Context, method string, req interface{}, expectedStatus int, resp interface{}) error {
+	status := s.statuses[s.calls]
+	s.calls++
+	switch status {
+	case expectedStatus:
+		return nil
+	case 0:
+		return &UpstreamError{Method: method, ExpectedStatus: expectedStatus, Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}}
+	default:
+		return &UpstreamError{Method: method, StatusCode: status, ExpectedStatus: expectedStatus}
+	}
+}
+
+func fastRetryPolicy(attempts int) RetryPolicy {
+	p := DefaultRetryPolicy()
+	p.Attempts = attempts
+	p.Backoff.Initial = time.Millisecond
+	return p
+}
+
+func TestSimServerCallRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		statuses []int
+		wantErr  bool
+		calls    int
+	}{
+		{"gateway errors then success", []int{502, 504, 202}, false, 3},
+		{"connection reset then success", []int{0, 202}, false, 2},
+		{"out of attempts", []int{503, 503, 503, 202}, true, 3},
+		{"not retryable", []int{400, 202}, true, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &sequenceSimServer{statuses: tc.statuses}
+			cfg := NewConfiguration("http://simserver.invalid", "http://myam.invalid")
+			cfg.SimServer = fake
+			cfg.Retry = &RetryPolicies{Default: fastRetryPolicy(3)}
+
+			err := SendRequestAndCheckResponse(context.Background(), cfg, requestObjectRequestMethod, "{}", http.StatusAccepted, nil)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("error = %v, want error %v", err, tc.wantErr)
+			}
+			if fake.calls != tc.calls {
+				t.Errorf("calls = %d, want %d", fake.calls, tc.calls)
+			}
+		})
+	}
+}
+
+func TestSimServerCallStopsAtDeadline(t *testing.T) {
+	fake := &sequenceSimServer{statuses: []int{503, 202}}
+	cfg := NewConfiguration("http://simserver.invalid", "http://myam.invalid")
+	cfg.SimServer = fake
+	policy := fastRetryPolicy(3)
+	policy.Backoff.Initial = time.Second
+	policy.Backoff.Jitter = 0
+	policy.Deadline = 100 * time.Millisecond
+	cfg.Retry = &RetryPolicies{Default: policy}
+
+	err := SendRequestAndCheckResponse(context.Background(), cfg, requestObjectRequestMethod, "{}", http.StatusAccepted, nil)
+	var upstreamErr *UpstreamError
+	if !errors.As(err, &upstreamErr) || upstreamErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("error = %v, want the 503 that could not be retried in time", err)
+	}
+	if fake.calls != 1 {
+		t.Errorf("calls = %d, want 1", fake.calls)
+	}
+}
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	p := DefaultRetryPolicy()
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&UpstreamError{StatusCode: http.StatusGatewayTimeout}, true},
+		{&UpstreamError{StatusCode: http.StatusInternalServerError}, false},
+		{&UpstreamError{Err: syscall.ECONNREFUSED}, true},
+		{&UpstreamError{Err: context.Canceled}, false},
+		{&UpstreamError{Err: context.DeadlineExceeded}, false},
+		{&FlowError{Step: StepCreateDA, Err: &UpstreamError{StatusCode: http.StatusBadGateway}}, true},
+		{errors.New("could not unmarshal"), false},
+	} {
+		if got := p.retryable(tc.err); got != tc.want {
+			t.Errorf("retryable(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestLoadRetryPolicies(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	err := v.ReadConfig(strings.NewReader(`
+retry:
+  default:
+    attempts: 5
+    statuses: [503]
+  methods:
+    createDA:
+      attempts: 2
+    recoverlockbox:
+      backoff:
+        initial: 20s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies, err := loadRetryPolicies(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := policies.For("issuelicense"); p.Attempts != 5 || len(p.Statuses) != 1 || p.Backoff.Initial != 500*time.Millisecond {
+		t.Errorf("issuelicense policy = %+v, want the default with 5 attempts and only 503", p)
+	}
+	if p := policies.For("createDA"); p.Attempts != 2 || len(p.Statuses) != 1 {
+		t.Errorf("createda policy = %+v, want the default with 2 attempts", p)
+	}
+	if p := policies.For(RequestMethodRecoverLockbox); p.Attempts != 4 || p.Backoff.Initial != 20*time.Second || p.Backoff.Multiplier != 1 {
+		t.Errorf("recoverlockbox policy = %+v, want its built-in policy starting at 20s", p)
+	}
+}
+
+func TestDefaultRetryPoliciesSkipAmbiguousNonIdempotentCalls(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(strings.NewReader("retry:\n  methods:\n    issuelicense:\n      errors: [timeout, connection]\n")); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadRetryPolicies(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		policies *RetryPolicies
+		method   string
+		// whether the calls that may have been carried out are retried
+		ambiguous bool
+	}{
+		{DefaultRetryPolicies(), requestObjectRequestMethod, true},
+		{DefaultRetryPolicies(), RequestMethodRecoverLockbox, true},
+		{DefaultRetryPolicies(), "retrievelicenserequest", true},
+		{DefaultRetryPolicies(), accessTokenRequestMethod, false},
+		{DefaultRetryPolicies(), EndpointCreateLockbox, false},
+		{DefaultRetryPolicies(), EndpointCreateDigitalAsset, false},
+		{DefaultRetryPolicies(), EndpointIssueLicense, false},
+		{loaded, EndpointCreateLockbox, false},
+	} {
+		policy := tc.policies.For(tc.method)
+		for name, err := range map[string]*UpstreamError{
+			"dropped connection": {Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}},
+			"timeout":            {Err: &net.OpError{Op: "read", Err: timeoutError{}}},
+			"502":                {StatusCode: http.StatusBadGateway},
+			"504":                {StatusCode: http.StatusGatewayTimeout},
+		} {
+			if got := policy.retryable(err); got != tc.ambiguous {
+				t.Errorf("%s retries a %s = %v, want %v", tc.method, name, got, tc.ambiguous)
+			}
+		}
+		// the server said it did not take the call on
+		if !policy.retryable(&UpstreamError{StatusCode: http.StatusServiceUnavailable}) {
+			t.Errorf("%s does not retry a 503", tc.method)
+		}
+	}
+
+	// a method's own errors put them back
+	policy := loaded.For(EndpointIssueLicense)
+	if !policy.retryable(&UpstreamError{Err: &net.OpError{Op: "read", Err: timeoutError{}}}) ||
+		!policy.retryable(&UpstreamError{Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}}) {
+		t.Errorf("%s with errors [timeout, connection] does not retry them", EndpointIssueLicense)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,122 @@
+package gmlserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SimServerClient calls the methods of a simulator server. Every flow function reaches the simulator server
+// through the Configuration's SimServer, so tests can swap in a fake.
+type SimServerClient interface {
+	// Call sends req to method, a string or []byte as is and anything else as JSON, and decodes the response into
+	// resp unless it is nil. A response without expectedStatus is returned as an *UpstreamError, as is a call
+	// that got no response.
+	Call(ctx context.Context, method string, req interface{}, expectedStatus int, resp interface{}) error
+}
+
+// HTTPSimServerClient is the default SimServerClient, it POSTs JSON to BaseURL/method
+type HTTPSimServerClient struct {
+	// BaseURL is the simulator server, ie. https://st-org10-app.stg.verified.me
+	BaseURL string
+	// Client sends the requests, http.DefaultClient if nil
+	Client *http.Client
+	// Timeout bounds each call on top of the caller's context, 0 leaves it to the context
+	Timeout time.Duration
+	// Header is sent with every request
+	Header http.Header
+	// Replayable are the methods, in lower case, sent again on a fresh connection when the pooled connection
+	// they were sent on turns out to be closed by the server
+	Replayable map[string]bool
+	// Logging switches the logging of request and response bodies to Logger at debug level, nil never logs them
+	Logging *Logging
+	Logger  *slog.Logger
+}
+
+// NewHTTPSimServerClient returns a client of baseURL sending its requests with client, replaying the methods
+// that only read
+func NewHTTPSimServerClient(baseURL string, client *http.Client) *HTTPSimServerClient {
+	return &HTTPSimServerClient{BaseURL: baseURL, Client: client, Replayable: defaultReplayableMethods()}
+}
+
+func (c *HTTPSimServerClient) Call(ctx context.Context, method string, req interface{}, expectedStatus int, resp interface{}) error {
+	var payload []byte
+	var err error
+	switch req := req.(type) {
+	case string:
+		payload = []byte(req)
+	case []byte:
+		payload = req
+	default:
+		payload, err = json.Marshal(req)
+		if err != nil {
+			return fmt.Errorf("unable to marshal request to %s, reason: %s", method, err)
+		}
+	}
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	httpReq, err := BuildRequest(ctx, http.MethodPost, strings.TrimSuffix(c.BaseURL, "/")+"/"+method, payload)
+	if err != nil {
+		return err
+	}
+	for name, values := range c.Header {
+		httpReq.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	if c.Replayable[strings.ToLower(method)] {
+		markReplayable(httpReq)
+	}
+	trace.SpanFromContext(ctx).SetAttributes(semconv.HTTPRequestMethodKey.String(http.MethodPost), semconv.URLFull(httpReq.URL.String()))
+	traceContext.Inject(ctx, propagation.HeaderCarrier(httpReq.Header))
+
+	logger := c.Logger
+	if logger == nil {
+		logger = myLogger
+	}
+	if c.Logging.LogBodies() {
+		logger.DebugContext(ctx, "--> send POST request to simulator server", "method", method, "body", redactBody("application/json", payload))
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	result, err := client.Do(httpReq)
+	if err != nil {
+		return &UpstreamError{Method: method, ExpectedStatus: expectedStatus, Err: err}
+	}
+	defer result.Body.Close()
+	body, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		return &UpstreamError{Method: method, StatusCode: result.StatusCode, ExpectedStatus: expectedStatus,
+			Err: fmt.Errorf("could not read response body :: %v", err)}
+	}
+	if c.Logging.LogBodies() {
+		logger.DebugContext(ctx, "<-- received response from simulator server", "method", method, "status", result.StatusCode, "body", redactBody(result.Header.Get("Content-Type"), body))
+	}
+
+	if result.StatusCode != expectedStatus {
+		return &UpstreamError{Method: method, StatusCode: result.StatusCode, ExpectedStatus: expectedStatus, Body: string(body)}
+	}
+	switch resp := resp.(type) {
+	case nil:
+	case *[]byte:
+		*resp = body
+	default:
+		if err = json.Unmarshal(body, resp); err != nil {
+			return fmt.Errorf("handler returned unexpected body: could not unmarshal into the structure we were expecting :: %v", err)
+		}
+	}
+	return nil
+}
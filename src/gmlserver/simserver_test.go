@@ -0,0 +1,115 @@
+package gmlserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSimServer answers every call with the status given for its method, recording the methods called
+type fakeSimServer struct {
+	status map[string]int
+	calls  []string
+}
+
+func (f *fakeSimServer) Call(ctx context.Context, method string, req interface{}, expectedStatus int, resp interface{}) error {
+	f.calls = append(f.calls, method)
+	if status := f.status[method]; status != expectedStatus {
+		return &UpstreamError{Method: method, StatusCode: status, ExpectedStatus: expectedStatus}
+	}
+	return nil
+}
+
+func TestLicenseFlowUsesSimServerClient(t *testing.T) {
+	fake := &fakeSimServer{status: map[string]int{requestObjectRequestMethod: http.StatusBadRequest}}
+	cfg := NewConfiguration("http://simserver.invalid", "http://myam.invalid")
+	cfg.SimServer = fake
+
+	_, err := getLicenseForDA(context.Background(), cfg, "alice", "secret", "request-id", "enc-key", nil)
+	var upstreamErr *UpstreamError
+	if !errors.As(err, &upstreamErr) || upstreamErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("getLicenseForDA error = %v, want the fake's 400", err)
+	}
+	if len(fake.calls) != 1 || fake.calls[0] != requestObjectRequestMethod {
+		t.Errorf("calls = %v, want [%s]", fake.calls, requestObjectRequestMethod)
+	}
+}
+
+func TestHTTPSimServerClientCall(t *testing.T) {
+	var gotHeader, gotPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader, gotPath = r.Header.Get("X-Env"), r.URL.Path
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"loginurl": "https://myam/authorize"}`))
+	}))
+	defer server.Close()
+
+	client := NewHTTPSimServerClient(server.URL+"/", server.Client())
+	client.Header = http.Header{"X-Env": {"stg"}}
+	resp := new(RequestObjectResp).Body
+	err := client.Call(context.Background(), requestObjectRequestMethod, map[string]string{}, http.StatusAccepted, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.LoginURL != "https://myam/authorize" {
+		t.Errorf("loginurl = %q", resp.LoginURL)
+	}
+	if gotPath != "/"+requestObjectRequestMethod || gotHeader != "stg" {
+		t.Errorf("got path %q and X-Env %q, want /%s and stg", gotPath, gotHeader, requestObjectRequestMethod)
+	}
+
+	err = client.Call(context.Background(), requestObjectRequestMethod, "{}", http.StatusOK, nil)
+	var upstreamErr *UpstreamError
+	if !errors.As(err, &upstreamErr) || upstreamErr.StatusCode != http.StatusAccepted {
+		t.Errorf("unexpected status error = %v, want an UpstreamError with 202", err)
+	}
+}
+
+func TestHTTPSimServerClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := NewHTTPSimServerClient(server.URL, server.Client())
+	client.Timeout = 50 * time.Millisecond
+	err := client.Call(context.Background(), requestObjectRequestMethod, "{}", http.StatusAccepted, nil)
+	var upstreamErr *UpstreamError
+	if !errors.As(err, &upstreamErr) || !upstreamErr.Timeout() {
+		t.Fatalf("error = %v, want an UpstreamError timing out", err)
+	}
+}
+
+func TestHTTPSimServerClientLogsRedactedBodies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"accesstoken": "secret-token"}`))
+	}))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	logging := new(Logging)
+	logging.Level.Set(slog.LevelDebug)
+	logging.SetLogBodies(true)
+	client := NewHTTPSimServerClient(server.URL, server.Client())
+	client.Logging, client.Logger = logging, slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: &logging.Level}))
+	err := client.Call(context.Background(), accessTokenRequestMethod, map[string]string{"password": "secret-password"}, http.StatusAccepted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logs.String(), "secret-") || strings.Count(logs.String(), redacted) != 2 {
+		t.Errorf("logged bodies = %s, want both redacted", logs.String())
+	}
+}
@@ -0,0 +1,42 @@
+package gmlserver
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// outcomes reported in StepEvent
+const (
+	StepStarted   = "started"
+	StepSucceeded = "succeeded"
+	StepFailed    = "failed"
+)
+
+// runStep runs fn as the named step of the license flow, reporting its start and end to observer
+// and logging its outcome. fn's context tags its log entries with the step.
+// A failure is returned as a *FlowError for that step.
+func runStep(ctx context.Context, cfg *Configuration, observer func(StepEvent), step string, fn func(ctx context.Context) error) error {
+	ctx = withStep(ctx, step)
+	event := StepEvent{Step: step, Outcome: StepStarted, StartedAt: time.Now().UTC()}
+	observer(event)
+	cfg.logger().DebugContext(ctx, "step started")
+
+	err := fn(ctx)
+	event.DurationMs = time.Since(event.StartedAt).Milliseconds()
+	if err != nil {
+		cfg.logger().ErrorContext(ctx, "step failed", "durationMs", event.DurationMs, "err", err)
+		event.Outcome = StepFailed
+		event.Error = err.Error()
+		var upstreamErr *UpstreamError
+		if errors.As(err, &upstreamErr) {
+			event.UpstreamStatus = upstreamErr.StatusCode
+		}
+		observer(event)
+		return &FlowError{Step: step, Err: err}
+	}
+	event.Outcome = StepSucceeded
+	observer(event)
+	cfg.logger().InfoContext(ctx, "step succeeded", "durationMs", event.DurationMs)
+	return nil
+}
@@ -0,0 +1,102 @@
+package gmlserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(caFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle %s: %v", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in CA bundle %s", caFile)
+	}
+	return pool, nil
+}
+
+// serverTLSConfig verifies client certificates against the CA bundle, and then that the subject of the
+// client's certificate fully matches one of the patterns. It returns nil if caFile is empty.
+func serverTLSConfig(caFile string, subjectPatterns []string) (*tls.Config, error) {
+	if caFile == "" {
+		if len(subjectPatterns) != 0 {
+			return nil, fmt.Errorf("%s needs %s", HTTP_TLS_CLIENT_SUBJECTS, HTTP_TLS_CLIENT_CA_FILE)
+		}
+		return nil, nil
+	}
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	subjects := make([]*regexp.Regexp, len(subjectPatterns))
+	for i, pattern := range subjectPatterns {
+		subjects[i], err = regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %v", HTTP_TLS_CLIENT_SUBJECTS, pattern, err)
+		}
+	}
+
+	return &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+		MinVersion: tls.VersionTLS12,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(subjects) == 0 {
+				return nil
+			}
+			subject := cs.PeerCertificates[0].Subject.String()
+			for _, allowed := range subjects {
+				if allowed.MatchString(subject) {
+					return nil
+				}
+			}
+			return fmt.Errorf("client certificate subject %q is not allowed", subject)
+		},
+	}, nil
+}
+
+// clientTLSConfig presents the client certificate to an upstream and trusts the CA bundle instead of the
+// system roots. It returns nil if neither is configured.
+func clientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(filepath.Clean(certFile), filepath.Clean(keyFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate %s: %v", certFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// upstreamTLSConfig reads the client certificate and CA bundle of the upstream whose keys start with prefix, ie. simserver
+func upstreamTLSConfig(v *viper.Viper, prefix string) (*tls.Config, error) {
+	tlsConfig, err := clientTLSConfig(
+		v.GetString(prefix+UPSTREAM_TLS_CERT_FILE),
+		v.GetString(prefix+UPSTREAM_TLS_KEY_FILE),
+		v.GetString(prefix+UPSTREAM_TLS_CA_FILE))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", strings.TrimSuffix(prefix, "."), err)
+	}
+	return tlsConfig, nil
+}
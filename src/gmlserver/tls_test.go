@@ -0,0 +1,125 @@
+package gmlserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues client certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gml test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// writePEM writes the CA certificate to a file in a temporary directory
+func (ca *testCA) writePEM(t *testing.T) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// issue returns a client certificate for subject signed by the CA
+func (ca *testCA) issue(t *testing.T, subject pkix.Name) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestServerTLSConfigClientSubjects(t *testing.T) {
+	ca := newTestCA(t)
+	tlsConfig, err := serverTLSConfig(ca.writePEM(t), []string{`CN=ci,O=Acme`, `CN=ops-[0-9]+`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = tlsConfig
+	// the rejected handshakes are the point of the test
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name   string
+		certs  []tls.Certificate
+		wantOK bool
+	}{
+		{"matching subject", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "ci", Organization: []string{"Acme"}})}, true},
+		{"matching pattern", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "ops-1"})}, true},
+		{"subject not allowed", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "intruder"})}, false},
+		// patterns match the whole subject
+		{"partial match", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "ci", Organization: []string{"Acme"}, Country: []string{"CA"}})}, false},
+		{"another CA", []tls.Certificate{newTestCA(t).issue(t, pkix.Name{CommonName: "ci", Organization: []string{"Acme"}})}, false},
+		{"no certificate", nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			transport := server.Client().Transport.(*http.Transport).Clone()
+			transport.TLSClientConfig.Certificates = tc.certs
+			client := &http.Client{Transport: transport}
+			resp, err := client.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err == nil) != tc.wantOK {
+				t.Errorf("GET with the client certificate = %v, want ok %v", err, tc.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package gmlserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	tracerName = "github.com/alialkhalidi/da-license-proxy/src/gmlserver"
+
+	TracingExporterNone   = "none"
+	TracingExporterStdout = "stdout"
+	TracingExporterOTLP   = "otlp"
+
+	defaultTracingServiceName = "gml"
+)
+
+// traceContext reads and writes the W3C traceparent and tracestate headers
+var traceContext = propagation.TraceContext{}
+
+func (c *Configuration) tracer() trace.Tracer {
+	if c.TracerProvider != nil {
+		return c.TracerProvider.Tracer(tracerName)
+	}
+	return noop.NewTracerProvider().Tracer(tracerName)
+}
+
+// newTracerProvider returns a provider batching spans to the exporter, nil if exporter is none or empty.
+// Without an endpoint the OTLP exporter follows the OTEL_EXPORTER_OTLP_* environment variables.
+func newTracerProvider(ctx context.Context, exporter, endpoint string, insecure bool, serviceName string) (*sdktrace.TracerProvider, error) {
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(exporter) {
+	case "", TracingExporterNone:
+		return nil, nil
+	case TracingExporterStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TracingExporterOTLP:
+		var opts []otlptracehttp.Option
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		if insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		spanExporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q, want none, stdout or otlp", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s span exporter: %v", exporter, err)
+	}
+
+	if serviceName == "" {
+		serviceName = defaultTracingServiceName
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tracing resource: %v", err)
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(spanExporter), sdktrace.WithResource(res)), nil
+}
+
+// startClientSpan starts the span of an outbound call and sends its trace context with req
+func startClientSpan(tracer trace.Tracer, name string, req *http.Request) (*http.Request, trace.Span) {
+	ctx, span := tracer.Start(req.Context(), name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLFull(req.URL.String()),
+		))
+	req = req.WithContext(ctx)
+	traceContext.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req, span
+}
+
+// endClientSpan records the outcome of an outbound call, statusCode is 0 when no response was received
+func endClientSpan(span trace.Span, statusCode int, err error) {
+	if statusCode != 0 {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(statusCode))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startFlowSpan starts the root span of a license flow
+func startFlowSpan(ctx context.Context, cfg *Configuration, licenseRequestID string) (context.Context, trace.Span) {
+	return cfg.tracer().Start(ctx, "getLicenseForDA", trace.WithAttributes(
+		attribute.String("gml.caller", CallerFrom(ctx)),
+		attribute.String("gml.user", logFieldsFrom(ctx).user),
+		attribute.String("gml.license_request_id", licenseRequestID),
+	))
+}
+
+// traceContextHandler continues the caller's trace, if it sent a traceparent header
+func traceContextHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// detachContext returns ctx carrying the log fields, trace and capture of from, for work that outlives the request it came from
+func detachContext(ctx, from context.Context) context.Context {
+	ctx = context.WithValue(ctx, logFieldsKey{}, logFieldsFrom(from))
+	ctx = withCapture(ctx, captureFrom(from))
+	return trace.ContextWithSpanContext(ctx, trace.SpanContextFromContext(from))
+}
@@ -0,0 +1,240 @@
+package gmlserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	testTraceID    = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentSpan = "00f067aa0ba902b7"
+)
+
+// authUpstream plays the simulator server and MyAM through the auth step, failing accesstoken
+// so the flow ends there. It keeps the traceparent header of every request it receives.
+type authUpstream struct {
+	*httptest.Server
+	mu          sync.Mutex
+	traceparent map[string]string
+}
+
+func newAuthUpstream(t *testing.T) *authUpstream {
+	u := &authUpstream{traceparent: make(map[string]string)}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.mu.Lock()
+		u.traceparent[r.URL.Path] = r.Header.Get("traceparent")
+		u.mu.Unlock()
+		switch r.URL.Path {
+		case "/" + requestObjectRequestMethod:
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]string{"loginurl": u.URL + "/myam/oidc/authorize?client_id=myClientID"})
+		case "/myam/oidc/authorize", "/myam/oidc/authenticate", "/myam/oidc/login":
+			w.WriteHeader(http.StatusOK)
+		case "/myam/oidc/consent":
+			http.Redirect(w, r, "/callback?code=authcode", http.StatusFound)
+		case "/" + accessTokenRequestMethod:
+			http.Error(w, "no token for you", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *authUpstream) traceparentFor(path string) string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.traceparent[path]
+}
+
+func newTestTracerProvider(t *testing.T) (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+	return tp, exporter
+}
+
+func spansByName(spans tracetest.SpanStubs) map[string]tracetest.SpanStub {
+	byName := make(map[string]tracetest.SpanStub, len(spans))
+	for _, span := range spans {
+		byName[span.Name] = span
+	}
+	return byName
+}
+
+func TestLicenseFlowSpans(t *testing.T) {
+	upstream := newAuthUpstream(t)
+	tp, exporter := newTestTracerProvider(t)
+	cfg := NewConfiguration(upstream.URL, upstream.URL)
+	cfg.TracerProvider = tp
+
+	_, err := getLicenseForDA(context.Background(), cfg, "alice", "secret", "request-id", "enc-key", nil)
+	var flowErr *FlowError
+	if !errors.As(err, &flowErr) || flowErr.Step != StepAuth {
+		t.Fatalf("getLicenseForDA error = %v, want a failure of the auth step", err)
+	}
+
+	spans := spansByName(exporter.GetSpans())
+	root, ok := spans["getLicenseForDA"]
+	if !ok {
+		t.Fatalf("no getLicenseForDA span in %v", spans)
+	}
+	if root.Parent.IsValid() {
+		t.Errorf("getLicenseForDA has parent %v, want a root span", root.Parent.SpanID())
+	}
+	if root.Status.Code != codes.Error {
+		t.Errorf("getLicenseForDA status = %v, want %v", root.Status.Code, codes.Error)
+	}
+
+	children := []string{
+		"simserver requestobject",
+		"myam authorize",
+		"myam authenticate",
+		"myam login",
+		"myam consent",
+		"simserver accesstoken",
+	}
+	for _, name := range children {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %q span", name)
+			continue
+		}
+		if span.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("%q parent = %v, want getLicenseForDA %v", name, span.Parent.SpanID(), root.SpanContext.SpanID())
+		}
+		if span.SpanKind != trace.SpanKindClient {
+			t.Errorf("%q kind = %v, want client", name, span.SpanKind)
+		}
+	}
+	if len(spans) != len(children)+1 {
+		t.Errorf("got %d spans, want %d", len(spans), len(children)+1)
+	}
+
+	failed := spans["simserver accesstoken"]
+	if failed.Status.Code != codes.Error {
+		t.Errorf("accesstoken status = %v, want %v", failed.Status.Code, codes.Error)
+	}
+	var statusCode int64
+	for _, attr := range failed.Attributes {
+		if attr.Key == semconv.HTTPResponseStatusCodeKey {
+			statusCode = attr.Value.AsInt64()
+		}
+	}
+	if statusCode != http.StatusInternalServerError {
+		t.Errorf("accesstoken %s = %d, want %d", semconv.HTTPResponseStatusCodeKey, statusCode, http.StatusInternalServerError)
+	}
+	if consent := spans["myam consent"]; consent.Status.Code == codes.Error {
+		t.Errorf("consent redirect with an auth code recorded as an error: %v", consent.Status.Description)
+	}
+}
+
+func TestLicenseFlowSendsTraceContext(t *testing.T) {
+	upstream := newAuthUpstream(t)
+	tp, exporter := newTestTracerProvider(t)
+	cfg := NewConfiguration(upstream.URL, upstream.URL)
+	cfg.TracerProvider = tp
+
+	getLicenseForDA(context.Background(), cfg, "alice", "secret", "request-id", "enc-key", nil)
+
+	spans := spansByName(exporter.GetSpans())
+	for path, name := range map[string]string{
+		"/requestobject":          "simserver requestobject",
+		"/myam/oidc/authorize":    "myam authorize",
+		"/myam/oidc/authenticate": "myam authenticate",
+		"/myam/oidc/login":        "myam login",
+		"/myam/oidc/consent":      "myam consent",
+		"/accesstoken":            "simserver accesstoken",
+	} {
+		span := spans[name].SpanContext
+		want := "00-" + span.TraceID().String() + "-" + span.SpanID().String() + "-01"
+		if got := upstream.traceparentFor(path); got != want {
+			t.Errorf("%s traceparent = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func newTestServer(t *testing.T, upstream *authUpstream, tp trace.TracerProvider) *GmlServer {
+	cfgFile, err := ioutil.TempFile(t.TempDir(), "*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgFile.WriteString("simserver:\n  url: " + upstream.URL + "\nmyam:\n  url: " + upstream.URL + "\n")
+	cfgFile.Close()
+	server, err := NewGmlServer(cfgFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.config.TracerProvider = tp
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func TestLicenseFlowContinuesCallerTrace(t *testing.T) {
+	upstream := newAuthUpstream(t)
+	tp, exporter := newTestTracerProvider(t)
+	server := newTestServer(t, upstream, tp)
+
+	body := `{"username": "alice", "password": "secret", "requestID": "request-id", "requestEncKey": "enc-key"}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/licenses", strings.NewReader(body))
+	req.Header.Set("traceparent", "00-"+testTraceID+"-"+testParentSpan+"-01")
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("POST /v1/licenses = %d, want %d: %s", rec.Code, http.StatusBadGateway, rec.Body)
+	}
+
+	root, ok := spansByName(exporter.GetSpans())["getLicenseForDA"]
+	if !ok {
+		t.Fatal("no getLicenseForDA span")
+	}
+	if root.SpanContext.TraceID().String() != testTraceID {
+		t.Errorf("trace ID = %v, want the caller's %v", root.SpanContext.TraceID(), testTraceID)
+	}
+	if root.Parent.SpanID().String() != testParentSpan || !root.Parent.IsRemote() {
+		t.Errorf("parent = %v (remote %v), want the caller's span %v", root.Parent.SpanID(), root.Parent.IsRemote(), testParentSpan)
+	}
+}
+
+func TestLicenseJobContinuesCallerTrace(t *testing.T) {
+	upstream := newAuthUpstream(t)
+	tp, exporter := newTestTracerProvider(t)
+	server := newTestServer(t, upstream, tp)
+
+	body := `{"username": "alice", "password": "secret", "requestID": "request-id", "requestEncKey": "enc-key"}`
+	req := httptest.NewRequest(http.MethodPost, licenseJobsPath, strings.NewReader(body))
+	req.Header.Set("traceparent", "00-"+testTraceID+"-"+testParentSpan+"-01")
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("POST %s = %d, want %d: %s", licenseJobsPath, rec.Code, http.StatusAccepted, rec.Body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.jobs.wait(ctx); err != nil {
+		t.Fatalf("job did not finish: %v", err)
+	}
+	root, ok := spansByName(exporter.GetSpans())["getLicenseForDA"]
+	if !ok {
+		t.Fatal("no getLicenseForDA span")
+	}
+	if root.SpanContext.TraceID().String() != testTraceID {
+		t.Errorf("trace ID = %v, want the caller's %v", root.SpanContext.TraceID(), testTraceID)
+	}
+}
@@ -0,0 +1,120 @@
+package gmlserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TransportSettings tunes the connection pool of an upstream client
+type TransportSettings struct {
+	Idle struct {
+		// Timeout closes pooled connections idle this long, keep it below the upstream's own keep-alive timeout
+		// so GML drops a connection before the server does
+		Timeout time.Duration `mapstructure:"timeout"`
+		// Conns is the most idle connections kept to the upstream
+		Conns int `mapstructure:"conns"`
+	} `mapstructure:"idle"`
+	// MaxConns caps the connections to the upstream, idle or not, 0 is unlimited
+	MaxConns int `mapstructure:"maxconns"`
+	Dial     struct {
+		Timeout time.Duration `mapstructure:"timeout"`
+	} `mapstructure:"dial"`
+	// HTTP2 is used where the upstream offers it over TLS
+	HTTP2 bool `mapstructure:"http2"`
+}
+
+// DefaultTransportSettings keeps up to 32 connections idle for 45s, under the 60s of most load balancers
+func DefaultTransportSettings() TransportSettings {
+	var s TransportSettings
+	s.Idle.Timeout = 45 * time.Second
+	s.Idle.Conns = 32
+	s.Dial.Timeout = 10 * time.Second
+	s.HTTP2 = true
+	return s
+}
+
+func (s TransportSettings) validate() error {
+	switch {
+	case s.Idle.Timeout < 0 || s.Dial.Timeout < 0:
+		return fmt.Errorf("durations must not be negative")
+	case s.Idle.Conns < 0 || s.MaxConns < 0:
+		return fmt.Errorf("connection counts must not be negative")
+	}
+	return nil
+}
+
+// newTransport returns a pooled transport of its own. Requests are replayed on a fresh connection when a pooled one
+// turns out to be closed by the server, if they are idempotent, see markReplayable.
+func newTransport(tlsConfig *tls.Config, settings TransportSettings) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// the transport adds its protocols to the config, keep them from leaking into the caller's
+	transport.TLSClientConfig = tlsConfig.Clone()
+	transport.DialContext = (&net.Dialer{Timeout: settings.Dial.Timeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.IdleConnTimeout = settings.Idle.Timeout
+	transport.MaxIdleConns = settings.Idle.Conns
+	transport.MaxIdleConnsPerHost = settings.Idle.Conns
+	transport.MaxConnsPerHost = settings.MaxConns
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetHTTP1(true)
+	transport.Protocols.SetHTTP2(settings.HTTP2)
+	return transport
+}
+
+// newUpstreamClient returns a client of upstream with its own pooled transport using tlsConfig, which may be nil.
+// The exchanges of flows being captured are recorded.
+func newUpstreamClient(upstream string, tlsConfig *tls.Config, settings TransportSettings, timeout time.Duration) *http.Client {
+	return &http.Client{Transport: &captureTransport{upstream: upstream, base: newTransport(tlsConfig, settings)}, Timeout: timeout}
+}
+
+// wrapTransport returns a copy of client whose calls to upstream go through wrap, beneath the capture of an upstream
+// client so captures still see them. A nil client stands for http.DefaultClient.
+func wrapTransport(client *http.Client, upstream string, wrap func(upstream string, base http.RoundTripper) http.RoundTripper) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	wrapped := *client
+	switch transport := client.Transport.(type) {
+	case *captureTransport:
+		wrapped.Transport = &captureTransport{upstream: transport.upstream, base: wrap(upstream, transport.base)}
+	case nil:
+		wrapped.Transport = wrap(upstream, http.DefaultTransport)
+	default:
+		wrapped.Transport = wrap(upstream, transport)
+	}
+	return &wrapped
+}
+
+// markReplayable lets the transport send req again on a fresh connection if the pooled one it was sent on was
+// closed by the server before answering. A nil Idempotency-Key marks it without sending the header.
+func markReplayable(req *http.Request) {
+	req.Header["Idempotency-Key"] = nil
+}
+
+// defaultReplayableMethods are the simulator server methods that only read, so sending one twice does no harm
+func defaultReplayableMethods() map[string]bool {
+	return map[string]bool{
+		requestObjectRequestMethod:                         true,
+		strings.ToLower(RequestMethodRetrieveCurrentTerms): true,
+		strings.ToLower(RequestMethodRecoverLockbox):       true,
+		"retrievelicenserequest":                           true,
+	}
+}
+
+// loadTransportSettings reads the transport settings under prefix, ie. simserver., starting from the defaults
+func loadTransportSettings(v *viper.Viper, prefix string) (TransportSettings, error) {
+	settings := DefaultTransportSettings()
+	key := prefix + UPSTREAM_TRANSPORT
+	if err := v.UnmarshalKey(key, &settings); err != nil {
+		return settings, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	if err := settings.validate(); err != nil {
+		return settings, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return settings, nil
+}
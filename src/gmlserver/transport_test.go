@@ -0,0 +1,144 @@
+package gmlserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// staleServer answers the first request on each connection and hangs up on the next one without answering,
+// like a server closing a keep-alive connection just as the client reuses it
+func staleServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for served := 0; ; served++ {
+					req, err := http.ReadRequest(reader)
+					if err != nil {
+						return
+					}
+					io.Copy(ioutil.Discard, req.Body)
+					if served > 0 {
+						return
+					}
+					io.WriteString(conn, "HTTP/1.1 202 Accepted\r\nContent-Length: 0\r\n\r\n")
+				}
+			}()
+		}
+	}()
+	return "http://" + listener.Addr().String()
+}
+
+func TestStaleConnectionReplay(t *testing.T) {
+	for _, tc := range []struct {
+		method  string
+		wantErr bool
+	}{
+		{requestObjectRequestMethod, false},
+		{EndpointCreateDigitalAsset, true},
+	} {
+		t.Run(tc.method, func(t *testing.T) {
+			client := NewHTTPSimServerClient(staleServer(t), newUpstreamClient(UpstreamSimServer, nil, DefaultTransportSettings(), 0))
+			if err := client.Call(context.Background(), tc.method, "{}", http.StatusAccepted, nil); err != nil {
+				t.Fatal(err)
+			}
+			err := client.Call(context.Background(), tc.method, "{}", http.StatusAccepted, nil)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("call on the stale connection error = %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestTransportHTTP2(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	tlsConfig := &tls.Config{RootCAs: server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+
+	for _, http2 := range []bool{true, false} {
+		settings := DefaultTransportSettings()
+		settings.HTTP2 = http2
+		resp, err := newUpstreamClient(UpstreamSimServer, tlsConfig, settings, 0).Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if want := map[bool]int{true: 2, false: 1}[http2]; resp.ProtoMajor != want {
+			t.Errorf("http2 %v: got HTTP/%d, want HTTP/%d", http2, resp.ProtoMajor, want)
+		}
+	}
+}
+
+// flowMethods are the simulator server calls of a license flow that recovers its lockbox
+var flowMethods = []string{requestObjectRequestMethod, accessTokenRequestMethod, "recoverlockbox", EndpointCreateDigitalAsset,
+	"retrievelicenserequest", EndpointIssueLicense}
+
+// BenchmarkLicenseFlowCalls makes the simulator server calls of one license flow over TLS per op, on pooled
+// connections and, as BuildRequest did with Connection: close, on a new connection each
+func BenchmarkLicenseFlowCalls(b *testing.B) {
+	var conns atomic.Int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	tlsConfig := &tls.Config{RootCAs: server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+
+	for _, bc := range []struct {
+		name      string
+		keepAlive bool
+		http2     bool
+	}{
+		{"connection_close", false, false},
+		{"pooled_http1", true, false},
+		{"pooled_http2", true, true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			settings := DefaultTransportSettings()
+			settings.HTTP2 = bc.http2
+			transport := newTransport(tlsConfig, settings)
+			transport.DisableKeepAlives = !bc.keepAlive
+			httpClient := &http.Client{Transport: transport}
+			client := NewHTTPSimServerClient(server.URL, httpClient)
+			conns.Store(0)
+			b.ResetTimer()
+			for b.Loop() {
+				for _, method := range flowMethods {
+					if err := client.Call(context.Background(), method, "{}", http.StatusAccepted, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(conns.Load())/float64(b.N), "conns/op")
+			httpClient.CloseIdleConnections()
+		})
+	}
+}
@@ -1,8 +1,10 @@
 package gmlserver
 
 import (
+	"context"
 	cryptorandom "crypto/rand"
 	"strings"
+	"time"
 
 	"encoding/base64"
 )
@@ -32,7 +34,7 @@ func GenerateRandomBytes(n int) ([]byte, error) {
 	_, err := cryptorandom.Read(b)
 	// Note that err == nil only if we read len(b) bytes.
 	if err != nil {
-		myLogger.Printf("cryptorandom read error: %v", err)
+		myLogger.Error("cryptorandom read error", "err", err)
 		return nil, err
 	}
 
@@ -47,3 +49,15 @@ func Base64URLDecode(data string) ([]byte, error) {
 	}
 	return base64.RawURLEncoding.DecodeString(data)
 }
+
+// sleepContext pauses for d, returning early with the context's error if ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
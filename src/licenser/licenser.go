@@ -0,0 +1,183 @@
+// Package licenser gets DA licenses for MyAM users in-process, running the same flow
+// as the gml server's /v1/licenses endpoint without having to run the gml binary.
+//
+//	l, err := licenser.New(
+//		licenser.WithSimServerURL("https://st-org10-app.stg.verified.me"),
+//		licenser.WithMyAMURL("https://st-peerorg10-myam.stg.verified.me"),
+//	)
+//	license, err := l.GetLicense(ctx, licenser.Credentials{Username: "user", Password: "pass"}, requestID, encKey)
+package licenser
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/alialkhalidi/da-license-proxy/src/gmlserver"
+)
+
+// errors returned by GetLicense, use errors.As to find the failed step and upstream status
+type (
+	FlowError     = gmlserver.FlowError
+	UpstreamError = gmlserver.UpstreamError
+	StepEvent     = gmlserver.StepEvent
+)
+
+// Credentials of the MyAM user the license is issued for
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Licenser runs the license flow against one simulator server and MyAM instance, it is safe for concurrent use
+type Licenser struct {
+	config   *gmlserver.Configuration
+	observer func(StepEvent)
+}
+
+type options struct {
+	simServerURL string
+	myamURL      string
+	httpClient   *http.Client
+	logger       *slog.Logger
+	assetTypes   []string
+	observer     func(StepEvent)
+	registerer   prometheus.Registerer
+	tracer       trace.TracerProvider
+	credentials  *gmlserver.CredentialStore
+	simServer    gmlserver.SimServerClient
+	breakers     *gmlserver.BreakerSettings
+	cassette     *gmlserver.Cassette
+	recoverDelay *time.Duration
+}
+
+// Option configures a Licenser
+type Option func(*options)
+
+// WithSimServerURL sets the app simulator server the flow talks to, ie. https://st-org10-app.stg.verified.me
+func WithSimServerURL(simServerURL string) Option {
+	return func(o *options) { o.simServerURL = simServerURL }
+}
+
+// WithMyAMURL sets the MyAM instance users authenticate with, ie. https://st-peerorg10-myam.stg.verified.me
+func WithMyAMURL(myamURL string) Option {
+	return func(o *options) { o.myamURL = myamURL }
+}
+
+// WithHTTPClient sets the client used for both the simulator server and MyAM
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) { o.httpClient = client }
+}
+
+// WithLogger sets where the flow logs, by default it logs text to standard error.
+// Entries logged for a context from WithRequestID carry its request ID.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// WithAssetTypes sets the digital assets created and licensed, by default the foundational identity
+func WithAssetTypes(assetTypes ...string) Option {
+	return func(o *options) { o.assetTypes = assetTypes }
+}
+
+// WithStepObserver is called as each step of the flow starts and ends
+func WithStepObserver(observer func(StepEvent)) Option {
+	return func(o *options) { o.observer = observer }
+}
+
+// WithPrometheusRegisterer registers the flow's metrics, the same as the gml server's /metrics, with reg
+func WithPrometheusRegisterer(reg prometheus.Registerer) Option {
+	return func(o *options) { o.registerer = reg }
+}
+
+// WithRequestID returns a context that tags the flow's log entries with requestID and sends it
+// as the X-Request-ID header of every simulator server and MyAM call
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return gmlserver.WithRequestID(ctx, requestID)
+}
+
+// WithTracerProvider traces each GetLicense call, with a child span for every simulator server and MyAM call.
+// The W3C trace context is sent on those calls.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *options) { o.tracer = tp }
+}
+
+// WithCredentialStore looks up the password of users whose Credentials leave it empty
+func WithCredentialStore(store *gmlserver.CredentialStore) Option {
+	return func(o *options) { o.credentials = store }
+}
+
+// WithSimServerClient calls the simulator server through client instead of over HTTP, ie. a fake in tests
+func WithSimServerClient(client gmlserver.SimServerClient) Option {
+	return func(o *options) { o.simServer = client }
+}
+
+// WithCircuitBreakers fails GetLicense fast with an error matching gmlserver.ErrCircuitOpen while the simulator
+// server or MyAM keeps failing, each upstream having its own breaker. By default every call is attempted.
+func WithCircuitBreakers(settings gmlserver.BreakerSettings) Option {
+	return func(o *options) { o.breakers = &settings }
+}
+
+// WithCassette records the simulator server and MyAM exchanges of every GetLicense call to cassette, or answers
+// them from it, see gmlserver.NewCassette and gmlserver.OpenCassette
+func WithCassette(cassette *gmlserver.Cassette) Option {
+	return func(o *options) { o.cassette = cassette }
+}
+
+// WithRecoverLockboxDelay sets the wait before recovering the user's lockbox, 10s by default so a lockbox set up
+// moments ago has propagated; tests against a fake simulator server can set 0
+func WithRecoverLockboxDelay(delay time.Duration) Option {
+	return func(o *options) { o.recoverDelay = &delay }
+}
+
+// New returns a Licenser, the simulator server and MyAM URLs are required
+func New(opts ...Option) (*Licenser, error) {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.simServerURL == "" {
+		return nil, fmt.Errorf("licenser: simulator server URL is required")
+	}
+	if o.myamURL == "" {
+		return nil, fmt.Errorf("licenser: MyAM URL is required")
+	}
+
+	config := gmlserver.NewConfiguration(o.simServerURL, o.myamURL)
+	if o.httpClient != nil {
+		config.SimServer = gmlserver.NewHTTPSimServerClient(o.simServerURL, o.httpClient)
+		config.MyAMClient = o.httpClient
+	}
+	config.Logger = o.logger
+	config.AssetTypes = o.assetTypes
+	config.TracerProvider = o.tracer
+	config.Credentials = o.credentials
+	if o.simServer != nil {
+		config.SimServer = o.simServer
+	}
+	if o.registerer != nil {
+		config.Metrics = gmlserver.NewMetrics(o.registerer)
+	}
+	if o.breakers != nil {
+		config.SimServerBreaker = gmlserver.NewCircuitBreaker(gmlserver.UpstreamSimServer, *o.breakers, config.Metrics)
+		config.MyAMBreaker = gmlserver.NewCircuitBreaker(gmlserver.UpstreamMyAM, *o.breakers, config.Metrics)
+	}
+	if o.recoverDelay != nil {
+		config.RecoverLockboxDelay = *o.recoverDelay
+	}
+	if o.cassette != nil {
+		o.cassette.Apply(config)
+	}
+	return &Licenser{config: config, observer: o.observer}, nil
+}
+
+// GetLicense runs the license flow for the user and returns the DA license for the DAC's license request.
+// On failure the error is a *FlowError naming the step that failed.
+func (l *Licenser) GetLicense(ctx context.Context, creds Credentials, requestID, encKey string) (string, error) {
+	return gmlserver.GetLicenseForDA(ctx, l.config, creds.Username, creds.Password, requestID, encKey, l.observer)
+}
@@ -0,0 +1,528 @@
+// openapigen writes an OpenAPI 3 document for a package from its go-swagger style annotations:
+//
+//	swagger:route METHOD /path tag operationID   on a handler, followed by a summary, a description,
+//	                                              an optional "produces: a/b, c/d" line and a responses: block
+//	swagger:parameters operationID...             on a struct whose fields are "in: body", "in: path", "in: query" or "in: header"
+//	swagger:response name                         on a struct whose Body field is the response payload
+//	swagger:model name                            renames the schema of a struct
+//
+// swagger:parameters and swagger:response annotations naming an operation that has no route describe
+// the simulator server methods GML calls, they are listed under x-simserver-methods.
+//
+// usage: go run ../openapigen -dir . -out openapi.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var responseLine = regexp.MustCompile(`^(\d{3}|default):\s*(\w+)$`)
+
+type document struct {
+	OpenAPI    string                 `json:"openapi"`
+	Info       info                   `json:"info"`
+	Paths      map[string]pathItem    `json:"paths"`
+	Components components             `json:"components"`
+	SimServer  map[string]interface{} `json:"x-simserver-methods,omitempty"`
+}
+
+type info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type components struct {
+	Schemas map[string]interface{} `json:"schemas"`
+}
+
+type pathItem map[string]*operation
+
+type operation struct {
+	Tags        []string               `json:"tags,omitempty"`
+	Summary     string                 `json:"summary,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	OperationID string                 `json:"operationId"`
+	Parameters  []interface{}          `json:"parameters,omitempty"`
+	RequestBody interface{}            `json:"requestBody,omitempty"`
+	Responses   map[string]interface{} `json:"responses"`
+
+	produces  []string
+	responses map[string]string
+}
+
+type route struct {
+	method, path string
+	op           *operation
+}
+
+type generator struct {
+	types      map[string]*ast.TypeSpec
+	docs       map[string]string
+	schemas    map[string]interface{}
+	routes     []route
+	params     map[string]*ast.TypeSpec
+	responses  map[string]*ast.TypeSpec
+	modelNames map[string]string
+}
+
+func main() {
+	dir := flag.String("dir", ".", "package directory to read")
+	out := flag.String("out", "openapi.json", "file to write")
+	title := flag.String("title", "GML", "document title")
+	version := flag.String("version", "1.0.0", "API version")
+	description := flag.String("description", "", "document description")
+	flag.Parse()
+
+	g := &generator{
+		types:      make(map[string]*ast.TypeSpec),
+		docs:       make(map[string]string),
+		schemas:    make(map[string]interface{}),
+		params:     make(map[string]*ast.TypeSpec),
+		responses:  make(map[string]*ast.TypeSpec),
+		modelNames: make(map[string]string),
+	}
+	if err := g.parse(*dir); err != nil {
+		log.Fatalf("openapigen: %v", err)
+	}
+	doc := g.document(*title, *version, *description)
+
+	payload, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		log.Fatalf("openapigen: %v", err)
+	}
+	if err := os.WriteFile(*out, append(payload, '\n'), 0644); err != nil {
+		log.Fatalf("openapigen: %v", err)
+	}
+}
+
+func (g *generator) parse(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	fset := token.NewFileSet()
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, nil, parser.ParseComments)
+		if err != nil {
+			return err
+		}
+		for _, decl := range f.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Doc != nil {
+					g.parseRoute(decl.Doc.Text())
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					typeSpec, ok := spec.(*ast.TypeSpec)
+					if !ok {
+						continue
+					}
+					doc := typeSpec.Doc
+					if doc == nil && len(decl.Specs) == 1 {
+						doc = decl.Doc
+					}
+					g.types[typeSpec.Name.Name] = typeSpec
+					if doc != nil {
+						g.parseTypeDoc(typeSpec, doc.Text())
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (g *generator) parseTypeDoc(typeSpec *ast.TypeSpec, text string) {
+	var description []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0 || line == ".":
+		case fields[0] == "swagger:parameters":
+			for _, op := range fields[1:] {
+				g.params[op] = typeSpec
+			}
+		case fields[0] == "swagger:response":
+			name := typeSpec.Name.Name
+			if len(fields) > 1 {
+				name = fields[1]
+			}
+			g.responses[name] = typeSpec
+		case fields[0] == "swagger:model":
+			if len(fields) > 1 {
+				g.modelNames[typeSpec.Name.Name] = fields[1]
+			}
+		default:
+			// drop the leading "TypeName ." convention
+			line = strings.TrimPrefix(line, typeSpec.Name.Name+" .")
+			if line = strings.TrimSpace(line); line != "" {
+				description = append(description, line)
+			}
+		}
+	}
+	g.docs[typeSpec.Name.Name] = strings.Join(description, " ")
+}
+
+func (g *generator) parseRoute(text string) {
+	lines := strings.Split(text, "\n")
+	start := -1
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "swagger:route ") {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return
+	}
+	fields := strings.Fields(lines[start])
+	if len(fields) != 5 {
+		log.Fatalf("openapigen: malformed route %q, want swagger:route METHOD /path tag operationID", lines[start])
+	}
+	op := &operation{Tags: []string{fields[3]}, OperationID: fields[4], responses: make(map[string]string)}
+
+	const (
+		inSummary = iota
+		inDescription
+		inResponses
+	)
+	state := inSummary
+	var summary, description []string
+	for _, line := range lines[start+1:] {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "responses:":
+			state = inResponses
+		case strings.HasPrefix(line, "produces:"):
+			for _, mediaType := range strings.Split(strings.TrimPrefix(line, "produces:"), ",") {
+				op.produces = append(op.produces, strings.TrimSpace(mediaType))
+			}
+		case state == inResponses:
+			if match := responseLine.FindStringSubmatch(line); match != nil {
+				op.responses[match[1]] = match[2]
+			} else if line != "" {
+				state = -1
+			}
+		case state == inSummary:
+			if line == "" && len(summary) > 0 {
+				state = inDescription
+			} else if line != "" {
+				summary = append(summary, line)
+			}
+		case state == inDescription && line != "":
+			description = append(description, line)
+		}
+	}
+	op.Summary = strings.Join(summary, " ")
+	op.Description = strings.Join(description, " ")
+	g.routes = append(g.routes, route{method: strings.ToLower(fields[1]), path: fields[2], op: op})
+}
+
+func (g *generator) document(title, version, description string) *document {
+	doc := &document{
+		OpenAPI:    "3.0.3",
+		Info:       info{Title: title, Version: version, Description: description},
+		Paths:      make(map[string]pathItem),
+		Components: components{Schemas: g.schemas},
+	}
+
+	operations := make(map[string]bool)
+	for _, r := range g.routes {
+		operations[r.op.OperationID] = true
+		g.operationParams(r.op)
+		r.op.Responses = make(map[string]interface{})
+		for code, name := range r.op.responses {
+			mediaTypes := []string{"application/json"}
+			if strings.HasPrefix(code, "2") && len(r.op.produces) > 0 {
+				mediaTypes = r.op.produces
+			}
+			r.op.Responses[code] = g.response(name, mediaTypes)
+		}
+		if doc.Paths[r.path] == nil {
+			doc.Paths[r.path] = make(pathItem)
+		}
+		doc.Paths[r.path][r.method] = r.op
+	}
+
+	// parameters and responses without a route describe the simulator server methods
+	simServer := make(map[string]interface{})
+	for method, typeSpec := range g.params {
+		if operations[method] {
+			continue
+		}
+		entry := map[string]interface{}{"request": g.bodySchema(typeSpec)}
+		if respSpec, ok := g.responses[method]; ok {
+			entry["response"] = g.bodySchema(respSpec)
+		}
+		simServer[method] = entry
+	}
+	if len(simServer) > 0 {
+		doc.SimServer = simServer
+	}
+	return doc
+}
+
+func (g *generator) operationParams(op *operation) {
+	typeSpec, ok := g.params[op.OperationID]
+	if !ok {
+		return
+	}
+	structType, ok := typeSpec.Type.(*ast.StructType)
+	if !ok {
+		return
+	}
+	for _, field := range structType.Fields.List {
+		if len(field.Names) == 0 {
+			continue
+		}
+		doc := parseFieldDoc(field)
+		if doc.in == "body" || (doc.in == "" && field.Names[0].Name == "Body") {
+			op.RequestBody = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": g.fieldSchema(typeSpec.Name.Name, field.Type)},
+				},
+			}
+			continue
+		}
+		param := map[string]interface{}{
+			"name":     jsonName(field),
+			"in":       doc.in,
+			"required": doc.required || doc.in == "path",
+			"schema":   g.fieldSchema(typeSpec.Name.Name, field.Type),
+		}
+		if doc.description != "" {
+			param["description"] = doc.description
+		}
+		op.Parameters = append(op.Parameters, param)
+	}
+}
+
+func (g *generator) response(name string, mediaTypes []string) interface{} {
+	typeSpec, ok := g.responses[name]
+	if !ok {
+		log.Fatalf("openapigen: unknown response %s", name)
+	}
+	resp := map[string]interface{}{"description": g.docs[typeSpec.Name.Name]}
+	if resp["description"] == "" {
+		resp["description"] = name
+	}
+	if schema := g.bodySchema(typeSpec); schema != nil {
+		content := make(map[string]interface{})
+		for _, mediaType := range mediaTypes {
+			content[mediaType] = map[string]interface{}{"schema": schema}
+		}
+		resp["content"] = content
+	}
+	return resp
+}
+
+// bodySchema returns the schema of the Body field of a swagger:parameters or swagger:response struct
+func (g *generator) bodySchema(typeSpec *ast.TypeSpec) interface{} {
+	structType, ok := typeSpec.Type.(*ast.StructType)
+	if !ok {
+		return g.typeSchema(typeSpec.Name.Name, typeSpec.Type)
+	}
+	for _, field := range structType.Fields.List {
+		if len(field.Names) == 1 && (field.Names[0].Name == "Body" || parseFieldDoc(field).in == "body") {
+			return g.fieldSchema(typeSpec.Name.Name, field.Type)
+		}
+	}
+	return nil
+}
+
+// fieldSchema returns the schema of a field, anonymous structs become components named after their parent
+func (g *generator) fieldSchema(parent string, expr ast.Expr) interface{} {
+	if structType, ok := expr.(*ast.StructType); ok {
+		if _, done := g.schemas[parent]; !done {
+			g.schemas[parent] = nil
+			g.schemas[parent] = g.structSchema(parent, structType)
+		}
+		return ref(parent)
+	}
+	return g.typeSchema(parent, expr)
+}
+
+func (g *generator) typeSchema(parent string, expr ast.Expr) interface{} {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return g.typeSchema(parent, t.X)
+	case *ast.ArrayType:
+		if ident, ok := t.Elt.(*ast.Ident); ok && ident.Name == "byte" {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.typeSchema(parent, t.Elt)}
+	case *ast.MapType:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.typeSchema(parent, t.Value)}
+	case *ast.InterfaceType:
+		return map[string]interface{}{}
+	case *ast.StructType:
+		return g.structSchema(parent, t)
+	case *ast.SelectorExpr:
+		if pkg, ok := t.X.(*ast.Ident); ok && pkg.Name == "time" && t.Sel.Name == "Time" {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		return map[string]interface{}{"type": "object"}
+	case *ast.Ident:
+		switch t.Name {
+		case "string":
+			return map[string]interface{}{"type": "string"}
+		case "bool":
+			return map[string]interface{}{"type": "boolean"}
+		case "int", "int32", "uint", "uint32":
+			return map[string]interface{}{"type": "integer", "format": "int32"}
+		case "int64", "uint64":
+			return map[string]interface{}{"type": "integer", "format": "int64"}
+		case "float32", "float64":
+			return map[string]interface{}{"type": "number"}
+		}
+		typeSpec, ok := g.types[t.Name]
+		if !ok {
+			return map[string]interface{}{}
+		}
+		name := g.schemaName(t.Name)
+		if _, done := g.schemas[name]; !done {
+			// reserve the name first so recursive types terminate
+			g.schemas[name] = nil
+			schema := g.typeSchema(t.Name, typeSpec.Type)
+			if description := g.docs[t.Name]; description != "" {
+				if object, ok := schema.(map[string]interface{}); ok {
+					object["description"] = description
+				}
+			}
+			g.schemas[name] = schema
+		}
+		return ref(name)
+	}
+	return map[string]interface{}{}
+}
+
+func (g *generator) structSchema(parent string, structType *ast.StructType) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	g.addFields(parent, structType, properties, &required)
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (g *generator) addFields(parent string, structType *ast.StructType, properties map[string]interface{}, required *[]string) {
+	for _, field := range structType.Fields.List {
+		if len(field.Names) == 0 {
+			// embedded structs contribute their fields
+			expr := field.Type
+			if star, ok := expr.(*ast.StarExpr); ok {
+				expr = star.X
+			}
+			if ident, ok := expr.(*ast.Ident); ok {
+				if typeSpec, ok := g.types[ident.Name]; ok {
+					if embedded, ok := typeSpec.Type.(*ast.StructType); ok {
+						g.addFields(ident.Name, embedded, properties, required)
+					}
+				}
+			}
+			continue
+		}
+		if !field.Names[0].IsExported() {
+			continue
+		}
+		name := jsonName(field)
+		if name == "-" {
+			continue
+		}
+		nestedParent := parent + field.Names[0].Name
+		schema := g.typeSchema(nestedParent, field.Type)
+		doc := parseFieldDoc(field)
+		if doc.description != "" {
+			if _, isRef := schema.(map[string]interface{})["$ref"]; isRef {
+				schema = map[string]interface{}{"allOf": []interface{}{schema}, "description": doc.description}
+			} else {
+				schema.(map[string]interface{})["description"] = doc.description
+			}
+		}
+		properties[name] = schema
+		if doc.required {
+			*required = append(*required, name)
+		}
+	}
+}
+
+func (g *generator) schemaName(typeName string) string {
+	if name, ok := g.modelNames[typeName]; ok {
+		return name
+	}
+	return typeName
+}
+
+type fieldDoc struct {
+	description string
+	in          string
+	required    bool
+}
+
+func parseFieldDoc(field *ast.Field) fieldDoc {
+	doc := fieldDoc{}
+	if field.Tag != nil {
+		tag := reflect.StructTag(strings.Trim(field.Tag.Value, "`"))
+		for _, rule := range strings.Split(tag.Get("validate"), ",") {
+			if rule == "required" {
+				doc.required = true
+			}
+		}
+	}
+	if field.Doc == nil {
+		return doc
+	}
+	var description []string
+	for _, line := range strings.Split(field.Doc.Text(), "\n") {
+		line = strings.TrimSpace(line)
+		key, value, found := strings.Cut(line, ":")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch {
+		case found && key == "in":
+			doc.in = value
+		case found && key == "required":
+			doc.required = value == "true"
+		case line != "":
+			description = append(description, line)
+		}
+	}
+	doc.description = strings.Join(description, " ")
+	return doc
+}
+
+func jsonName(field *ast.Field) string {
+	if field.Tag != nil {
+		tag := reflect.StructTag(strings.Trim(field.Tag.Value, "`"))
+		if name := strings.Split(tag.Get("json"), ",")[0]; name != "" {
+			return name
+		}
+	}
+	return field.Names[0].Name
+}
+
+func ref(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": fmt.Sprintf("#/components/schemas/%s", name)}
+}